@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// rules a configmap can hold are at most 1MiB compressed, this leaves
+	// room for a good ratio without letting a value blow up the loader
+	defaultMaxDecompressedBytes = 8 << 20
+	defaultMaxCompressionRatio  = 100
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// configMapValues returns the keys of Data and BinaryData together, the api
+// server doesn't allow a key in both.
+func configMapValues(cm *corev1.ConfigMap) map[string][]byte {
+	values := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for key, value := range cm.Data {
+		values[key] = []byte(value)
+	}
+	for key, value := range cm.BinaryData {
+		values[key] = value
+	}
+	return values
+}
+
+// compression tells how value is compressed by its magic bytes, or by the
+// suffix of its key for values too short to have them. Empty if it isn't.
+func compression(key string, value []byte) string {
+	switch {
+	case bytes.HasPrefix(value, gzipMagic), strings.HasSuffix(key, ".gz"):
+		return CompressionGzip
+	case bytes.HasPrefix(value, zstdMagic), strings.HasSuffix(key, ".zst"):
+		return CompressionZstd
+	}
+	return ""
+}
+
+// uncompressedKey strips the compression suffix, key.yaml.gz is parsed like
+// key.yaml.
+func uncompressedKey(key string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(key, ".gz"), ".zst")
+}
+
+func (p *Pipeline) decompressionLimits() (int, int) {
+	maxBytes, maxRatio := p.maxDecompressedBytes, p.maxCompressionRatio
+	if maxBytes == 0 {
+		maxBytes = defaultMaxDecompressedBytes
+	}
+	if maxRatio == 0 {
+		maxRatio = defaultMaxCompressionRatio
+	}
+	return maxBytes, maxRatio
+}
+
+// decompressValue returns value decompressed if it is compressed, as is
+// otherwise. Decompression stops as soon as the result gets larger than the
+// limits of pipeline p allow, to keep decompression bombs out.
+func (p *Pipeline) decompressValue(key string, value []byte) (string, error) {
+	method := compression(key, value)
+	if method == "" {
+		return string(value), nil
+	}
+
+	maxBytes, maxRatio := p.decompressionLimits()
+	limit := int64(maxBytes)
+	ratioLimited := false
+	if byRatio := int64(len(value)) * int64(maxRatio); byRatio < limit {
+		limit = byRatio
+		ratioLimited = true
+	}
+
+	var reader io.Reader
+	switch method {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return "", fmt.Errorf("invalid gzip value: %s", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case CompressionZstd:
+		zstdReader, err := zstd.NewReader(bytes.NewReader(value), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxBytes)))
+		if err != nil {
+			return "", fmt.Errorf("invalid zstd value: %s", err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("invalid %s value: %s", method, err)
+	}
+	if int64(len(decompressed)) > limit {
+		if ratioLimited {
+			return "", fmt.Errorf("%s value of %d bytes decompresses to more than %d times its size", method, len(value), maxRatio)
+		}
+		return "", fmt.Errorf("%s value decompresses to more than %d bytes", method, maxBytes)
+	}
+	return string(decompressed), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func gzipValue(value string) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(value))
+	writer.Close()
+	return buf.Bytes()
+}
+
+func zstdValue(value string) []byte {
+	encoder, _ := zstd.NewWriter(nil)
+	defer encoder.Close()
+	return encoder.EncodeAll([]byte(value), nil)
+}
+
+func binaryConfigMap(data map[string][]byte) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "compressed",
+			Namespace:   "team-a",
+			Annotations: map[string]string{myAnno: "true"},
+		},
+		Data:       map[string]string{"plain": configmapDataBlockRules.Data["rules"]},
+		BinaryData: data,
+	}
+}
+
+func TestCompression(t *testing.T) {
+	Convey("Compression should be told by magic bytes or the key suffix", t, func() {
+		So(compression("rules", gzipValue("x")), ShouldEqual, CompressionGzip)
+		So(compression("rules", zstdValue("x")), ShouldEqual, CompressionZstd)
+		So(compression("rules.gz", []byte("x")), ShouldEqual, CompressionGzip)
+		So(compression("rules", []byte("groups: []")), ShouldEqual, "")
+		So(uncompressedKey("rules.json.gz"), ShouldEqual, "rules.json")
+	})
+}
+
+func TestDecompressValue(t *testing.T) {
+	bomb := gzipValue(strings.Repeat(" ", 1<<20))
+
+	Convey("Values within the limits should be decompressed", t, func() {
+		value, err := pipeline.decompressValue("rules", zstdValue("groups: []"))
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "groups: []")
+	})
+
+	Convey("Decompression bombs should be stopped by the ratio or size limit", t, func() {
+		_, err := pipeline.decompressValue("rules", bomb)
+		So(err.Error(), ShouldEndWith, "decompresses to more than 100 times its size")
+
+		lp := &Pipeline{Name: "limits", maxDecompressedBytes: 1024, maxCompressionRatio: 100000}
+		_, err = lp.decompressValue("rules", bomb)
+		So(err.Error(), ShouldEqual, "gzip value decompresses to more than 1024 bytes")
+
+		_, err = pipeline.decompressValue("rules.gz", []byte("groups: []"))
+		So(err.Error(), ShouldStartWith, "invalid gzip value")
+	})
+}
+
+func TestExtractValuesBinaryData(t *testing.T) {
+	Convey("Compressed binaryData keys should be loaded next to data keys", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, binaryConfigMap(map[string][]byte{
+			"gzip.yaml.gz": gzipValue(configmapDataBlockRules.Data["rules"]),
+			"zstd.json":    zstdValue(jsonRuleGroups),
+			"bomb":         gzipValue(strings.Repeat(" ", 1<<20)),
+		}))
+		So(len(mrg.Values), ShouldEqual, 3)
+		So(len(mrg.Reports), ShouldEqual, 4)
+		So(mrg.Reports[0].Key, ShouldEqual, "bomb")
+		So(mrg.Reports[0].Errors[0].Error(), ShouldContainSubstring, "more than 100 times its size")
+		So(events.CountWarnings(), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Config is the layout of the -config file. It is watched for changes and
+// applied at runtime, see configWatcher.
+//
+//	namespaces: team-*,monitoring
+//	quota:
+//	  rules: 200
+//	pipelines:
+//	- name: platform
+//	  annotation: prometheus.io/v2/rules
+//	  target: platform
+//	  rulesPath: /rules/platform.yaml
+//	  reloadEndpoints: [http://localhost:9090/-/reload]
+type Config struct {
+	Namespaces        string           `yaml:"namespaces,omitempty"`
+	ExcludeNamespaces string           `yaml:"excludeNamespaces,omitempty"`
+	NamespaceSelector string           `yaml:"namespaceSelector,omitempty"`
+	Quota             NamespaceQuota   `yaml:"quota,omitempty"`
+	QuotaAnnotation   string           `yaml:"quotaAnnotation,omitempty"`
+	Pipelines         []PipelineConfig `yaml:"pipelines"`
+}
+
+// PipelineConfig describes where a pipeline gets its rules from and where
+// they go.
+type PipelineConfig struct {
+	Name          string `yaml:"name"`
+	Annotation    string `yaml:"annotation"`
+	Target        string `yaml:"target,omitempty"`
+	LabelSelector string `yaml:"labelSelector,omitempty"`
+	RulesPath     string `yaml:"rulesPath,omitempty"`
+	// Output is "file" (the default) to write RulesPath, "configmap" to
+	// write OutputConfigMap (namespace/name) or "ruler" to push to RulerURL.
+	Output          string `yaml:"output,omitempty"`
+	OutputConfigMap string `yaml:"outputConfigMap,omitempty"`
+	// RulerURL is the Cortex or Mimir ruler the "ruler" output pushes to,
+	// every kubernetes namespace becomes the ruler namespace
+	// RulerNamespacePrefix + namespace of tenant RulerTenant.
+	RulerURL             string   `yaml:"rulerUrl,omitempty"`
+	RulerTenant          string   `yaml:"rulerTenant,omitempty"`
+	RulerNamespacePrefix string   `yaml:"rulerNamespacePrefix,omitempty"`
+	ReloadEndpoints      []string `yaml:"reloadEndpoints"`
+	StatusAnnotation     string   `yaml:"statusAnnotation,omitempty"`
+	PolicyFile           string   `yaml:"policyFile,omitempty"`
+	// Shards spreads the rule groups over this many rules files, one per
+	// reload endpoint.
+	Shards          int    `yaml:"shards,omitempty"`
+	ShardAnnotation string `yaml:"shardAnnotation,omitempty"`
+	// Language is "promql" (the default) or "logql", the pipeline only
+	// loads configmaps whose LanguageAnnotation names the same language.
+	Language           string `yaml:"language,omitempty"`
+	LanguageAnnotation string `yaml:"languageAnnotation,omitempty"`
+	// Backend is "prometheus" (the default) or "thanos", group fields the
+	// backend doesn't know are dropped, or rejected with StrictGroupFields.
+	Backend           string `yaml:"backend,omitempty"`
+	StrictGroupFields bool   `yaml:"strictGroupFields,omitempty"`
+	// PrometheusVersion rejects groups using fields newer than it, such as
+	// limit before 2.31. Empty allows every field.
+	PrometheusVersion string `yaml:"prometheusVersion,omitempty"`
+	// RejectConflicts drops the newer of two recording rules of the same
+	// name that differ, or of two overlapping alerts of the same name.
+	RejectConflicts bool `yaml:"rejectConflicts,omitempty"`
+	// ReorderRules puts recording rules before the rules of their group
+	// that use them.
+	ReorderRules bool `yaml:"reorderRules,omitempty"`
+	// SeriesCheckURL is a Prometheus asked whether the selectors of the
+	// rules match any series, empty disables the check. Answers are cached
+	// for SeriesCheckTTL.
+	SeriesCheckURL string        `yaml:"seriesCheckUrl,omitempty"`
+	SeriesCheckTTL time.Duration `yaml:"seriesCheckTtl,omitempty"`
+	// MaxDecompressedBytes and MaxCompressionRatio limit what gzip and zstd
+	// compressed values may decompress to, 0 uses the defaults.
+	MaxDecompressedBytes int `yaml:"maxDecompressedBytes,omitempty"`
+	MaxCompressionRatio  int `yaml:"maxCompressionRatio,omitempty"`
+	// TemplateAnnotation names the rule template a configmap defines, it is
+	// only read from namespaces matching TemplateNamespaces (comma separated
+	// name patterns, empty disables templates).
+	TemplateAnnotation string `yaml:"templateAnnotation,omitempty"`
+	TemplateNamespaces string `yaml:"templateNamespaces,omitempty"`
+}
+
+// parseConfig reads content on top of base, settings the file leaves out
+// keep the value they have in base. Pipelines are replaced as a whole.
+func parseConfig(content []byte, base Config) (*Config, error) {
+	config := &base
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("Unable to parse config: %s", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (config *Config) namespaceFilter() (*NamespaceFilter, error) {
+	return NewNamespaceFilter(config.Namespaces, config.ExcludeNamespaces, config.NamespaceSelector)
+}
+
+// sameRuler is true if the ruler outputs of a and b write the rules of the
+// same tenant.
+func sameRuler(a, b PipelineConfig) bool {
+	return strings.TrimSuffix(a.RulerURL, "/") == strings.TrimSuffix(b.RulerURL, "/") && a.RulerTenant == b.RulerTenant
+}
+
+func (config *Config) validate() error {
+	if len(config.Pipelines) == 0 {
+		return fmt.Errorf("Config has no pipelines")
+	}
+
+	names := make(map[string]struct{})
+	paths := make(map[string]string)
+	rulers := make([]PipelineConfig, 0)
+	for _, p := range config.Pipelines {
+		if p.Name == "" {
+			return fmt.Errorf("Pipeline without a name")
+		}
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("Pipeline name %q is used more than once", p.Name)
+		}
+		names[p.Name] = struct{}{}
+
+		if p.Annotation == "" {
+			return fmt.Errorf("Pipeline %s: annotation must be set", p.Name)
+		}
+		target := p.RulesPath
+		switch p.Output {
+		case "", OutputFile:
+			if p.RulesPath == "" {
+				return fmt.Errorf("Pipeline %s: rulesPath must be set", p.Name)
+			}
+			// a local Prometheus has to be told about the new file
+			if len(p.ReloadEndpoints) == 0 {
+				return fmt.Errorf("Pipeline %s: reloadEndpoints must be set", p.Name)
+			}
+		case OutputConfigMap:
+			if err := validateOutputConfigMap(p.Name, p.OutputConfigMap); err != nil {
+				return fmt.Errorf("Pipeline %s: %s", p.Name, err)
+			}
+			target = "configmap " + p.OutputConfigMap
+		case OutputRuler:
+			if p.RulerURL == "" {
+				return fmt.Errorf("Pipeline %s: rulerUrl must be set", p.Name)
+			}
+			if p.Shards > 0 {
+				return fmt.Errorf("Pipeline %s: the ruler output can't be sharded, the ruler shards by itself", p.Name)
+			}
+			// every ruler namespace with the prefix is pruned, without one
+			// that is every namespace of the tenant
+			if p.RulerNamespacePrefix == "" {
+				return fmt.Errorf("Pipeline %s: rulerNamespacePrefix must be set, the loader deletes the groups of every ruler namespace starting with it", p.Name)
+			}
+			for _, other := range rulers {
+				if sameRuler(p, other) && (strings.HasPrefix(p.RulerNamespacePrefix, other.RulerNamespacePrefix) || strings.HasPrefix(other.RulerNamespacePrefix, p.RulerNamespacePrefix)) {
+					return fmt.Errorf("Pipeline %s: rulerNamespacePrefix %q overlaps %q of pipeline %s, each would delete the groups of the other", p.Name, p.RulerNamespacePrefix, other.RulerNamespacePrefix, other.Name)
+				}
+			}
+			rulers = append(rulers, p)
+			target = fmt.Sprintf("ruler %s tenant %q namespaces %s*", p.RulerURL, p.RulerTenant, p.RulerNamespacePrefix)
+		default:
+			return fmt.Errorf("Pipeline %s: output must be %q, %q or %q, got %q", p.Name, OutputFile, OutputConfigMap, OutputRuler, p.Output)
+		}
+		if other, ok := paths[target]; ok {
+			return fmt.Errorf("Pipeline %s: %s is already written by pipeline %s", p.Name, target, other)
+		}
+		paths[target] = p.Name
+
+		if p.Language != "" && p.Language != LanguagePromQL && p.Language != LanguageLogQL {
+			return fmt.Errorf("Pipeline %s: language must be %q or %q, got %q", p.Name, LanguagePromQL, LanguageLogQL, p.Language)
+		}
+		if _, ok := backendGroupFields[p.Backend]; p.Backend != "" && !ok {
+			return fmt.Errorf("Pipeline %s: backend must be %q or %q, got %q", p.Name, BackendPrometheus, BackendThanos, p.Backend)
+		}
+		if p.Backend == BackendThanos && (p.Output == OutputRuler || p.Language == LanguageLogQL) {
+			return fmt.Errorf("Pipeline %s: the thanos backend reads PromQL rules files, it can't be used with the ruler output or LogQL", p.Name)
+		}
+		if p.PrometheusVersion != "" {
+			if _, err := parsePrometheusVersion(p.PrometheusVersion); err != nil {
+				return fmt.Errorf("Pipeline %s: %s", p.Name, err)
+			}
+		}
+		if p.SeriesCheckURL != "" {
+			if u, err := url.Parse(p.SeriesCheckURL); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("Pipeline %s: seriesCheckUrl must be an absolute URL, got %q", p.Name, p.SeriesCheckURL)
+			}
+			if p.Language == LanguageLogQL {
+				return fmt.Errorf("Pipeline %s: seriesCheckUrl needs a Prometheus, it can't check LogQL rules", p.Name)
+			}
+		}
+		if p.SeriesCheckTTL < 0 {
+			return fmt.Errorf("Pipeline %s: seriesCheckTtl must not be negative", p.Name)
+		}
+		if p.MaxDecompressedBytes < 0 || p.MaxCompressionRatio < 0 {
+			return fmt.Errorf("Pipeline %s: maxDecompressedBytes and maxCompressionRatio must not be negative", p.Name)
+		}
+		if p.TemplateAnnotation != "" && p.TemplateAnnotation == p.Annotation {
+			return fmt.Errorf("Pipeline %s: templateAnnotation must differ from annotation, templates aren't rules", p.Name)
+		}
+		for _, pattern := range splitList(p.TemplateNamespaces) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Pipeline %s: invalid template namespace pattern %q: %s", p.Name, pattern, err)
+			}
+		}
+		if p.Shards < 0 {
+			return fmt.Errorf("Pipeline %s: shards must not be negative", p.Name)
+		}
+		if p.Shards > 0 && len(p.ReloadEndpoints) > 0 && len(p.ReloadEndpoints) != p.Shards {
+			return fmt.Errorf("Pipeline %s: %d shards need %d reload endpoints, one per shard, got %d", p.Name, p.Shards, p.Shards, len(p.ReloadEndpoints))
+		}
+	}
+
+	if config.Quota.Groups < 0 || config.Quota.Rules < 0 || config.Quota.ExprBytes < 0 {
+		return fmt.Errorf("Quota limits must not be negative")
+	}
+	if _, err := config.namespaceFilter(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateLabelSelectors checks that no pipeline selects configmaps the label
+// selector of the configmap watch, server, keeps from the loader. Every
+// pipeline has to require what server requires, a pipeline without a selector
+// of its own gets server.
+func (config *Config) validateLabelSelectors(server string) error {
+	serverSelector, err := labels.Parse(server)
+	if err != nil {
+		return fmt.Errorf("Invalid label selector %q: %s", server, err)
+	}
+	required, _ := serverSelector.Requirements()
+
+	for i := range config.Pipelines {
+		p := &config.Pipelines[i]
+		if p.LabelSelector == "" {
+			p.LabelSelector = server
+			continue
+		}
+		selector, err := labels.Parse(p.LabelSelector)
+		if err != nil {
+			return fmt.Errorf("Pipeline %s: invalid label selector %q: %s", p.Name, p.LabelSelector, err)
+		}
+		requirements, _ := selector.Requirements()
+		has := make(map[string]struct{})
+		for _, requirement := range requirements {
+			has[requirement.String()] = struct{}{}
+		}
+		for _, requirement := range required {
+			if _, ok := has[requirement.String()]; !ok {
+				return fmt.Errorf("Pipeline %s: labelSelector %q selects configmaps the label selector %q of the watch excludes, it has to require %s as well", p.Name, p.LabelSelector, server, requirement.String())
+			}
+		}
+	}
+	return nil
+}
+
+// validateOutputConfigMap checks that the output configmap can be written and
+// labelled with the names of its pipeline and itself.
+func validateOutputConfigMap(pipeline, target string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(target)
+	if err != nil || namespace == "" || name == "" {
+		return fmt.Errorf("outputConfigMap must be namespace/name, got %q", target)
+	}
+	for _, value := range []string{pipeline, name} {
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("%q can't be used as a label value: %s", value, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseConfig(t *testing.T) {
+	Convey("A config with several pipelines should parse", t, func() {
+		config, err := parseConfig([]byte(`
+pipelines:
+- name: platform
+  annotation: prometheus.io/v2/rules
+  target: platform
+  rulesPath: /rules/platform.yaml
+  reloadEndpoints: [http://localhost:9090/-/reload]
+- name: teams
+  annotation: prometheus.io/v2/rules
+  labelSelector: team
+  rulesPath: /rules/teams.yaml
+  reloadEndpoints: [http://localhost:9091/-/reload, http://localhost:9092/-/reload]
+`), Config{})
+		So(err, ShouldBeNil)
+		So(len(config.Pipelines), ShouldEqual, 2)
+		So(config.Pipelines[0].Target, ShouldEqual, "platform")
+		So(config.Pipelines[1].ReloadEndpoints, ShouldResemble, []string{"http://localhost:9091/-/reload", "http://localhost:9092/-/reload"})
+
+		pipeline, err := NewPipeline(config.Pipelines[1])
+		So(err, ShouldBeNil)
+		So(pipeline.selector.String(), ShouldEqual, "team")
+		pipeline.workqueue.ShutDown()
+	})
+
+	Convey("Settings the file leaves out should keep their value", t, func() {
+		base := Config{
+			Namespaces:      "team-*",
+			Quota:           NamespaceQuota{Groups: 10, Rules: 100},
+			QuotaAnnotation: "quota",
+			Pipelines:       []PipelineConfig{{Name: "default", Annotation: "a", RulesPath: "/rules", ReloadEndpoints: []string{"e"}}},
+		}
+
+		config, err := parseConfig([]byte("quota:\n  rules: 200\nexcludeNamespaces: kube-*\n"), base)
+		So(err, ShouldBeNil)
+		So(config.Namespaces, ShouldEqual, "team-*")
+		So(config.ExcludeNamespaces, ShouldEqual, "kube-*")
+		So(config.Quota, ShouldResemble, NamespaceQuota{Groups: 10, Rules: 200})
+		So(config.QuotaAnnotation, ShouldEqual, "quota")
+		So(config.Pipelines, ShouldResemble, base.Pipelines)
+
+		config, err = parseConfig([]byte("pipelines:\n- name: other\n  annotation: b\n  rulesPath: /other\n  reloadEndpoints: [e]\n"), base)
+		So(err, ShouldBeNil)
+		So(len(config.Pipelines), ShouldEqual, 1)
+		So(config.Pipelines[0].Name, ShouldEqual, "other")
+	})
+
+	Convey("Pipelines writing to a configmap need no rules path or endpoints", t, func() {
+		config, err := parseConfig([]byte("pipelines:\n- name: a\n  annotation: x\n  output: configmap\n  outputConfigMap: monitoring/rules\n"), Config{})
+		So(err, ShouldBeNil)
+		So(config.Pipelines[0].OutputConfigMap, ShouldEqual, "monitoring/rules")
+	})
+
+	Convey("Broken configs should be rejected", t, func() {
+		broken := []string{
+			``,
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  endpoint: e\n",
+			"pipelines:\n- annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n- name: a\n  annotation: x\n  rulesPath: /b\n  reloadEndpoints: [e]\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n- name: b\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n",
+			"namespaces: '['\npipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  shards: 2\n",
+			"pipelines:\n- name: a\n  annotation: x\n  output: configmap\n  outputConfigMap: rules\n",
+			"pipelines:\n- name: a\n  annotation: x\n  output: s3\n  rulesPath: /a\n  reloadEndpoints: [e]\n",
+			"pipelines:\n- name: a\n  annotation: x\n  output: ruler\n",
+			"pipelines:\n- name: a\n  annotation: x\n  output: ruler\n  rulerUrl: http://ruler\n  shards: 2\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  language: sql\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  backend: cortex\n",
+			"pipelines:\n- name: a\n  annotation: x\n  backend: thanos\n  output: ruler\n  rulerUrl: http://ruler\n  rulerNamespacePrefix: k8s-\n",
+			"pipelines:\n- name: a\n  annotation: x\n  output: ruler\n  rulerUrl: http://ruler\n",
+			"pipelines:\n- name: a\n  annotation: x\n  output: ruler\n  rulerUrl: http://ruler\n  rulerNamespacePrefix: k8s-\n- name: b\n  annotation: y\n  output: ruler\n  rulerUrl: http://ruler/\n  rulerNamespacePrefix: k8s-team-\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  prometheusVersion: latest\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  seriesCheckUrl: prometheus:9090\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  seriesCheckUrl: http://prometheus:9090\n  seriesCheckTtl: -1m\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  maxCompressionRatio: -1\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  templateAnnotation: x\n",
+			"pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n  templateNamespaces: \"platform-[\"\n",
+			"quota:\n  rules: -1\npipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n",
+		}
+		for _, content := range broken {
+			_, err := parseConfig([]byte(content), Config{})
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Ruler pipelines should only share a prefix across tenants", t, func() {
+		content := "pipelines:\n- name: a\n  annotation: x\n  output: ruler\n  rulerUrl: http://ruler\n  rulerTenant: a\n  rulerNamespacePrefix: k8s-\n- name: b\n  annotation: y\n  output: ruler\n  rulerUrl: http://ruler\n  rulerTenant: b\n  rulerNamespacePrefix: k8s-\n"
+		_, err := parseConfig([]byte(content), Config{})
+		So(err, ShouldBeNil)
+	})
+
+	Convey("The config built from the flags should be validated too", t, func() {
+		So(configFromFlags().validate(), ShouldBeNil)
+
+		defer func(n int) { *shards = n }(*shards)
+		*shards = 2
+		So(configFromFlags().validate(), ShouldNotBeNil)
+	})
+
+	Convey("Pipelines should only narrow down the label selector of the watch", t, func() {
+		config := &Config{Pipelines: []PipelineConfig{
+			{Name: "all"},
+			{Name: "teams", LabelSelector: "owner=team,rules=enabled"},
+		}}
+		So(config.validateLabelSelectors("rules=enabled"), ShouldBeNil)
+		So(config.Pipelines[0].LabelSelector, ShouldEqual, "rules=enabled")
+
+		for _, selector := range []string{"owner=team", "rules!=enabled", "rules in (enabled, disabled)"} {
+			config.Pipelines[1].LabelSelector = selector
+			So(config.validateLabelSelectors("rules=enabled"), ShouldNotBeNil)
+		}
+		So(config.validateLabelSelectors("rules in ("), ShouldNotBeNil)
+
+		defer func(selector string) { *labelSelector = selector }(*labelSelector)
+		*labelSelector = "rules=enabled"
+		So(configFromFlags().Pipelines[0].LabelSelector, ShouldEqual, "rules=enabled")
+		_, err := parseConfigWithFlags([]byte("pipelines:\n- name: a\n  annotation: x\n  labelSelector: owner=team\n  rulesPath: /rules/a.yaml\n  reloadEndpoints: [http://localhost:9090/-/reload]\n"))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEnqueueConfigMapPipelines(t *testing.T) {
+	Convey("Configmaps should only be queued on the pipelines that select them", t, func() {
+		rules, err := NewPipeline(PipelineConfig{Name: "rules", Annotation: myAnno})
+		So(err, ShouldBeNil)
+		other, err := NewPipeline(PipelineConfig{Name: "other", Annotation: "other-annotation"})
+		So(err, ShouldBeNil)
+		defer rules.workqueue.ShutDown()
+		defer other.workqueue.ShutDown()
+
+		pc := &Controller{pipelines: []*Pipeline{rules, other}}
+		pc.enqueueConfigMap(&configmapDataBlockRules)
+
+		So(rules.workqueue.Len(), ShouldEqual, 1)
+		So(other.workqueue.Len(), ShouldEqual, 0)
+	})
+}
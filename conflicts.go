@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	ErrRuleConflict = "RuleConflict"
+)
+
+// ruleDefinition is a rule along with where it was loaded from.
+type ruleDefinition struct {
+	cm    *corev1.ConfigMap
+	rules *MultiRuleGroups
+	key   string
+	rule  rulefmt.Rule
+}
+
+// ruleIndex holds the rules loaded so far by kind and name, see ruleID.
+type ruleIndex map[string][]ruleDefinition
+
+func ruleID(rule rulefmt.Rule) string {
+	if rule.Record != "" {
+		return "record:" + rule.Record
+	}
+	return "alert:" + rule.Alert
+}
+
+// ruleConflict explains why two rules of the same name from different
+// configmaps can't both be loaded, empty if they can. Recording rules of the
+// same name have to be identical or they produce a flapping series. Alerts of
+// the same name are a conflict when their labels overlap, that is they don't
+// differ in the value of any label both set, as the same alert would then
+// fire twice. The same alert at several severities is fine.
+func ruleConflict(language string, a, b rulefmt.Rule) string {
+	if a.Record != "" {
+		if normalizeExpr(language, a.Expr) != normalizeExpr(language, b.Expr) {
+			return "a different expression"
+		}
+		if !sameLabels(a.Labels, b.Labels) {
+			return "different labels"
+		}
+		return ""
+	}
+
+	for name, value := range a.Labels {
+		if other, ok := b.Labels[name]; ok && other != value {
+			return ""
+		}
+	}
+	return "overlapping labels"
+}
+
+// normalizeExpr makes expressions that only differ in formatting compare equal.
+func normalizeExpr(language, expr string) string {
+	if language != LanguageLogQL {
+		if parsed, err := promql.ParseExpr(expr); err == nil {
+			return parsed.String()
+		}
+	}
+	return strings.Join(strings.Fields(expr), " ")
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkConflicts compares the rules of cm with the rules of the configmaps
+// pipeline p loaded before it, which are older. Conflicts are reported on
+// both configmaps, as events and in their status. When p rejects conflicts
+// the rule of cm, the newer definition, is dropped as well.
+func (c *Controller) checkConflicts(p *Pipeline, cm *corev1.ConfigMap, cmRules *MultiRuleGroups, index ruleIndex) int {
+	conflicts := 0
+	nameStub := c.createNameStub(cm)
+	for i := range cmRules.Values {
+		key := cmRules.Keys[i]
+		groups := make([]RuleGroup, 0, len(cmRules.Values[i].Groups))
+		rejected := false
+		for _, group := range cmRules.Values[i].Groups {
+			remove := make([]int, 0)
+			for j, rule := range group.Rules {
+				id := ruleID(rule)
+				name := strings.TrimPrefix(strings.TrimPrefix(id, "record:"), "alert:")
+
+				conflicting := false
+				for _, older := range index[id] {
+					if older.cm == cm {
+						continue
+					}
+					reason := ruleConflict(p.queryLanguage(), older.rule, rule)
+					if reason == "" {
+						continue
+					}
+					conflicting = true
+					conflicts++
+					olderStub := c.createNameStub(older.cm)
+
+					verr := ValidationError{Group: group.Name, Rule: name, Err: fmt.Errorf("conflicts with the rule of the same name in configmap %s key %s, %s", olderStub, older.key, reason)}
+					if p.rejectConflicts {
+						verr.Err = fmt.Errorf("%s, rejected as the newer definition", verr.Err)
+						addReportError(cmRules, key, verr)
+					} else {
+						addReportWarning(cmRules, key, verr)
+					}
+					c.recordEvent(cm, corev1.EventTypeWarning, ErrRuleConflict, fmt.Sprintf("Rule conflict: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, key, verr.Error()))
+
+					olderErr := ValidationError{Rule: name, Err: fmt.Errorf("conflicts with the rule of the same name in configmap %s key %s, %s", nameStub, key, reason)}
+					addReportWarning(older.rules, older.key, olderErr)
+					c.recordEvent(older.cm, corev1.EventTypeWarning, ErrRuleConflict, fmt.Sprintf("Rule conflict: Namespace-ConfigMap:%s, Key:%s, %s", olderStub, older.key, olderErr.Error()))
+				}
+
+				if conflicting && p.rejectConflicts {
+					remove = append(remove, j)
+					continue
+				}
+				index[id] = append(index[id], ruleDefinition{cm: cm, rules: cmRules, key: key, rule: rule})
+			}
+
+			c.removeRules(&group, remove)
+			rejected = rejected || len(remove) > 0
+			if len(group.Rules) > 0 {
+				groups = append(groups, group)
+			} else if len(remove) > 0 {
+				addReportError(cmRules, key, ValidationError{Group: group.Name, Err: fmt.Errorf("every rule of the group was rejected as a conflict, the group is dropped")})
+			}
+		}
+		cmRules.Values[i].Groups = groups
+		// the report counts what is left to load
+		if rejected {
+			countReportRules(cmRules, key, groups)
+		}
+	}
+
+	return conflicts
+}
+
+func addReportError(mrg *MultiRuleGroups, key string, verr ValidationError) {
+	for i := range mrg.Reports {
+		if mrg.Reports[i].Key == key {
+			mrg.Reports[i].Errors = append(mrg.Reports[i].Errors, verr)
+		}
+	}
+}
+
+// countReportRules sets the groups and rules the report of key loads to
+// groups, a key left without any isn't accepted.
+func countReportRules(mrg *MultiRuleGroups, key string, groups []RuleGroup) {
+	rules := 0
+	for _, group := range groups {
+		rules += len(group.Rules)
+	}
+	for i := range mrg.Reports {
+		if mrg.Reports[i].Key == key {
+			mrg.Reports[i].Groups = len(groups)
+			mrg.Reports[i].Rules = rules
+			mrg.Reports[i].Accepted = len(groups) > 0
+		}
+	}
+}
+
+func addReportWarning(mrg *MultiRuleGroups, key string, verr ValidationError) {
+	for i := range mrg.Reports {
+		if mrg.Reports[i].Key == key {
+			mrg.Reports[i].Warnings = append(mrg.Reports[i].Warnings, verr)
+		}
+	}
+}
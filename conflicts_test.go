@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func conflictConfigMap(namespace string, age time.Duration, rules string) corev1.ConfigMap {
+	return corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "slo",
+			Namespace:         namespace,
+			Annotations:       map[string]string{myAnno: "true"},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Data: map[string]string{"rules": rules},
+	}
+}
+
+const (
+	olderConflictRules = `
+- record: job:http_requests:rate5m
+  expr: sum by (job) (rate(http_requests_total[5m]))
+- alert: HighErrorRate
+  expr: job:http_errors:rate5m > 1
+  labels:
+    severity: page
+`
+	// the recording rule only differs in formatting, the alert in severity
+	compatibleRules = `
+- record: job:http_requests:rate5m
+  expr: sum  by(job) (rate(http_requests_total[5m]))
+- alert: HighErrorRate
+  expr: job:http_errors:rate5m > 0.5
+  labels:
+    severity: ticket
+`
+	conflictingRules = `
+- record: job:http_requests:rate5m
+  expr: sum by (job) (rate(http_requests_total[1m]))
+- alert: HighErrorRate
+  expr: job:http_errors:rate5m > 2
+  labels:
+    severity: page
+    team: b
+- alert: Unrelated
+  expr: up == 0
+`
+)
+
+func TestCheckConflicts(t *testing.T) {
+	statuses := make(map[string][]ValidationReport)
+	cc := &Controller{
+		configmapEventRecorderFunc: events.Add,
+		configmapStatusFunc: func(p *Pipeline, cm *corev1.ConfigMap, reports []ValidationReport) {
+			statuses[cm.Namespace] = reports
+		},
+	}
+
+	Convey("Rules that only differ in formatting or severity should not conflict", t, func() {
+		events.Clear()
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{
+			conflictConfigMap("team-a", time.Hour, olderConflictRules),
+			conflictConfigMap("team-b", time.Minute, compatibleRules),
+		}}
+		mrg := cc.collectRuleGroups(pipeline, list)
+		So(len(mrg.Values), ShouldEqual, 2)
+		So(events.CountWarnings(), ShouldEqual, 0)
+	})
+
+	Convey("Conflicts should be reported on both configmaps", t, func() {
+		events.Clear()
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{
+			conflictConfigMap("team-b", time.Minute, conflictingRules),
+			conflictConfigMap("team-a", time.Hour, olderConflictRules),
+		}}
+		mrg := cc.collectRuleGroups(pipeline, list)
+		So(events.CountWarnings(), ShouldEqual, 4)
+		So(len(mrg.Values[1].Groups[0].Rules), ShouldEqual, 3)
+
+		So(len(statuses["team-a"][0].Warnings), ShouldEqual, 2)
+		So(statuses["team-a"][0].Warnings[0].Error(), ShouldContainSubstring, "configmap team-b-slo key rules, a different expression")
+		So(len(statuses["team-b"][0].Warnings), ShouldEqual, 2)
+		So(statuses["team-b"][0].Warnings[1].Error(), ShouldContainSubstring, "configmap team-a-slo key rules, overlapping labels")
+		So(statuses["team-b"][0].Errors, ShouldBeEmpty)
+	})
+
+	Convey("With rejectConflicts the newer definitions should be dropped", t, func() {
+		events.Clear()
+		rp := &Pipeline{Name: "strict", interestingAnnotation: myAnno, rejectConflicts: true}
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{
+			conflictConfigMap("team-a", time.Hour, olderConflictRules),
+			conflictConfigMap("team-b", time.Minute, conflictingRules),
+			conflictConfigMap("team-c", time.Second, conflictingRules),
+		}}
+		mrg := cc.collectRuleGroups(rp, list)
+		So(len(mrg.Values[0].Groups[0].Rules), ShouldEqual, 2)
+		So(len(mrg.Values[1].Groups[0].Rules), ShouldEqual, 1)
+		So(mrg.Values[1].Groups[0].Rules[0].Alert, ShouldEqual, "Unrelated")
+
+		// team-c only conflicts with what was kept, its Unrelated alert overlaps the one of team-b
+		So(len(mrg.Values[2].Groups), ShouldEqual, 0)
+		So(len(statuses["team-c"][0].Errors), ShouldEqual, 4)
+		So(strings.Contains(statuses["team-c"][0].Errors[0].Error(), "team-a-slo"), ShouldBeTrue)
+		So(statuses["team-c"][0].Errors[3].Error(), ShouldContainSubstring, "was rejected as a conflict, the group is dropped")
+		So(statuses["team-c"][0].Accepted, ShouldBeFalse)
+		So(statuses["team-c"][0].Rules, ShouldEqual, 0)
+
+		// the report of team-b counts what is left
+		So(statuses["team-b"][0].Accepted, ShouldBeTrue)
+		So(statuses["team-b"][0].Groups, ShouldEqual, 1)
+		So(statuses["team-b"][0].Rules, ShouldEqual, 1)
+		So(len(statuses["team-a"][0].Warnings), ShouldEqual, 4)
+	})
+}
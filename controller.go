@@ -2,27 +2,32 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"gopkg.in/matryer/try.v1"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
-	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
-	"math/rand"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/rulefmt"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	corev1informers "k8s.io/client-go/informers/core/v1"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -35,10 +40,6 @@ const (
 
 	ErrInvalidKey = "InvalidKey"
 	ValidKey = "ValidKey"
-	letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
 // Controller is the controller implementation for Foo resources
@@ -48,37 +49,74 @@ type Controller struct {
 
 	configmapsLister     corev1listers.ConfigMapLister
 	configmapsSynced     cache.InformerSynced
-
-	// workqueue is a rate limited work queue. This is used to queue work to be
-	// processed instead of performing it as soon as a change happens. This
-	// means we can ensure we only process a fixed amount of resources at a
-	// time, and makes it easy to ensure we are never processing the same item
-	// simultaneously in two different workers.
-	workqueue            workqueue.RateLimitingInterface
+	namespacesLister     corev1listers.NamespaceLister
+	namespacesSynced     cache.InformerSynced
+
+	// pipelines share the informers above, each one has a rate limited work
+	// queue of its own. This is used to queue work to be processed instead
+	// of performing it as soon as a change happens. This means we can ensure
+	// we only process a fixed amount of resources at a time, and makes it
+	// easy to ensure we are never processing the same item simultaneously in
+	// two different workers.
+	pipelines            []*Pipeline
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
 	recorder             record.EventRecorder
 
-	resourceVersionMap         map[string]string
-	interestingAnnotation      *string
-	reloadEndpoint             *string
-	rulesPath                  *string
-	randSrc                    *rand.Source
+	namespaceQuota             *NamespaceQuota
+	quotaAnnotation            *string
+	namespaceFilter            *NamespaceFilter
+	// settingsLock guards the pipelines and the namespace settings above,
+	// they are swapped when the config file changes.
+	settingsLock               sync.RWMutex
+	threadiness                int
+	stopCh                     <-chan struct{}
 	configmapEventRecorderFunc func(cm *corev1.ConfigMap, eventtype,reason, msg string)
+	configmapStatusFunc        func(p *Pipeline, cm *corev1.ConfigMap, reports []ValidationReport)
+	getNamespace               func(name string) (*corev1.Namespace, error)
+	// listConfigMaps returns every configmap, rule templates are looked up
+	// in it. nil when there is no cluster to look them up in.
+	listConfigMaps             func() ([]*corev1.ConfigMap, error)
+	// heldEvents buffers the events of the configmaps a rebuild is working
+	// on, see holdEvents
+	heldEvents                 map[*corev1.ConfigMap][]configMapEvent
+	heldEventsLock             sync.Mutex
+	// unitTests runs the unit tests in the background and keeps their
+	// results, nil runs them right away.
+	unitTests                  *unitTestRunner
+}
+
+// configMapEvent is an event held back until the rebuild knows whether the
+// status of its configmap changed.
+type configMapEvent struct {
+	eventtype string
+	reason    string
+	msg       string
 }
 
 
 type MultiRuleGroups struct {
-	Values []rulefmt.RuleGroups
+	Values  []RuleGroups
+	// Keys holds the configmap key each entry of Values was read from.
+	Keys    []string
+	// Reports holds one entry per configmap key that was looked at, accepted or not.
+	Reports []ValidationReport
+	// Sources holds the configmap each entry of Values came from, only
+	// collectRuleGroups fills it in.
+	Sources []*corev1.ConfigMap
+	// Pending is set while the unit tests of the rules are still running.
+	Pending bool
 }
 
 
 func NewController(
 	kubeclientset *kubernetes.Clientset,
 	configmapInformer corev1informers.ConfigMapInformer,
-	interestingAnnotation *string,
-	reloadEndpoint *string,
-	rulesPath *string,
+	namespaceInformer corev1informers.NamespaceInformer,
+	pipelines []*Pipeline,
+	namespaceQuota *NamespaceQuota,
+	quotaAnnotation *string,
+	namespaceFilter *NamespaceFilter,
 	) *Controller {
 
 		utilruntime.Must(scheme.AddToScheme(scheme.Scheme))
@@ -88,23 +126,27 @@ func NewController(
 		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 		recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
-		rsource := rand.NewSource(time.Now().UnixNano())
-
 		controller := &Controller{
 			kubeclientset:         kubeclientset,
 			configmapsLister:      configmapInformer.Lister(),
 			configmapsSynced:      configmapInformer.Informer().HasSynced,
-			workqueue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "configmaps"),
+			namespacesLister:      namespaceInformer.Lister(),
+			namespacesSynced:      namespaceInformer.Informer().HasSynced,
+			pipelines:             pipelines,
 			recorder:              recorder,
-			interestingAnnotation: interestingAnnotation,
-			reloadEndpoint:        reloadEndpoint,
-			rulesPath:             rulesPath,
-			randSrc:               &rsource,
-			resourceVersionMap:    make(map[string]string),
+			namespaceQuota:        namespaceQuota,
+			quotaAnnotation:       quotaAnnotation,
+			namespaceFilter:       namespaceFilter,
+			unitTests:             newUnitTestRunner(),
 		}
 
 		// is this idomatic?
 		controller.configmapEventRecorderFunc = controller.recordEventOnConfigMap
+		controller.configmapStatusFunc = controller.recordStatusOnConfigMap
+		controller.getNamespace = controller.namespacesLister.Get
+		controller.listConfigMaps = func() ([]*corev1.ConfigMap, error) {
+			return controller.configmapsLister.List(labels.Everything())
+		}
 
 		klog.Info("Setting up event handlers")
 		configmapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -115,31 +157,45 @@ func NewController(
 				if newCM.ResourceVersion == oldCM.ResourceVersion {
 					return
 				}
-				controller.enqueueConfigMap(newCM)
+				// writing the status doesn't change the rules, rebuilding for
+				// it would write the status again
+				ignored := controller.statusAnnotations()
+				if configMapVersion(oldCM, ignored) == configMapVersion(newCM, ignored) {
+					return
+				}
+				// a configmap that lost its annotation still has to leave its pipelines
+				controller.enqueueConfigMaps(oldCM, newCM)
 			},
 			DeleteFunc: controller.enqueueConfigMap,
 		})
+		namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: controller.handleNamespaceUpdate,
+		})
 
 		return controller
 }
 
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
-	defer c.workqueue.ShutDown()
 
 	// Start the informer factories to begin populating the informer caches
 	klog.Infof("Starting %s", controllerAgentName)
 
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.configmapsSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.configmapsSynced, c.namespacesSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
 	klog.Info("Starting workers")
-	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+	c.settingsLock.Lock()
+	// pipelines added by a config reload are started with the same settings
+	c.threadiness, c.stopCh = threadiness, stopCh
+	for _, p := range c.pipelines {
+		p.start(c, threadiness, stopCh)
+		klog.Infof("Started workers for pipeline %s", p.Name)
 	}
+	c.settingsLock.Unlock()
 
 	klog.Info("Started workers")
 	<-stopCh
@@ -148,21 +204,21 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	return nil
 }
 
-func (c *Controller) runWorker() {
-	for c.processNextWorkItem() {
+func (c *Controller) runWorker(p *Pipeline) {
+	for c.processNextWorkItem(p) {
 	}
 }
 
-// processNextWorkItem will read a single work item off the workqueue and
-// attempt to process it, by calling the syncHandler.
-func (c *Controller) processNextWorkItem() bool {
-	obj, shutdown := c.workqueue.Get()
+// processNextWorkItem will read a single work item off the workqueue of a
+// pipeline and attempt to process it, by calling the syncHandler.
+func (c *Controller) processNextWorkItem(p *Pipeline) bool {
+	obj, shutdown := p.workqueue.Get()
 
 	if shutdown {
 		return false
 	}
 
-	// We wrap this block in a func so we can defer c.workqueue.Done.
+	// We wrap this block in a func so we can defer p.workqueue.Done.
 	err := func(obj interface{}) error {
 		// We call Done here so the workqueue knows we have finished
 		// processing this item. We also must remember to call Forget if we
@@ -170,7 +226,7 @@ func (c *Controller) processNextWorkItem() bool {
 		// not call Forget if a transient error occurs, instead the item is
 		// put back on the workqueue and attempted again after a back-off
 		// period.
-		defer c.workqueue.Done(obj)
+		defer p.workqueue.Done(obj)
 		var key string
 		var ok bool
 		// We expect strings to come off the workqueue. These are of the
@@ -182,21 +238,21 @@ func (c *Controller) processNextWorkItem() bool {
 			// As the item in the workqueue is actually invalid, we call
 			// Forget here else we'd go into a loop of attempting to
 			// process a work item that is invalid.
-			c.workqueue.Forget(obj)
+			p.workqueue.Forget(obj)
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
 		// Run the syncHandler, passing it the namespace/name string of the
 		// Foo resource to be synced.
-		if err := c.syncHandler(key); err != nil {
+		if err := c.syncHandler(p, key); err != nil {
 			// Put the item back on the workqueue to handle any transient errors.
-			c.workqueue.AddRateLimited(key)
-			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
+			p.workqueue.AddRateLimited(key)
+			return fmt.Errorf("pipeline %s: error syncing '%s': %s, requeuing", p.Name, key, err.Error())
 		}
 		// Finally, if no error occurs we Forget this item so it does not
 		// get queued again until another change happens.
-		c.workqueue.Forget(obj)
-		klog.Infof("Successfully synced '%s'", key)
+		p.workqueue.Forget(obj)
+		klog.Infof("Pipeline %s: successfully synced '%s'", p.Name, key)
 		return nil
 	}(obj)
 
@@ -214,7 +270,7 @@ func (c *Controller) processNextWorkItem() bool {
 //
 // Only return errors that are transient, a return w/ an error creates a rate
 // limited requeue of the resource.
-func (c *Controller) syncHandler(key string) error {
+func (c *Controller) syncHandler(p *Pipeline, key string) error {
 	//// Convert the namespace/name string into a distinct namespace and name
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
@@ -222,14 +278,17 @@ func (c *Controller) syncHandler(key string) error {
 		return nil
 	}
 
-	// Get the CM resource with this namespace/name
-	configmap, err := c.configmapsLister.ConfigMaps(namespace).Get(name)
-	if err != nil {
-		// the cm may have already been deleted
-		if errors.IsNotFound(err) {
-			utilruntime.HandleError(fmt.Errorf("configmap '%s' in work queue no longer exists, rebuilding rules config", key))
-		} else {
-			return err
+	// Get the CM resource with this namespace/name, the rebuild key has none
+	var configmap *corev1.ConfigMap
+	if key != rebuildKey {
+		configmap, err = c.configmapsLister.ConfigMaps(namespace).Get(name)
+		if err != nil {
+			// the cm may have already been deleted
+			if errors.IsNotFound(err) {
+				utilruntime.HandleError(fmt.Errorf("configmap '%s' in work queue no longer exists, rebuilding rules config", key))
+			} else {
+				return err
+			}
 		}
 	}
 
@@ -251,28 +310,60 @@ func (c *Controller) syncHandler(key string) error {
 		bypassCheck = true
 	}
 
-	if c.isRuleConfigMap(configmap) || bypassCheck {
-		mapList, err := c.kubeclientset.CoreV1().ConfigMaps(corev1.NamespaceAll).List(metav1.ListOptions{})
+	// a configmap the pipeline loaded that isn't selected anymore has to
+	// take its rules with it
+	if p.hasResourceVersion(fmt.Sprintf("%s-%s", namespace, name)) {
+		bypassCheck = true
+	}
+
+	if c.isRuleConfigMap(p, configmap) || bypassCheck {
+		// every pipeline works off the shared informer cache
+		cms, err := c.configmapsLister.List(labels.Everything())
 		if err != nil {
-			utilruntime.HandleError(fmt.Errorf("Unable to collect configmaps from the cluster; %s", err))
+			utilruntime.HandleError(fmt.Errorf("Unable to collect configmaps from the cache; %s", err))
 			return nil
 		}
+		mapList := &corev1.ConfigMapList{}
+		for _, cm := range cms {
+			mapList.Items = append(mapList.Items, *cm)
+		}
 
-		if c.haveConfigMapsChanged(mapList) || bypassCheck {
-			finalrules := c.buildFinalConfig(mapList)
-			if err != nil {
-				utilruntime.HandleError(err)
+		if c.haveConfigMapsChanged(p, mapList) || bypassCheck {
+			mrg := c.collectRuleGroups(p, mapList)
+			if mrg.Pending {
+				// the unit tests requeue the configmap once they are done
+				klog.Infof("Pipeline %s waits for unit tests before writing its rules.", p.Name)
+				return nil
+			}
+			if p.output == OutputRuler {
+				if err := c.syncRuler(p, mrg); err != nil {
+					// nothing changes in the cache until the retry, make sure it pushes again
+					p.forgetResourceVersions()
+					return err
+				}
+				return nil
+			}
+			if p.shards > 0 {
+				c.writeShards(p, mrg)
 				return nil
 			}
 
+			finalrules := c.finalRuleGroups(mrg)
+
 			// write
-			err = c.persistRulesGroup(finalrules)
+			err = c.persistRulesGroup(p, finalrules)
 			if err != nil {
 				utilruntime.HandleError(err)
 			}
 
+			if err := c.pruneOutputConfigMaps(p, p.outputNames()); err != nil {
+				utilruntime.HandleError(err)
+			}
+
 			// reload
-			c.tryConfigReload()
+			if p.reloadsPrometheus() {
+				c.tryConfigReload(p)
+			}
 
 		}
 
@@ -282,79 +373,262 @@ func (c *Controller) syncHandler(key string) error {
 }
 
 
-// get the cm on the workqueue
+// get the cm on the workqueue of every pipeline it belongs to
 func (c *Controller) enqueueConfigMap(obj interface{}) {
-	var key string
-	var err error
-	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
-		utilruntime.HandleError(err)
-		return
+	c.enqueueConfigMaps(obj)
+}
+
+// enqueueConfigMaps gets the versions of a configmap, the old and the new one
+// of an update, on the workqueue of every pipeline one of them belongs to. The
+// users of a template are requeued once, however many versions define it.
+func (c *Controller) enqueueConfigMaps(objs ...interface{}) {
+	keys := make([]string, 0, len(objs))
+	cms := make([]*corev1.ConfigMap, 0, len(objs))
+	for _, obj := range objs {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("expected a configmap but got %#v", obj))
+			return
+		}
+		keys = append(keys, key)
+		cms = append(cms, cm)
 	}
-	c.workqueue.Add(key)
+
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	for _, p := range c.pipelines {
+		template := false
+		for i, cm := range cms {
+			if c.isRuleConfigMap(p, cm) {
+				p.workqueue.Add(keys[i])
+			}
+			_, ok := p.templateName(cm)
+			template = template || ok
+		}
+		// the rules of the configmaps using a template change with it
+		if template {
+			c.requeueTemplateUsers(p)
+		}
+	}
+}
+
+func (c *Controller) buildFinalConfig(p *Pipeline, mapList *corev1.ConfigMapList) *RuleGroups {
+	return c.finalRuleGroups(c.collectRuleGroups(p, mapList))
+}
+
+// finalRuleGroups merges the collected rules into the groups that are written.
+func (c *Controller) finalRuleGroups(mrg *MultiRuleGroups) *RuleGroups {
+	finalRGs := c.decomposeMultiRuleGroupIntoRuleGroups(mrg)
+	return c.saltRuleGroupNames(finalRGs)
 }
 
-func (c *Controller) buildFinalConfig(mapList *corev1.ConfigMapList) *rulefmt.RuleGroups {
+// collectRuleGroups extracts the rules of every configmap pipeline p selects.
+func (c *Controller) collectRuleGroups(p *Pipeline, mapList *corev1.ConfigMapList) *MultiRuleGroups {
 	finalRules := MultiRuleGroups{}
 
-	for _, cm := range mapList.Items {
-		if c.isRuleConfigMap(&cm) {
-			cmRules := c.extractValues(&cm)
-			if len(cmRules.Values) > 0 {
-				finalRules.Values = append(finalRules.Values, cmRules.Values...)
+	// oldest first, when a namespace runs out of quota the newest configmaps are the ones rejected
+	items := make([]corev1.ConfigMap, len(mapList.Items))
+	copy(items, mapList.Items)
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].CreationTimestamp.Equal(&items[j].CreationTimestamp) {
+			return items[i].CreationTimestamp.Before(&items[j].CreationTimestamp)
+		}
+		return c.createNameStub(&items[i]) < c.createNameStub(&items[j])
+	})
 
+	// the namespace settings are only read under the lock, the rules are
+	// extracted, tested and checked against Prometheus without holding it
+	quotas := make(map[string]NamespaceQuota)
+	selected := make([]*corev1.ConfigMap, 0)
+	ignored := make(map[string]string)
+	ignoredCMs := make([]*corev1.ConfigMap, 0)
+	c.settingsLock.RLock()
+	for i := range items {
+		cm := &items[i]
+		if c.isRuleConfigMap(p, cm) {
+			if ok, reason := c.isNamespaceAllowed(cm); !ok {
+				ignored[c.createNameStub(cm)] = reason
+				ignoredCMs = append(ignoredCMs, cm)
+				continue
+			}
+			if _, ok := quotas[cm.Namespace]; !ok {
+				quotas[cm.Namespace] = c.quotaForNamespace(cm.Namespace)
 			}
+			selected = append(selected, cm)
+		}
+	}
+	c.settingsLock.RUnlock()
+
+	// an ignored configmap is only told again when the reason changes
+	changedIgnored := p.setIgnored(ignored)
+	for _, cm := range ignoredCMs {
+		stub := c.createNameStub(cm)
+		if changedIgnored[stub] {
+			errorMsg := fmt.Sprintf("Configmap: %s Ignored, %s.", stub, ignored[stub])
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrNamespaceNotAllowed, errorMsg)
 		}
 	}
 
-	finalRGs := c.decomposeMultiRuleGroupIntoRuleGroups(&finalRules)
-	return c.saltRuleGroupNames(finalRGs)
+	// the events of a configmap are held back until its status is known,
+	// rebuilding the same rules again shouldn't repeat them
+	if p.statusAnnotation != "" {
+		for _, cm := range selected {
+			c.holdEvents(cm)
+		}
+	}
+
+	used := make(map[string]*namespaceUsage)
+	overQuota := make(map[string]int)
+
+	// a conflict is also reported on the older configmap, so statuses are
+	// only written once every configmap was looked at
+	index := make(ruleIndex)
+	conflicts := 0
+	loaded := make([]*corev1.ConfigMap, 0)
+	loadedRules := make([]*MultiRuleGroups, 0)
+
+	for _, cm := range selected {
+		cmRules := c.extractValues(p, cm)
+		if !c.enforceQuota(cm, &cmRules, quotas[cm.Namespace], used) {
+			overQuota[cm.Namespace]++
+		}
+		conflicts += c.checkConflicts(p, cm, &cmRules, index)
+
+		loaded = append(loaded, cm)
+		loadedRules = append(loadedRules, &cmRules)
+	}
+	p.exportOverQuota(overQuota)
+	ruleConflicts.WithLabelValues(p.Name).Set(float64(conflicts))
+	p.setDependencyGraph(c.analyzeDependencies(p, loaded, loadedRules))
+	c.checkSeries(p, loaded, loadedRules)
+
+	for i, cm := range loaded {
+		if loadedRules[i].Pending {
+			// nothing is said about the configmap until its tests are done
+			finalRules.Pending = true
+			c.releaseEvents(cm, false)
+			continue
+		}
+		c.releaseEvents(cm, p.statusChanged(cm, loadedRules[i].Reports))
+		if c.configmapStatusFunc != nil {
+			c.configmapStatusFunc(p, cm, loadedRules[i].Reports)
+		}
+		for _, rgs := range loadedRules[i].Values {
+			finalRules.Values = append(finalRules.Values, rgs)
+			finalRules.Sources = append(finalRules.Sources, cm)
+		}
+	}
+
+	return &finalRules
 }
 
 
-func (c *Controller) extractValues(cm *corev1.ConfigMap) (MultiRuleGroups) {
+func (c *Controller) extractValues(p *Pipeline, cm *corev1.ConfigMap) (MultiRuleGroups) {
 
 	fallbackNameStub := c.createNameStub(cm)
 
 	// make a bucket for random non fully formed rulegroups (just a single rulegroup) to live
 	mrg := MultiRuleGroups{}
 
-	for key, value := range cm.Data {
-		// try each encoding
-		// try to extract a rulegroups
-		var rulegroups rulefmt.RuleGroups
-		var err error
-		err, rulegroups = c.extractRuleGroups(value)
+	for key, raw := range configMapValues(cm) {
+		// unit tests are run once all the rules are extracted
+		if isUnitTestKey(key) {
+			continue
+		}
+		report := ValidationReport{ConfigMap: fallbackNameStub, Key: key}
+
+		value, err := p.decompressValue(key, raw)
 		if err != nil {
-			// try to extract a rulegroup as a rulegroups
-			err, rulegroups = c.extractRuleGroupAsRuleGroups(value)
-			if err != nil {
-				// try to extract a rules array as a rulegroups
-				_, rulegroups = c.extractRulesAsRuleGroups(fallbackNameStub, key, value)
+			errorMsg := fmt.Sprintf("Configmap: %s key: %s could not be decompressed, %s. Skipping.", fallbackNameStub, key, err)
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
+			report.Errors = append(report.Errors, ValidationError{Err: err})
+			mrg.Reports = append(mrg.Reports, report)
+			continue
+		}
+
+		// a template key holds references to templates, the rules are what
+		// they expand to
+		if isTemplateKey(key) {
+			var templateErrors []ValidationError
+			value, templateErrors = c.expandTemplates(p, cm, value)
+			for _, verr := range templateErrors {
+				errorMsg := fmt.Sprintf("Configmap: %s key: %s template could not be expanded, %s. Skipping.", fallbackNameStub, key, verr.Error())
+				c.recordEvent(cm, corev1.EventTypeWarning, ErrTemplateFailed, errorMsg)
+			}
+			report.Errors = append(report.Errors, templateErrors...)
+			if value == "" {
+				mrg.Reports = append(mrg.Reports, report)
+				continue
 			}
 		}
 
-		if len(rulegroups.Groups) == 0 {
-			errorMsg := fmt.Sprintf("Configmap: %s key: %s does not conform to any of the legal formats (RuleGroups, RuleGroup or []Rules. Skipping.", fallbackNameStub, key)
-			c.configmapEventRecorderFunc(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
-		} else {
+		// a key can hold several documents, each is decoded on its own and
+		// the groups of all of them are loaded together
+		documents := splitDocuments(value)
+		rulegroups := RuleGroups{}
+		decoded := false
+		for i, document := range documents {
+			number := 0
+			if len(documents) > 1 {
+				number = i + 1
+			}
+			groups, errs, ok := c.extractDocument(cm, key, document, number)
+			rulegroups.Groups = append(rulegroups.Groups, groups.Groups...)
+			report.Errors = append(report.Errors, errs...)
+			decoded = decoded || ok
+		}
+
+		if decoded {
 			// validate the rules
-			rulegroups = c.validateRuleGroups(cm, key, rulegroups)
+			var validationErrors []ValidationError
+			rulegroups, validationErrors = c.validateRuleGroups(p, cm, key, rulegroups)
+			report.Errors = append(report.Errors, validationErrors...)
+
+			// keep only the group fields the backend understands
+			var fieldErrors, fieldWarnings []ValidationError
+			rulegroups, fieldErrors, fieldWarnings = c.checkGroupFields(p, cm, key, rulegroups)
+			report.Errors = append(report.Errors, fieldErrors...)
+			report.Warnings = append(report.Warnings, fieldWarnings...)
+
+			// enforce the organisational policies on what is left
+			var policyErrors, policyWarnings []ValidationError
+			rulegroups, policyErrors, policyWarnings = c.applyPolicies(p, cm, key, rulegroups)
+			report.Errors = append(report.Errors, policyErrors...)
+			report.Warnings = append(report.Warnings, policyWarnings...)
 
 			//if there are groups and rules
 			totalrules := c.countRuleGroupsRules(rulegroups)
 			if len(rulegroups.Groups) > 0 && totalrules > 0 {
 				// append
 				mrg.Values = append(mrg.Values, rulegroups)
+				mrg.Keys = append(mrg.Keys, key)
+				report.Accepted = true
+				report.Groups = len(rulegroups.Groups)
+				report.Rules = totalrules
 				successMessage := fmt.Sprintf("Configmap: %s key: %s Accepted with %d rulegroups and %d total rules.", fallbackNameStub, key, len(rulegroups.Groups), totalrules)
-				c.configmapEventRecorderFunc(cm, corev1.EventTypeNormal, ValidKey, successMessage)
+				c.recordEvent(cm, corev1.EventTypeNormal, ValidKey, successMessage)
 			} else {
 				failMessage := fmt.Sprintf("Configmap: %s key: %s Rejected, no valid rules.", fallbackNameStub, key)
-				c.configmapEventRecorderFunc(cm, corev1.EventTypeWarning, ErrInvalidKey, failMessage)
+				c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, failMessage)
 			}
 		}
 
+		mrg.Reports = append(mrg.Reports, report)
 	}
 
+	c.runUnitTests(p, cm, &mrg)
+
+	sort.Slice(mrg.Reports, func(i, j int) bool { return mrg.Reports[i].Key < mrg.Reports[j].Key })
+
 	return mrg
 }
 
@@ -364,11 +638,11 @@ func (c *Controller) extractValues(cm *corev1.ConfigMap) (MultiRuleGroups) {
 //type RuleGroups struct {
 //	Groups []RuleGroup `yaml:"groups"`
 //}
-func (c *Controller) extractRuleGroups(value string) (error, rulefmt.RuleGroups) {
-	groups := rulefmt.RuleGroups{}
-	err := yaml.Unmarshal([]byte(value), &groups)
+func (c *Controller) extractRuleGroups(value string) (error, RuleGroups) {
+	groups := RuleGroups{}
+	err := yaml.UnmarshalStrict([]byte(value), &groups)
 	if err != nil {
-		return err, rulefmt.RuleGroups{}
+		return err, RuleGroups{}
 	}
 	if len(groups.Groups) == 0 {
 		return fmt.Errorf("No RuleGroups"), groups
@@ -384,22 +658,73 @@ func (c *Controller) extractRuleGroups(value string) (error, rulefmt.RuleGroups)
 //	Interval model.Duration `yaml:"interval,omitempty"`
 //	Rules    []Rule         `yaml:"rules"`
 //}
-func (c *Controller) extractRuleGroupAsRuleGroups(value string) (error, rulefmt.RuleGroups) {
-	group := rulefmt.RuleGroup{}
-	err := yaml.Unmarshal([]byte(value), &group)
+func (c *Controller) extractRuleGroupAsRuleGroups(value string) (error, RuleGroups) {
+	group := RuleGroup{}
+	err := yaml.UnmarshalStrict([]byte(value), &group)
 	if err != nil {
-		return err, rulefmt.RuleGroups{}
+		return err, RuleGroups{}
 	}
 	if len(group.Rules) == 0 {
-		return fmt.Errorf("No RuleGroup"), rulefmt.RuleGroups{}
+		return fmt.Errorf("No RuleGroup"), RuleGroups{}
 	}
 
-	wrapper := rulefmt.RuleGroups{}
+	wrapper := RuleGroups{}
 	wrapper.Groups = append(wrapper.Groups, group)
 
 	return nil, wrapper
 }
 
+// extractRuleGroupsPerGroup is the fallback for RuleGroups and RuleGroup
+// values that failed to decode as a whole. Each group is decoded on its own,
+// the groups that decode are returned and the others are reported along with
+// the line of the problem.
+func (c *Controller) extractRuleGroupsPerGroup(value string) (RuleGroups, []ValidationError) {
+	groups := RuleGroups{}
+	errs := make([]ValidationError, 0)
+
+	root := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal([]byte(value), &root); err != nil {
+		return groups, errs
+	}
+
+	decoded := make([]decodedGroup, 0)
+	if _, ok := root["groups"]; ok {
+		document := struct {
+			Groups []decodedGroup `yaml:"groups"`
+		}{}
+		// whatever is wrong outside of the groups
+		if err := yaml.UnmarshalStrict([]byte(value), &document); err != nil {
+			errs = append(errs, yamlErrors(value, err)...)
+		}
+		decoded = document.Groups
+	} else if _, ok := root["rules"]; ok {
+		group := decodedGroup{}
+		if err := yaml.UnmarshalStrict([]byte(value), &group); err != nil {
+			errs = append(errs, yamlErrors(value, err)...)
+		}
+		decoded = append(decoded, group)
+	}
+
+	for _, group := range decoded {
+		if group.err == nil {
+			groups.Groups = append(groups.Groups, group.group)
+			continue
+		}
+		for _, verr := range yamlErrors(value, group.err) {
+			verr.Group = group.name
+			if verr.Field == "" {
+				verr.Field = "rules"
+				if _, perr := model.ParseDuration(group.interval); group.interval != "" && perr != nil {
+					verr.Field = "interval"
+				}
+			}
+			errs = append(errs, verr)
+		}
+	}
+
+	return groups, errs
+}
+
 // []Rule
 // for reference
 // from prometheus/pkg/rulefmt/rulefmt.go
@@ -411,73 +736,109 @@ func (c *Controller) extractRuleGroupAsRuleGroups(value string) (error, rulefmt.
 //	Labels      map[string]string `yaml:"labels,omitempty"`
 //	Annotations map[string]string `yaml:"annotations,omitempty"`
 //}
-func (c *Controller) extractRulesAsRuleGroups(fallbackName string, key string, value string) (error, rulefmt.RuleGroups){
+func (c *Controller) extractRulesAsRuleGroups(fallbackName string, key string, value string) (error, RuleGroups){
 	rules := make([]rulefmt.Rule,0)
-	err := yaml.Unmarshal([]byte(value), &rules)
+	err := yaml.UnmarshalStrict([]byte(value), &rules)
 	if err != nil {
-		return err, rulefmt.RuleGroups{}
+		return err, RuleGroups{}
 	}
 	if len(rules) == 0 {
-		return fmt.Errorf("No rules"), rulefmt.RuleGroups{}
+		return fmt.Errorf("No rules"), RuleGroups{}
 	}
 
 	rgName := fmt.Sprintf("%s-%s", fallbackName, key)
-	rg := rulefmt.RuleGroup{}
+	rg := RuleGroup{}
 	rg.Name = rgName
 	rg.Rules = rules
 
-	wrapper := rulefmt.RuleGroups{}
+	wrapper := RuleGroups{}
 	wrapper.Groups = append(wrapper.Groups, rg)
 
 	return nil, wrapper
 }
 
 
-func (c *Controller) validateRuleGroups(cm *corev1.ConfigMap, keyname string, groups rulefmt.RuleGroups) (rulefmt.RuleGroups) {
+// validateRuleGroups drops every rule that fails validation and every group
+// that fails group level validation from groups and returns what is left
+// along with an entry for each error found.
+func (c *Controller) validateRuleGroups(p *Pipeline, cm *corev1.ConfigMap, keyname string, groups RuleGroups) (RuleGroups, []ValidationError) {
 	nameStub := c.createNameStub(cm)
+	report := make([]ValidationError, 0)
+	validGroups := RuleGroups{}
+	seenGroups := make(map[string]struct{})
 	// im not using rulegroups.Validate here because i think their current error processing is broken.
 	for i := 0; i < len(groups.Groups); i++ {
+		groupErrs := c.validateRuleGroup(groups.Groups[i], seenGroups)
+		for _, verr := range groupErrs {
+			errorMsg := fmt.Sprintf("Group failed validation: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, keyname, verr.Error())
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
+		}
+		report = append(report, groupErrs...)
 
-		for j := 0; j < len(groups.Groups[i].Rules); j++ {
-			remove := make([]int,0)
-			r := groups.Groups[i].Rules[j]
+		remove := make([]int,0)
 
+		for j := 0; j < len(groups.Groups[i].Rules); j++ {
 			// Validate of any particular rule can return multiple errors
-			for _, err := range r.Validate() {
-				if err != nil {
-					remove = append(remove, i)
-					name := r.Alert
-
-					// recording rules have no names so therefore we'll use the value of "Record" in the error
-					if name == "" {
-						name = r.Record
-					}
-					errorMsg := fmt.Sprintf("Rule failed validation: Namespace-ConfigMap:%s, Key:%s, GroupName: %s, Rule Name/Record: %s Error: %s", nameStub, keyname, groups.Groups[i].Name, name, err)
-					c.configmapEventRecorderFunc(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
-				}
-				c.removeRules(&groups.Groups[i], remove)
+			errs := c.validateRule(p.language, groups.Groups[i].Name, groups.Groups[i].Rules[j])
+			if len(errs) > 0 {
+				remove = append(remove, j)
 			}
+			for _, verr := range errs {
+				errorMsg := fmt.Sprintf("Rule failed validation: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, keyname, verr.Error())
+				c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
+			}
+			report = append(report, errs...)
+		}
+
+		// a broken group is rejected as a whole, the rest of the key is still loaded
+		if len(groupErrs) > 0 {
+			continue
 		}
+
+		c.removeRules(&groups.Groups[i], remove)
+		validGroups.Groups = append(validGroups.Groups, groups.Groups[i])
 	}
 
-	return groups
+	return validGroups, report
 }
 
-func (c *Controller) removeRules(group *rulefmt.RuleGroup, list []int) {
+func (c *Controller) removeRules(group *RuleGroup, list []int) {
 	for i := len(list)-1; i >=0; i-- {
 		v := list[i]
 		group.Rules = append(group.Rules[:v], group.Rules[v+1:]...)
 	}
 }
 
-func (c *Controller) isRuleConfigMap(cm *corev1.ConfigMap) bool {
+// isRuleConfigMap checks if cm is a source of pipeline p. cm has to match the
+// label selector of p and carry its interesting annotation. "true" selects
+// the configmap and "false" doesn't, any other value is a comma separated
+// list of the targets the configmap is meant for.
+func (c *Controller) isRuleConfigMap(p *Pipeline, cm *corev1.ConfigMap) bool {
 	if cm == nil {
 		return false
 	}
+	if p.selector != nil && !p.selector.Matches(labels.Set(cm.GetObjectMeta().GetLabels())) {
+		return false
+	}
+	if configMapLanguage(p, cm) != p.queryLanguage() {
+		return false
+	}
 	annotations := cm.GetObjectMeta().GetAnnotations()
 
-	for key := range annotations {
-		if key == *c.interestingAnnotation {
+	value, ok := annotations[p.interestingAnnotation]
+	if !ok {
+		return false
+	}
+
+	if selected, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+		return selected
+	}
+
+	if p.target == "" {
+		return false
+	}
+	for _, target := range strings.Split(value, ",") {
+		if strings.TrimSpace(target) == p.target {
 			return true
 		}
 	}
@@ -485,35 +846,155 @@ func (c *Controller) isRuleConfigMap(cm *corev1.ConfigMap) bool {
 	return false
 }
 
-func (c *Controller) haveConfigMapsChanged(mapList *corev1.ConfigMapList) bool {
+func (c *Controller) haveConfigMapsChanged(p *Pipeline, mapList *corev1.ConfigMapList) bool {
+	p.resourceVersionLock.Lock()
+	defer p.resourceVersionLock.Unlock()
+
 	changes := false
+	selected := make(map[string]struct{})
+	ignored := c.statusAnnotations()
 	for _, cm := range mapList.Items {
-		if c.isRuleConfigMap(&cm) {
+		if c.isRuleConfigMap(p, &cm) {
 			stub := c.createNameStub(&cm)
-			val, ok := c.resourceVersionMap[stub];
+			selected[stub] = struct{}{}
+			version := configMapVersion(&cm, ignored)
+			val, ok := p.resourceVersionMap[stub];
 			if !ok {
 				// new configmap
 				changes = true
 			}
-			if cm.ResourceVersion != val {
+			if version != val {
 				// changed configmap
 				changes = true
 			}
-			c.resourceVersionMap[stub] = cm.ResourceVersion
+			p.resourceVersionMap[stub] = version
+		}
+	}
+
+	// configmaps that were deleted or aren't selected anymore
+	for stub := range p.resourceVersionMap {
+		if _, ok := selected[stub]; !ok {
+			delete(p.resourceVersionMap, stub)
+			changes = true
 		}
 	}
 
 	return changes
 }
 
-func (c *Controller) decomposeMultiRuleGroupIntoRuleGroups(mrg *MultiRuleGroups) *rulefmt.RuleGroups {
-	finalRuleGroup := rulefmt.RuleGroups{}
+// statusAnnotations are the annotations the pipelines write the status of
+// configmaps to.
+func (c *Controller) statusAnnotations() map[string]struct{} {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+
+	annotations := make(map[string]struct{})
+	for _, p := range c.pipelines {
+		if p.statusAnnotation != "" {
+			annotations[p.statusAnnotation] = struct{}{}
+		}
+	}
+	return annotations
+}
+
+// configMapVersion identifies the content of cm the rules are built from.
+// Unlike the resource version it stays the same when only one of the ignored
+// annotations changes.
+func configMapVersion(cm *corev1.ConfigMap, ignored map[string]struct{}) string {
+	annotations := make(map[string]string, len(cm.Annotations))
+	for name, value := range cm.Annotations {
+		if _, ok := ignored[name]; !ok {
+			annotations[name] = value
+		}
+	}
+
+	// maps are marshalled with sorted keys
+	content, _ := json.Marshal(struct {
+		Labels      map[string]string
+		Annotations map[string]string
+		Data        map[string]string
+		BinaryData  map[string][]byte
+	}{cm.Labels, annotations, cm.Data, cm.BinaryData})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// forgetConfigMap drops the resource version pipeline p saw for cm, the next
+// check treats it as a new configmap.
+func (c *Controller) forgetConfigMap(p *Pipeline, cm *corev1.ConfigMap) {
+	p.resourceVersionLock.Lock()
+	defer p.resourceVersionLock.Unlock()
+
+	delete(p.resourceVersionMap, c.createNameStub(cm))
+}
+
+// requeueConfigMap rebuilds the rules of pipeline p for cm although cm didn't
+// change. Controllers without a cache, like the webhook's, have nothing to
+// rebuild.
+func (c *Controller) requeueConfigMap(p *Pipeline, cm *corev1.ConfigMap) {
+	if c.configmapsLister == nil {
+		return
+	}
+	name, err := cache.MetaNamespaceKeyFunc(cm)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.forgetConfigMap(p, cm)
+	p.workqueue.Add(name)
+}
+
+func (c *Controller) decomposeMultiRuleGroupIntoRuleGroups(mrg *MultiRuleGroups) *RuleGroups {
+	finalRuleGroup := RuleGroups{}
 	for _, rg := range mrg.Values {
 		finalRuleGroup.Groups = append(finalRuleGroup.Groups, rg.Groups...)
 	}
 	return &finalRuleGroup
 }
 
+// recordEvent records an event on cm, or buffers it while a rebuild holds back
+// the events of cm.
+func (c *Controller) recordEvent(cm *corev1.ConfigMap, eventtype, reason, msg string) {
+	c.heldEventsLock.Lock()
+	if held, ok := c.heldEvents[cm]; ok {
+		c.heldEvents[cm] = append(held, configMapEvent{eventtype: eventtype, reason: reason, msg: msg})
+		c.heldEventsLock.Unlock()
+		return
+	}
+	c.heldEventsLock.Unlock()
+
+	c.configmapEventRecorderFunc(cm, eventtype, reason, msg)
+}
+
+// holdEvents buffers the events recorded on cm until releaseEvents is called.
+// A rebuild works on its own copies of the configmaps, the events of other
+// rebuilds are not held.
+func (c *Controller) holdEvents(cm *corev1.ConfigMap) {
+	c.heldEventsLock.Lock()
+	defer c.heldEventsLock.Unlock()
+
+	if c.heldEvents == nil {
+		c.heldEvents = make(map[*corev1.ConfigMap][]configMapEvent)
+	}
+	c.heldEvents[cm] = make([]configMapEvent, 0)
+}
+
+// releaseEvents stops holding back the events of cm, the held ones are
+// recorded if record is true and dropped otherwise.
+func (c *Controller) releaseEvents(cm *corev1.ConfigMap, record bool) {
+	c.heldEventsLock.Lock()
+	held := c.heldEvents[cm]
+	delete(c.heldEvents, cm)
+	c.heldEventsLock.Unlock()
+
+	if !record {
+		return
+	}
+	for _, event := range held {
+		c.configmapEventRecorderFunc(cm, event.eventtype, event.reason, event.msg)
+	}
+}
+
 func (c *Controller) recordEventOnConfigMap(cm *corev1.ConfigMap, eventtype, reason, msg string) {
 	c.recorder.Event(cm, eventtype, reason, msg )
 	if eventtype == corev1.EventTypeWarning {
@@ -521,6 +1002,32 @@ func (c *Controller) recordEventOnConfigMap(cm *corev1.ConfigMap, eventtype, rea
 	}
 }
 
+// recordStatusOnConfigMap writes the validation reports of a configmap to the
+// status annotation of pipeline p. The configmap is only updated when the
+// status changed, otherwise every update would trigger another rebuild.
+func (c *Controller) recordStatusOnConfigMap(p *Pipeline, cm *corev1.ConfigMap, reports []ValidationReport) {
+	if p.statusAnnotation == "" || !p.statusChanged(cm, reports) {
+		return
+	}
+
+	status, err := json.Marshal(reports)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Unable to marshal status of configmap %s: %s", c.createNameStub(cm), err))
+		return
+	}
+
+	cmCopy := cm.DeepCopy()
+	if cmCopy.Annotations == nil {
+		cmCopy.Annotations = make(map[string]string)
+	}
+	cmCopy.Annotations[p.statusAnnotation] = string(status)
+
+	_, err = c.kubeclientset.CoreV1().ConfigMaps(cm.Namespace).Update(cmCopy)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Unable to update status annotation on configmap %s: %s", c.createNameStub(cm), err))
+	}
+}
+
 func (c *Controller) createNameStub(cm *corev1.ConfigMap) string {
 	name := cm.GetObjectMeta().GetName()
 	namespace := cm.GetObjectMeta().GetNamespace()
@@ -528,19 +1035,39 @@ func (c *Controller) createNameStub(cm *corev1.ConfigMap) string {
 	return fmt.Sprintf("%s-%s", namespace, name)
 }
 
-func (c *Controller) saltRuleGroupNames(rgs *rulefmt.RuleGroups) *rulefmt.RuleGroups {
+func (c *Controller) saltRuleGroupNames(rgs *RuleGroups) *RuleGroups {
+	// a salted name must not take the name of a group further down
+	names := make(map[string]string)
+	for _, rg := range rgs.Groups {
+		names[rg.Name] = "yes"
+	}
+
 	usedNames := make(map[string]string)
 	for i:=0; i < len(rgs.Groups); i++ {
 		if _, ok := usedNames[rgs.Groups[i].Name]; ok {
-			// used name, salt
-			rgs.Groups[i].Name = fmt.Sprintf("%s-%s", rgs.Groups[i].Name, c.generateRandomString(5))
+			// used name, salt with the first free number so the same rules
+			// always get the same names and don't rewrite the output
+			for n := 2; ; n++ {
+				salted := fmt.Sprintf("%s-%d", rgs.Groups[i].Name, n)
+				_, taken := names[salted]
+				_, used := usedNames[salted]
+				if !taken && !used {
+					rgs.Groups[i].Name = salted
+					break
+				}
+			}
 		}
 		usedNames[rgs.Groups[i].Name] = "yes"
 	}
 	return rgs
 }
 
-func (c *Controller) persistRulesGroup(rulesGroup *rulefmt.RuleGroups) error {
+func (c *Controller) persistRulesGroup(p *Pipeline, rulesGroup *RuleGroups) error {
+	_, err := c.writeRules(p, p.outputTarget(), rulesGroup)
+	return err
+}
+
+func (c *Controller) writeRulesFile(path string, rulesGroup *RuleGroups) error {
 
 	rulesBytes, err := yaml.Marshal(*rulesGroup)
 	if err != nil {
@@ -548,9 +1075,9 @@ func (c *Controller) persistRulesGroup(rulesGroup *rulefmt.RuleGroups) error {
 	}
 
 
-	f, err := os.Create(*c.rulesPath)
+	f, err := os.Create(path)
 	if err != nil {
-		return fmt.Errorf("Unable to open rules file %s for writing. Error: %s", *c.rulesPath, err)
+		return fmt.Errorf("Unable to open rules file %s for writing. Error: %s", path, err)
 	}
 	defer f.Close()
 
@@ -565,9 +1092,15 @@ func (c *Controller) persistRulesGroup(rulesGroup *rulefmt.RuleGroups) error {
 	return nil
 }
 
-func (c *Controller) tryConfigReload() {
+func (c *Controller) tryConfigReload(p *Pipeline) {
+	for _, endpoint := range p.reloadEndpoints {
+		c.tryEndpointReload(endpoint)
+	}
+}
+
+func (c *Controller) tryEndpointReload(endpoint string) {
 	_ = try.Do(func(attempt int) (bool, error) {
-		err := c.configReload(*c.reloadEndpoint)
+		err := c.configReload(endpoint)
 		if err != nil {
 			klog.Error(err)
 			time.Sleep(10 * time.Second)
@@ -594,29 +1127,10 @@ func (c *Controller) configReload(url string) error {
 	return fmt.Errorf("Unable to reload the Prometheus config. Endpoint: %s, Reponse StatusCode: %d, Response Body: %s", url, resp.StatusCode, string(respBody))
 }
 
-func (c *Controller) countRuleGroupsRules(rgs rulefmt.RuleGroups) int {
+func (c *Controller) countRuleGroupsRules(rgs RuleGroups) int {
 	count := 0
 	for _, rg := range rgs.Groups {
 		count += len(rg.Rules)
 	}
 	return count
 }
-
-// borrowed from here https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go
-func (c *Controller) generateRandomString(n int) string {
-	b := make([]byte, n)
-	src := *c.randSrc
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-
-	return string(b)
-}
\ No newline at end of file
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"gopkg.in/yaml.v2"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/rulefmt"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -22,6 +27,7 @@ const(
 
 var (
 	c *Controller
+	pipeline *Pipeline
 
 	events *ConfigMapEventContainer
 
@@ -51,17 +57,15 @@ type ConfigMapEvent struct {
 
 func TestMain(m *testing.M) {
 
-	rsource := rand.NewSource(time.Now().UnixNano())
-
 	testRulesObj := validRulesArray()
 
-	testRuleGroupObj := rulefmt.RuleGroup{
+	testRuleGroupObj := RuleGroup{
 		Name: "TestGroup",
 		Rules: testRulesObj,
 	}
 
-	testRuleGroupsObj := rulefmt.RuleGroups{
-		Groups: []rulefmt.RuleGroup{
+	testRuleGroupsObj := RuleGroups{
+		Groups: []RuleGroup{
 			testRuleGroupObj,
 		},
 	}
@@ -140,21 +144,24 @@ func TestMain(m *testing.M) {
 		"rules": string(testRules),
 	}
 
-	anno := myAnno
 	events = &ConfigMapEventContainer{}
 
 	// just what we need
+	pipeline = &Pipeline{
+		Name:                  "test",
+		interestingAnnotation: myAnno,
+		workqueue:             nil,
+		resourceVersionMap:    make(map[string]string),
+		reloadEndpoints:       nil,
+		rulesPath:             "",
+	}
+
 	c = &Controller{
 		kubeclientset:              nil,
 		configmapsLister:           nil,
 		configmapsSynced:           nil,
-		workqueue:                  nil,
+		pipelines:                  []*Pipeline{pipeline},
 		recorder:                   nil,
-		resourceVersionMap:         make(map[string]string),
-		interestingAnnotation:      &anno,
-		reloadEndpoint:             nil,
-		rulesPath:                  nil,
-		randSrc:                    &rsource,
 		configmapEventRecorderFunc: events.Add,
 	}
 
@@ -228,7 +235,7 @@ func TestExtractRulesAsRuleGroups(t *testing.T) {
 
 func TestExtractValues(t *testing.T) {
 	Convey("Presented with a configmap, the proper values should be extracted regardless of formats, where the format is acceptable", t, func() {
-		mrg := c.extractValues(&configmapDataBlockAllThree)
+		mrg := c.extractValues(pipeline, &configmapDataBlockAllThree)
 		So(len(mrg.Values), ShouldEqual, 3)
 		So(countMultiRuleGroupsRules(mrg), ShouldEqual, 6)
 	})
@@ -252,7 +259,7 @@ func TestExtractValues(t *testing.T) {
 					"test3": `- record: failNoExpression`,
 				}
 
-		mrg := c.extractValues(&cm)
+		mrg := c.extractValues(pipeline, &cm)
 		So(len(mrg.Values), ShouldEqual, 1)
 		So(countMultiRuleGroupsRules(mrg), ShouldEqual, 1)
 		// 1 key accepted at all
@@ -266,12 +273,40 @@ func TestExtractValues(t *testing.T) {
 
 func TestIsRuleConfigMap(t *testing.T) {
 	Convey("Should correctly detect a properly annotated configmap", t, func() {
-		ok := c.isRuleConfigMap(&configmapDataBlockRules)
-		ok2 := c.isRuleConfigMap(&configmapNoAnnotation)
+		ok := c.isRuleConfigMap(pipeline, &configmapDataBlockRules)
+		ok2 := c.isRuleConfigMap(pipeline, &configmapNoAnnotation)
 
 		So(ok, ShouldBeTrue)
 		So(ok2, ShouldBeFalse)
 	})
+
+	Convey("The annotation value should select the configmap for the right targets", t, func() {
+		oldTarget := pipeline.target
+		defer func() { pipeline.target = oldTarget }()
+
+		cases := []struct {
+			value  string
+			target string
+			ok     bool
+		}{
+			{"true", "", true},
+			{"True", "apps", true},
+			{"false", "", false},
+			{"false", "apps", false},
+			{"", "", false},
+			{"apps", "", false},
+			{"apps", "apps", true},
+			{"platform, apps", "apps", true},
+			{"platform,slo", "apps", false},
+		}
+
+		for _, tc := range cases {
+			pipeline.target = tc.target
+			cm := configmapDataBlockRules
+			cm.ObjectMeta.Annotations = map[string]string{myAnno: tc.value}
+			So(c.isRuleConfigMap(pipeline, &cm), ShouldEqual, tc.ok)
+		}
+	})
 }
 
 
@@ -280,6 +315,8 @@ func TestHaveRuleConfigMapsChanged(t *testing.T) {
 		cm1 := configmapDataBlockAllThree
 		cm2 := configmapDataBlockAllThree
 
+		cm2.Name = "rules-groups-all-three-copy"
+
 		cm1.ResourceVersion = "0000000001"
 		cm2.ResourceVersion = "0000000001"
 
@@ -287,24 +324,402 @@ func TestHaveRuleConfigMapsChanged(t *testing.T) {
 
 
 		// initial read should be positive
-		changed := c.haveConfigMapsChanged(&list)
+		changed := c.haveConfigMapsChanged(pipeline, &list)
 		So(changed, ShouldBeTrue)
 
 		// run it again, should be false (no changes)
-		changed = c.haveConfigMapsChanged(&list)
+		changed = c.haveConfigMapsChanged(pipeline, &list)
 		So(changed, ShouldBeFalse)
 
-		// tweak then one last time, RV will change on one should be true
+		// tweak then one last time, the data will change on one should be true
 		list.Items[1].ResourceVersion = "0000000002"
-		changed = c.haveConfigMapsChanged(&list)
+		list.Items[1].Data = map[string]string{"rules": string(testRuleGroup)}
+		changed = c.haveConfigMapsChanged(pipeline, &list)
 		So(changed, ShouldBeTrue)
 
+		// writing the status bumps the resource version, but it's no change
+		pipeline.statusAnnotation = "status"
+		defer func() { pipeline.statusAnnotation = "" }()
+		list.Items[1].ResourceVersion = "0000000003"
+		list.Items[1].Annotations = map[string]string{myAnno: "true", "status": "[]"}
+		changed = c.haveConfigMapsChanged(pipeline, &list)
+		So(changed, ShouldBeFalse)
+
+
+	})
+}
+
+func TestUnloadConfigMap(t *testing.T) {
+	Convey("Rules of a configmap that isn't selected anymore should be unloaded", t, func() {
+		dir, err := ioutil.TempDir("", "rules")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		cm := configmapDataBlockRules.DeepCopy()
+		cm.ResourceVersion = "1"
+		So(indexer.Add(cm), ShouldBeNil)
+
+		up := &Pipeline{Name: "unload", interestingAnnotation: myAnno, rulesPath: filepath.Join(dir, "rules.yaml"), resourceVersionMap: make(map[string]string)}
+		uc := &Controller{
+			configmapsLister:           corev1listers.NewConfigMapLister(indexer),
+			configmapEventRecorderFunc: events.Add,
+		}
+		key := cm.Namespace + "/" + cm.Name
+
+		So(uc.syncHandler(up, key), ShouldBeNil)
+		written, err := ioutil.ReadFile(up.rulesPath)
+		So(err, ShouldBeNil)
+		So(string(written), ShouldContainSubstring, "alert:")
+
+		disabled := cm.DeepCopy()
+		disabled.Annotations = map[string]string{myAnno: "false"}
+		disabled.ResourceVersion = "2"
+		So(indexer.Update(disabled), ShouldBeNil)
+
+		So(uc.syncHandler(up, key), ShouldBeNil)
+		written, err = ioutil.ReadFile(up.rulesPath)
+		So(err, ShouldBeNil)
+		So(string(written), ShouldNotContainSubstring, "alert:")
+		So(up.hasResourceVersion(uc.createNameStub(cm)), ShouldBeFalse)
+	})
+}
+
+func TestRepeatedEvents(t *testing.T) {
+	Convey("Rebuilding the same rules should not repeat their events", t, func() {
+		events.Clear()
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{conflictConfigMap("team-a", time.Hour, "- alert: Broken\n  expr: up ==\n")}}
+		ep := &Pipeline{Name: "events", interestingAnnotation: myAnno, statusAnnotation: "status"}
+		ec := &Controller{
+			configmapEventRecorderFunc: events.Add,
+			// stands in for the api server, the next rebuild sees the status
+			configmapStatusFunc: func(p *Pipeline, cm *corev1.ConfigMap, reports []ValidationReport) {
+				status, _ := json.Marshal(reports)
+				list.Items[0].Annotations[p.statusAnnotation] = string(status)
+			},
+		}
+
+		ec.collectRuleGroups(ep, list)
+		So(events.CountWarnings(), ShouldBeGreaterThan, 0)
+		So(list.Items[0].Annotations["status"], ShouldNotBeEmpty)
 
+		events.Clear()
+		ec.collectRuleGroups(ep, list)
+		So(events.Events, ShouldBeEmpty)
+
+		// another mistake changes the status, so it's told again
+		list.Items[0].Data["rules"] = "- alert: Broken\n  expr: up == 0\n  for: soon\n"
+		ec.collectRuleGroups(ep, list)
+		So(events.CountWarnings(), ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Without a status annotation every rebuild should record the events", t, func() {
+		events.Clear()
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{conflictConfigMap("team-a", time.Hour, "- alert: Broken\n  expr: up ==\n")}}
+		ep := &Pipeline{Name: "events", interestingAnnotation: myAnno}
+		ec := &Controller{configmapEventRecorderFunc: events.Add}
+
+		ec.collectRuleGroups(ep, list)
+		first := events.CountWarnings()
+		So(first, ShouldBeGreaterThan, 0)
+		ec.collectRuleGroups(ep, list)
+		So(events.CountWarnings(), ShouldEqual, 2*first)
+	})
+
+	Convey("Events recorded outside of a rebuild should not be held", t, func() {
+		events.Clear()
+		ec := &Controller{configmapEventRecorderFunc: events.Add}
+		cm := configmapDataBlockRules.DeepCopy()
+
+		ec.holdEvents(cm)
+		ec.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, "held")
+		ec.recordEvent(configmapDataBlockRules.DeepCopy(), corev1.EventTypeWarning, ErrInvalidKey, "not held")
+		So(len(events.Events), ShouldEqual, 1)
+		So(events.Events[0].Message, ShouldEqual, "not held")
+
+		ec.releaseEvents(cm, true)
+		So(len(events.Events), ShouldEqual, 2)
+		So(events.Events[1].Message, ShouldEqual, "held")
 	})
 }
 
 func TestValidateRuleGroups(t *testing.T) {
+	cases := []struct {
+		name      string
+		rules     []rulefmt.Rule
+		remaining []string
+		fields    []string
+	}{
+		{
+			name:      "valid rules are kept",
+			rules:     validRulesArray(),
+			remaining: []string{"job:http_inprogress_requests:sum", "HighErrorRate"},
+			fields:    []string{},
+		},
+		{
+			name: "invalid expression",
+			rules: []rulefmt.Rule{
+				{Record: "test0", Expr: "sum(up)"},
+				{Record: "test1", Expr: "sum(up"},
+				{Record: "test2", Expr: "sum(up)"},
+			},
+			remaining: []string{"test0", "test2"},
+			fields:    []string{"expr"},
+		},
+		{
+			name: "missing expression",
+			rules: []rulefmt.Rule{
+				{Record: "test0"},
+			},
+			remaining: []string{},
+			fields:    []string{"expr"},
+		},
+		{
+			name: "for duration on a recording rule",
+			rules: []rulefmt.Rule{
+				{Record: "test0", Expr: "sum(up)", For: model.Duration(5 * time.Minute)},
+				{Alert: "test1", Expr: "up == 0", For: model.Duration(5 * time.Minute)},
+			},
+			remaining: []string{"test1"},
+			fields:    []string{"for"},
+		},
+		{
+			name: "invalid annotation template",
+			rules: []rulefmt.Rule{
+				{Alert: "test0", Expr: "up == 0", Annotations: map[string]string{"summary": "{{ $labels.instance "}},
+				{Alert: "test1", Expr: "up == 0", Annotations: map[string]string{"summary": "{{ $labels.instance }} is down"}},
+			},
+			remaining: []string{"test1"},
+			fields:    []string{"annotations.summary"},
+		},
+		{
+			name: "invalid label template",
+			rules: []rulefmt.Rule{
+				{Alert: "test0", Expr: "up == 0", Labels: map[string]string{"severity": "{{ if }}"}},
+			},
+			remaining: []string{},
+			fields:    []string{"labels.severity"},
+		},
+		{
+			name: "several invalid rules in one group",
+			rules: []rulefmt.Rule{
+				{Record: "test0", Expr: "sum(up"},
+				{Record: "test1", Expr: "sum(up)"},
+				{Record: "test2", Expr: ""},
+				{Record: "test3", Expr: "sum(up)"},
+			},
+			remaining: []string{"test1", "test3"},
+			fields:    []string{"expr", "expr"},
+		},
+		{
+			name: "errors in labels and annotations in sorted order",
+			rules: []rulefmt.Rule{
+				{Alert: "test0", Expr: "up == 0",
+					Labels:      map[string]string{"c": "{{ if }}", "a": "{{ if }}", "b": "{{ if }}"},
+					Annotations: map[string]string{"z": "{{ if }}", "y": "{{ if }}"}},
+			},
+			remaining: []string{},
+			fields:    []string{"labels.a", "labels.b", "labels.c", "annotations.y", "annotations.z"},
+		},
+		{
+			name: "record and alert both set",
+			rules: []rulefmt.Rule{
+				{Record: "test0", Alert: "test0", Expr: "sum(up)"},
+			},
+			remaining: []string{},
+			fields:    []string{"record"},
+		},
+	}
+
+	for _, tc := range cases {
+		Convey(fmt.Sprintf("validateRuleGroups: %s", tc.name), t, func() {
+			events.Clear()
+			// the rules under test go into the second group, the first one is always valid
+			rgs := RuleGroups{Groups: []RuleGroup{
+				createRuleGroup(),
+				{Name: "UnderTest", Rules: tc.rules},
+			}}
+
+			validated, report := c.validateRuleGroups(pipeline, &configmapDataBlockRules, "rules", rgs)
+
+			So(len(validated.Groups[0].Rules), ShouldEqual, 3)
 
+			remaining := make([]string, 0)
+			for _, r := range validated.Groups[1].Rules {
+				name := r.Alert
+				if name == "" {
+					name = r.Record
+				}
+				remaining = append(remaining, name)
+			}
+			So(remaining, ShouldResemble, tc.remaining)
+
+			fields := make([]string, 0)
+			for _, verr := range report {
+				So(verr.Group, ShouldEqual, "UnderTest")
+				fields = append(fields, verr.Field)
+			}
+			So(fields, ShouldResemble, tc.fields)
+			So(events.CountWarnings(), ShouldEqual, len(tc.fields))
+		})
+	}
+}
+
+func TestValidateRuleGroupsGroupLevel(t *testing.T) {
+	Convey("Group level errors should reject only the offending group", t, func() {
+		events.Clear()
+		dup := createRuleGroup()
+		unnamed := createRuleGroup()
+		unnamed.Name = ""
+		rgs := RuleGroups{Groups: []RuleGroup{createRuleGroup(), dup, unnamed}}
+
+		validated, report := c.validateRuleGroups(pipeline, &configmapDataBlockRules, "rules", rgs)
+		So(len(validated.Groups), ShouldEqual, 1)
+		So(validated.Groups[0].Name, ShouldEqual, "Test")
+		So(len(report), ShouldEqual, 2)
+		So(report[0].Field, ShouldEqual, "name")
+		So(report[0].Group, ShouldEqual, "Test")
+		So(report[1].Field, ShouldEqual, "name")
+		So(events.CountWarnings(), ShouldEqual, 2)
+	})
+
+	Convey("Repeated rule names should reject their group", t, func() {
+		events.Clear()
+		severities := RuleGroup{Name: "severities", Rules: []rulefmt.Rule{
+			{Alert: "InstanceDown", Expr: "up == 0", Labels: map[string]string{"severity": "warning"}},
+			{Alert: "InstanceDown", Expr: "up == 0", Labels: map[string]string{"severity": "page"}},
+		}}
+		repeated := RuleGroup{Name: "repeated", Rules: []rulefmt.Rule{
+			{Record: "job:up:sum", Expr: "sum(up) by (job)"},
+			{Record: "job:up:sum", Expr: "sum(up) by (job)"},
+		}}
+		distinct := RuleGroup{Name: "distinct", Rules: []rulefmt.Rule{
+			{Alert: "InstanceDown", Expr: "up == 0", Labels: map[string]string{"severity": "page"}},
+			{Alert: "InstanceFlapping", Expr: "changes(up[10m]) > 3"},
+		}}
+		rgs := RuleGroups{Groups: []RuleGroup{severities, repeated, distinct}}
+
+		validated, report := c.validateRuleGroups(pipeline, &configmapDataBlockRules, "rules", rgs)
+		So(len(validated.Groups), ShouldEqual, 1)
+		So(validated.Groups[0].Name, ShouldEqual, "distinct")
+		So(len(report), ShouldEqual, 2)
+		So(report[0].Group, ShouldEqual, "severities")
+		So(report[0].Rule, ShouldEqual, "InstanceDown")
+		So(report[1].Group, ShouldEqual, "repeated")
+		So(report[1].Rule, ShouldEqual, "job:up:sum")
+		So(events.CountWarnings(), ShouldEqual, 2)
+	})
+
+	Convey("A group that doesn't decode should not take the rest of the key with it", t, func() {
+		events.Clear()
+		cm := corev1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "rules",
+				Namespace:   "default",
+				Annotations: map[string]string{myAnno: "true"},
+			},
+			Data: map[string]string{
+				// spacing inside of `` is sacrosanct do not over-format
+				"groups": `groups:
+- name: good
+  rules:
+  - record: job:up:sum
+    expr: sum(up) by (job)
+- name: badinterval
+  interval: 1 minute
+  rules:
+  - record: job:up:count
+    expr: count(up) by (job)
+- name: badfor
+  rules:
+  - alert: InstanceDown
+    expr: up == 0
+    for: soon`,
+				"group": `name: single
+interval: often
+rules:
+- record: job:up:sum
+  expr: sum(up) by (job)`,
+			},
+		}
+
+		mrg := c.extractValues(pipeline, &cm)
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(mrg.Values[0].Groups[0].Name, ShouldEqual, "good")
+
+		So(mrg.Reports[0].Key, ShouldEqual, "group")
+		So(mrg.Reports[0].Accepted, ShouldBeFalse)
+		So(mrg.Reports[0].Errors[0].Group, ShouldEqual, "single")
+		So(mrg.Reports[0].Errors[0].Field, ShouldEqual, "interval")
+
+		So(mrg.Reports[1].Key, ShouldEqual, "groups")
+		So(mrg.Reports[1].Accepted, ShouldBeTrue)
+		So(len(mrg.Reports[1].Errors), ShouldEqual, 2)
+		So(mrg.Reports[1].Errors[0].Group, ShouldEqual, "badinterval")
+		So(mrg.Reports[1].Errors[0].Field, ShouldEqual, "interval")
+		So(mrg.Reports[1].Errors[1].Group, ShouldEqual, "badfor")
+		So(mrg.Reports[1].Errors[1].Field, ShouldEqual, "rules")
+
+		// 3 decode failures, 1 "key has no rules failure" (group)
+		So(events.CountWarnings(), ShouldEqual, 4)
+		So(events.CountNormals(), ShouldEqual, 1)
+	})
+}
+
+func TestExtractValuesReports(t *testing.T) {
+	Convey("Every key of a configmap should get a validation report", t, func() {
+		events.Clear()
+		cm := corev1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "rules",
+				Namespace:   "default",
+				Annotations: map[string]string{myAnno: "true"},
+			},
+			Data: map[string]string{
+				"good": string(testRules),
+				// spacing inside of `` is sacrosanct do not over-format
+				"badduration": `- alert: InstanceDown
+  expr: up == 0
+  for: 10x`,
+				"badexpr": `- record: job:up:sum
+  expr: sum(up) by (job
+- record: job:up:count
+  expr: count(up) by (job)`,
+			},
+		}
+
+		mrg := c.extractValues(pipeline, &cm)
+		So(len(mrg.Values), ShouldEqual, 2)
+		So(len(mrg.Reports), ShouldEqual, 3)
+
+		// reports are sorted by key
+		So(mrg.Reports[0].Key, ShouldEqual, "badduration")
+		So(mrg.Reports[0].Accepted, ShouldBeFalse)
+		So(len(mrg.Reports[0].Errors), ShouldEqual, 1)
+
+		So(mrg.Reports[1].Key, ShouldEqual, "badexpr")
+		So(mrg.Reports[1].Accepted, ShouldBeTrue)
+		So(mrg.Reports[1].Rules, ShouldEqual, 1)
+		So(len(mrg.Reports[1].Errors), ShouldEqual, 1)
+		So(mrg.Reports[1].Errors[0].Rule, ShouldEqual, "job:up:sum")
+		So(mrg.Reports[1].Errors[0].Field, ShouldEqual, "expr")
+
+		So(mrg.Reports[2].Key, ShouldEqual, "good")
+		So(mrg.Reports[2].Accepted, ShouldBeTrue)
+		So(mrg.Reports[2].Groups, ShouldEqual, 1)
+		So(mrg.Reports[2].Rules, ShouldEqual, 2)
+		So(len(mrg.Reports[2].Errors), ShouldEqual, 0)
+	})
+
+	Convey("Reports should be written to the status annotation as json", t, func() {
+		reports := []ValidationReport{
+			{Key: "a", Accepted: true, Groups: 1, Rules: 2},
+			{Key: "b", Errors: []ValidationError{{Group: "g", Rule: "r", Field: "expr", Err: fmt.Errorf("boom")}}},
+		}
+		status, err := json.Marshal(reports)
+		So(err, ShouldBeNil)
+		So(string(status), ShouldEqual, `[{"key":"a","accepted":true,"groups":1,"rules":2},{"key":"b","accepted":false,"groups":0,"rules":0,"errors":[{"group":"g","rule":"r","field":"expr","error":"boom"}]}]`)
+	})
 }
 
 func TestRemoveRules(t *testing.T) {
@@ -363,6 +778,17 @@ func TestSaltRuleGroupNames(t *testing.T) {
 		So(rgs2.Groups[1].Name, ShouldNotEqual, rgs2.Groups[2].Name)
 
 	})
+
+	Convey("Salting the same groups twice should give the same names", t, func() {
+		first, second := createRuleGroups(), createRuleGroups()
+		first.Groups[2].Name = first.Groups[0].Name + "-2"
+		second.Groups[2].Name = second.Groups[0].Name + "-2"
+
+		c.saltRuleGroupNames(&first)
+		c.saltRuleGroupNames(&second)
+		So(first, ShouldResemble, second)
+		So(first.Groups[1].Name, ShouldEqual, first.Groups[0].Name + "-3")
+	})
 }
 
 func validRulesArray() []rulefmt.Rule {
@@ -384,8 +810,8 @@ func validRulesArray() []rulefmt.Rule {
 	}
 }
 
-func createRuleGroup() rulefmt.RuleGroup {
-	rg := rulefmt.RuleGroup{
+func createRuleGroup() RuleGroup {
+	rg := RuleGroup{
 		Name:     "Test",
 		Interval: 0,
 		Rules:    nil,
@@ -417,8 +843,8 @@ func createRuleGroup() rulefmt.RuleGroup {
 	return rg
 }
 
-func createRuleGroups() rulefmt.RuleGroups {
-	rgs := rulefmt.RuleGroups{}
+func createRuleGroups() RuleGroups {
+	rgs := RuleGroups{}
 	rgs.Groups = append(rgs.Groups, createRuleGroup())
 	rgs.Groups = append(rgs.Groups, createRuleGroup())
 	rgs.Groups = append(rgs.Groups, createRuleGroup())
@@ -429,17 +855,17 @@ func createRuleGroups() rulefmt.RuleGroups {
 // returns a mrg of 2 rulegroups, one which has 2 rg the other has 1
 // total of 3 rg and 9 rules
 func createMultiRuleGroups() MultiRuleGroups {
-	rgs0 := rulefmt.RuleGroups{}
+	rgs0 := RuleGroups{}
 
 	rgs0.Groups = append(rgs0.Groups, createRuleGroup())
 	rgs0.Groups = append(rgs0.Groups, createRuleGroup())
 
-	rgs1 := rulefmt.RuleGroups{}
+	rgs1 := RuleGroups{}
 
 	rgs1.Groups = append(rgs1.Groups, createRuleGroup())
 
 	mgs := MultiRuleGroups{}
-	mgs.Values = []rulefmt.RuleGroups{rgs0, rgs1}
+	mgs.Values = []RuleGroups{rgs0, rgs1}
 
 	return mgs
 }
@@ -454,7 +880,7 @@ func countMultiRuleGroupsRules(mrgs MultiRuleGroups) int {
 	return count
 }
 
-func countRuleGroupsRules(rgs rulefmt.RuleGroups) int {
+func countRuleGroupsRules(rgs RuleGroups) int {
 	count := 0
 	for _, rg := range rgs.Groups {
 		count += len(rg.Rules)
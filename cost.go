@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// expressionCostPolicy statically analyses rule expressions for patterns that
+// are known to be expensive to evaluate.
+type expressionCostPolicy struct {
+	spec                  PolicySpec
+	highCardinalityLabels map[string]struct{}
+}
+
+func newExpressionCostPolicy(spec PolicySpec) (Policy, error) {
+	if spec.MaxRange < 0 || spec.MaxSubqueryDepth < 0 {
+		return nil, fmt.Errorf("expressionCost thresholds must not be negative")
+	}
+	if spec.MaxRange == 0 && !spec.RequireMatchers && len(spec.HighCardinalityLabels) == 0 && spec.MaxSubqueryDepth == 0 {
+		return nil, fmt.Errorf("expressionCost needs at least one of maxRange, requireMatchers, highCardinalityLabels or maxSubqueryDepth")
+	}
+
+	policy := &expressionCostPolicy{spec: spec, highCardinalityLabels: make(map[string]struct{})}
+	for _, l := range spec.HighCardinalityLabels {
+		policy.highCardinalityLabels[l] = struct{}{}
+	}
+	return policy, nil
+}
+
+func (p *expressionCostPolicy) Spec() PolicySpec {
+	return p.spec
+}
+
+func (p *expressionCostPolicy) Check(rule rulefmt.Rule) []error {
+	expr, err := promql.ParseExpr(rule.Expr)
+	if err != nil {
+		// reported by validateRule
+		return nil
+	}
+	return p.analyze(expr)
+}
+
+func (p *expressionCostPolicy) analyze(expr promql.Expr) []error {
+	errs := make([]error, 0)
+	maxRange := time.Duration(p.spec.MaxRange)
+
+	promql.Inspect(expr, func(node promql.Node, path []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			errs = append(errs, p.checkMatchers(n.String(), n.LabelMatchers)...)
+
+		case *promql.MatrixSelector:
+			if maxRange > 0 && n.Range > maxRange {
+				errs = append(errs, fmt.Errorf("range of %s exceeds the maximum of %s", n.String(), p.spec.MaxRange))
+			}
+			errs = append(errs, p.checkMatchers(n.String(), n.LabelMatchers)...)
+
+		case *promql.SubqueryExpr:
+			if maxRange > 0 && n.Range > maxRange {
+				errs = append(errs, fmt.Errorf("range of subquery %s exceeds the maximum of %s", n.String(), p.spec.MaxRange))
+			}
+			if p.spec.MaxSubqueryDepth > 0 {
+				depth := 1
+				for _, parent := range path {
+					if _, ok := parent.(*promql.SubqueryExpr); ok {
+						depth++
+					}
+				}
+				if depth > p.spec.MaxSubqueryDepth {
+					errs = append(errs, fmt.Errorf("subquery %s is nested %d deep, the maximum is %d", n.String(), depth, p.spec.MaxSubqueryDepth))
+				}
+			}
+
+		case *promql.AggregateExpr:
+			if n.Op != promql.ItemCountValues {
+				break
+			}
+			if param, ok := n.Param.(*promql.StringLiteral); ok && p.isHighCardinality(param.Val) {
+				errs = append(errs, fmt.Errorf("count_values into high cardinality label %q", param.Val))
+			}
+			if !n.Without {
+				for _, l := range n.Grouping {
+					if p.isHighCardinality(l) {
+						errs = append(errs, fmt.Errorf("count_values grouped by high cardinality label %q", l))
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	return errs
+}
+
+func (p *expressionCostPolicy) checkMatchers(selector string, matchers []*labels.Matcher) []error {
+	errs := make([]error, 0)
+
+	hasLabelMatcher := false
+	for _, m := range matchers {
+		if m.Name == model.MetricNameLabel {
+			continue
+		}
+		hasLabelMatcher = true
+		if (m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp) && p.isHighCardinality(m.Name) {
+			errs = append(errs, fmt.Errorf("selector %s uses a regex matcher on high cardinality label %q", selector, m.Name))
+		}
+	}
+
+	if p.spec.RequireMatchers && !hasLabelMatcher {
+		errs = append(errs, fmt.Errorf("selector %s has no label matchers", selector))
+	}
+
+	return errs
+}
+
+func (p *expressionCostPolicy) isHighCardinality(label string) bool {
+	_, ok := p.highCardinalityLabels[label]
+	return ok
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExpressionCostPolicy(t *testing.T) {
+	maxRange, err := model.ParseDuration("1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := PolicySpec{
+		ID:                    "cost",
+		Type:                  "expressionCost",
+		Action:                PolicyActionReject,
+		RequireMatchers:       true,
+		HighCardinalityLabels: []string{"pod", "instance"},
+		MaxSubqueryDepth:      1,
+		MaxRange:              maxRange,
+	}
+
+	policy, err := newExpressionCostPolicy(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		expr       string
+		violations int
+	}{
+		{`sum(rate(http_requests_total{job="api"}[5m])) by (job)`, 0},
+		{`sum(rate(http_requests_total[5m])) by (job)`, 1},
+		{`sum(rate(http_requests_total{job="api"}[30d]))`, 1},
+		{`sum(rate(http_requests_total[30d]))`, 2},
+		{`count_values("pod", kube_pod_info{namespace="a"})`, 1},
+		{`count_values("version", kube_pod_info{namespace="a"}) by (instance)`, 1},
+		{`count_values("version", kube_pod_info{namespace="a"}) without (instance)`, 0},
+		{`up{instance=~"web-.*"}`, 1},
+		{`up{job=~"web-.*"}`, 0},
+		{`max_over_time(rate(up{job="a"}[5m])[1h:1m])`, 0},
+		{`max_over_time(max_over_time(rate(up{job="a"}[5m])[1h:1m])[2h:1m])`, 1},
+		{`max_over_time(rate(up{job="a"}[5m])[7d:1m])`, 1},
+	}
+
+	for _, tc := range cases {
+		Convey("Expression cost of "+tc.expr, t, func() {
+			errs := policy.Check(rulefmt.Rule{Record: "a:b:c", Expr: tc.expr})
+			So(len(errs), ShouldEqual, tc.violations)
+		})
+	}
+
+	Convey("An expression cost policy without thresholds should be refused", t, func() {
+		_, err := newExpressionCostPolicy(PolicySpec{ID: "empty", Type: "expressionCost"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Expression cost thresholds should be read from the policy file", t, func() {
+		set, err := parsePolicies([]byte("policies:\n- id: cost\n  type: expressionCost\n  action: reject\n  maxRange: 1d\n  requireMatchers: true\n"))
+		So(err, ShouldBeNil)
+		So(set.Policies[0].Spec().MaxRange, ShouldEqual, maxRange)
+		So(len(set.Policies[0].Check(rulefmt.Rule{Record: "a:b:c", Expr: "sum(rate(x[30d]))"})), ShouldEqual, 2)
+	})
+}
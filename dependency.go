@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	ErrRuleDependency = "RuleDependency"
+
+	dependencyPath = "/debug/dependencies"
+)
+
+// DependencyNode is a rule in the dependency graph of a pipeline.
+type DependencyNode struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Group     string `json:"group"`
+	ConfigMap string `json:"configmap"`
+	Key       string `json:"key"`
+}
+
+// DependencyEdge leads from a recording rule to a rule using its series.
+type DependencyEdge struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	CrossGroup bool   `json:"crossGroup,omitempty"`
+	Cycle      bool   `json:"cycle,omitempty"`
+}
+
+// DependencyGraph shows which rules of a pipeline use the series of which
+// recording rules.
+type DependencyGraph struct {
+	Pipeline string           `json:"pipeline"`
+	Nodes    []DependencyNode `json:"nodes"`
+	Edges    []DependencyEdge `json:"edges"`
+	// Cycles lists the ids of the rules that depend on each other.
+	Cycles [][]string `json:"cycles,omitempty"`
+}
+
+// ruleRef is where a rule of the graph lives in the loaded rules.
+type ruleRef struct {
+	cm    *corev1.ConfigMap
+	rules *MultiRuleGroups
+	value int
+	group int
+	index int
+}
+
+func (r ruleRef) sameGroup(other ruleRef) bool {
+	return r.rules == other.rules && r.value == other.value && r.group == other.group
+}
+
+func (r ruleRef) rule() rulefmt.Rule {
+	return r.rules.Values[r.value].Groups[r.group].Rules[r.index]
+}
+
+// usedMetrics returns the metric names expr selects, unparsable expressions
+// and LogQL use none.
+func usedMetrics(language, expr string) []string {
+	if language == LanguageLogQL {
+		return nil
+	}
+	parsed, err := promql.ParseExpr(expr)
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0)
+	add := func(name string, matchers []*labels.Matcher) {
+		if name == "" {
+			for _, m := range matchers {
+				if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+					name = m.Value
+				}
+			}
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	promql.Inspect(parsed, func(node promql.Node, path []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			add(n.Name, n.LabelMatchers)
+		case *promql.MatrixSelector:
+			add(n.Name, n.LabelMatchers)
+		}
+		return nil
+	})
+	return names
+}
+
+// reorderGroup sorts the rules of group so that recording rules come before
+// the rules of the group using them, otherwise keeping their order. Rules in
+// a cycle keep their order.
+func reorderGroup(language string, group *RuleGroup) bool {
+	producers := make(map[string][]int)
+	for i, rule := range group.Rules {
+		if rule.Record != "" {
+			producers[rule.Record] = append(producers[rule.Record], i)
+		}
+	}
+
+	before := make([]map[int]struct{}, len(group.Rules))
+	for i, rule := range group.Rules {
+		before[i] = make(map[int]struct{})
+		for _, name := range usedMetrics(language, rule.Expr) {
+			for _, producer := range producers[name] {
+				if producer != i {
+					before[i][producer] = struct{}{}
+				}
+			}
+		}
+	}
+
+	order := make([]int, 0, len(group.Rules))
+	placed := make(map[int]struct{})
+	for len(order) < len(group.Rules) {
+		progress := false
+		for i := range group.Rules {
+			if _, ok := placed[i]; ok {
+				continue
+			}
+			ready := true
+			for producer := range before[i] {
+				if _, ok := placed[producer]; !ok {
+					ready = false
+				}
+			}
+			if ready {
+				order = append(order, i)
+				placed[i] = struct{}{}
+				progress = true
+				// start over so earlier rules that just became ready go first
+				break
+			}
+		}
+		if !progress {
+			// a cycle, the rest stays as it is
+			for i := range group.Rules {
+				if _, ok := placed[i]; !ok {
+					order = append(order, i)
+					placed[i] = struct{}{}
+				}
+			}
+		}
+	}
+
+	changed := false
+	rules := make([]rulefmt.Rule, len(group.Rules))
+	for i, index := range order {
+		rules[i] = group.Rules[index]
+		changed = changed || i != index
+	}
+	group.Rules = rules
+	return changed
+}
+
+// analyzeDependencies builds the dependency graph of the rules pipeline p
+// loaded and reports cycles, rules using recording rules of other groups and
+// rules evaluated before the recording rules they use on the configmaps of
+// the rules using them. When p reorders rules they are reordered first.
+func (c *Controller) analyzeDependencies(p *Pipeline, loaded []*corev1.ConfigMap, loadedRules []*MultiRuleGroups) *DependencyGraph {
+	language := p.queryLanguage()
+	graph := &DependencyGraph{Pipeline: p.Name, Nodes: make([]DependencyNode, 0), Edges: make([]DependencyEdge, 0)}
+
+	refs := make([]ruleRef, 0)
+	producers := make(map[string][]int)
+	for i, cm := range loaded {
+		mrg := loadedRules[i]
+		nameStub := c.createNameStub(cm)
+		for v := range mrg.Values {
+			for g := range mrg.Values[v].Groups {
+				group := &mrg.Values[v].Groups[g]
+				if p.reorderRules && reorderGroup(language, group) {
+					klog.V(2).Infof("Pipeline %s: reordered the rules of group %s of configmap %s.", p.Name, group.Name, nameStub)
+				}
+				for r, rule := range group.Rules {
+					node := DependencyNode{Kind: "alert", Name: rule.Alert, Group: group.Name, ConfigMap: nameStub, Key: mrg.Keys[v]}
+					if rule.Record != "" {
+						node.Kind = "record"
+						node.Name = rule.Record
+						producers[rule.Record] = append(producers[rule.Record], len(refs))
+					}
+					node.ID = fmt.Sprintf("%s/%s/%s/%d", nameStub, node.Key, group.Name, r)
+					graph.Nodes = append(graph.Nodes, node)
+					refs = append(refs, ruleRef{cm: cm, rules: mrg, value: v, group: g, index: r})
+				}
+			}
+		}
+	}
+
+	edges := make([][]int, len(refs))
+	for consumer, ref := range refs {
+		seen := make(map[int]struct{})
+		for _, name := range usedMetrics(language, ref.rule().Expr) {
+			for _, producer := range producers[name] {
+				if _, ok := seen[producer]; ok {
+					continue
+				}
+				seen[producer] = struct{}{}
+				edges[producer] = append(edges[producer], consumer)
+			}
+		}
+	}
+
+	inCycle := make(map[int]int)
+	for n, cycle := range dependencyCycles(edges) {
+		ids := make([]string, 0, len(cycle))
+		names := make([]string, 0, len(cycle))
+		for _, node := range cycle {
+			inCycle[node] = n
+			ids = append(ids, graph.Nodes[node].ID)
+			names = append(names, graph.Nodes[node].Name)
+		}
+		graph.Cycles = append(graph.Cycles, ids)
+
+		reported := make(map[*MultiRuleGroups]struct{})
+		for _, node := range cycle {
+			ref := refs[node]
+			if _, ok := reported[ref.rules]; ok {
+				continue
+			}
+			reported[ref.rules] = struct{}{}
+			c.reportDependency(ref, graph.Nodes[node], fmt.Errorf("recording rules %s depend on each other in a cycle", strings.Join(names, ", ")))
+		}
+	}
+
+	for producer := range edges {
+		for _, consumer := range edges[producer] {
+			from, to := refs[producer], refs[consumer]
+			edge := DependencyEdge{From: graph.Nodes[producer].ID, To: graph.Nodes[consumer].ID, CrossGroup: !from.sameGroup(to)}
+			pc, pok := inCycle[producer]
+			cc, cok := inCycle[consumer]
+			edge.Cycle = pok && cok && pc == cc
+			graph.Edges = append(graph.Edges, edge)
+			if edge.Cycle {
+				continue
+			}
+
+			source := graph.Nodes[producer]
+			switch {
+			case edge.CrossGroup:
+				c.reportDependency(to, graph.Nodes[consumer], fmt.Errorf("uses %s recorded by group %s of configmap %s key %s, groups are evaluated independently so it can see data up to an evaluation interval old", source.Name, source.Group, source.ConfigMap, source.Key))
+			case to.index < from.index:
+				c.reportDependency(to, graph.Nodes[consumer], fmt.Errorf("is evaluated before %s which it uses, it sees the result of the previous evaluation", source.Name))
+			}
+		}
+	}
+
+	return graph
+}
+
+func (c *Controller) reportDependency(ref ruleRef, node DependencyNode, err error) {
+	verr := ValidationError{Group: node.Group, Rule: node.Name, Err: err}
+	addReportWarning(ref.rules, node.Key, verr)
+	errorMsg := fmt.Sprintf("Rule dependency: Namespace-ConfigMap:%s, Key:%s, %s", node.ConfigMap, node.Key, verr.Error())
+	c.recordEvent(ref.cm, corev1.EventTypeWarning, ErrRuleDependency, errorMsg)
+}
+
+// dependencyCycles returns the strongly connected components of the graph
+// that form a cycle, using Tarjan's algorithm. Rules using their own series
+// are a cycle of one.
+func dependencyCycles(edges [][]int) [][]int {
+	index := make([]int, len(edges))
+	low := make([]int, len(edges))
+	onStack := make([]bool, len(edges))
+	for i := range index {
+		index[i] = -1
+	}
+	stack := make([]int, 0)
+	next := 0
+	cycles := make([][]int, 0)
+
+	var visit func(node int)
+	visit = func(node int) {
+		index[node], low[node] = next, next
+		next++
+		stack = append(stack, node)
+		onStack[node] = true
+
+		selfLoop := false
+		for _, to := range edges[node] {
+			if to == node {
+				selfLoop = true
+			}
+			if index[to] == -1 {
+				visit(to)
+				if low[to] < low[node] {
+					low[node] = low[to]
+				}
+			} else if onStack[to] && index[to] < low[node] {
+				low[node] = index[to]
+			}
+		}
+
+		if low[node] != index[node] {
+			return
+		}
+		component := make([]int, 0)
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == node {
+				break
+			}
+		}
+		if len(component) > 1 || selfLoop {
+			sort.Ints(component)
+			cycles = append(cycles, component)
+		}
+	}
+
+	for node := range edges {
+		if index[node] == -1 {
+			visit(node)
+		}
+	}
+	return cycles
+}
+
+// dot renders the graph in the Graphviz DOT language. Recording rules are
+// boxes, alerts ellipses, dependencies across groups are dashed and cycles
+// red.
+func (graph *DependencyGraph) dot() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %q {\n", graph.Pipeline)
+	buf.WriteString("  rankdir=LR;\n")
+	for _, node := range graph.Nodes {
+		shape := "ellipse"
+		if node.Kind == "record" {
+			shape = "box"
+		}
+		fmt.Fprintf(&buf, "  %q [label=%q, shape=%s];\n", node.ID, node.Name+"\n"+node.ConfigMap+"/"+node.Group, shape)
+	}
+	for _, edge := range graph.Edges {
+		attrs := make([]string, 0)
+		if edge.CrossGroup {
+			attrs = append(attrs, "style=dashed")
+		}
+		if edge.Cycle {
+			attrs = append(attrs, "color=red")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&buf, "  %q -> %q [%s];\n", edge.From, edge.To, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&buf, "  %q -> %q;\n", edge.From, edge.To)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// serveDependencies serves the dependency graph of the pipeline named by the pipeline
+// parameter, which can be left out when there is only one. format=dot returns
+// the graph in the DOT language, anything else JSON.
+func (c *Controller) serveDependencies(w http.ResponseWriter, r *http.Request) {
+	c.settingsLock.RLock()
+	var p *Pipeline
+	names := make([]string, 0, len(c.pipelines))
+	for _, candidate := range c.pipelines {
+		names = append(names, candidate.Name)
+		if candidate.Name == r.URL.Query().Get("pipeline") || (r.URL.Query().Get("pipeline") == "" && len(c.pipelines) == 1) {
+			p = candidate
+		}
+	}
+	c.settingsLock.RUnlock()
+
+	if p == nil {
+		http.Error(w, fmt.Sprintf("pipeline must be one of %s", strings.Join(names, ", ")), http.StatusBadRequest)
+		return
+	}
+	graph := p.dependencyGraph()
+	if graph == nil {
+		http.Error(w, fmt.Sprintf("pipeline %s has not built its rules yet", p.Name), http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write(graph.dot())
+		return
+	}
+	out, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
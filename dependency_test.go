@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	// the alert comes before the recording rule it uses
+	producerRules = `
+groups:
+- name: http
+  rules:
+  - alert: HighRequestRate
+    expr: job:http_requests:rate5m > 100
+  - record: job:http_requests:rate5m
+    expr: sum by (job) (rate(http_requests_total[5m]))
+`
+	consumerRules = `
+groups:
+- name: slo
+  rules:
+  - record: job:http_requests:ratio
+    expr: job:http_requests:rate5m / ignoring(job) group_left sum(job:http_requests:rate5m)
+`
+	cycleRules = `
+groups:
+- name: loop
+  rules:
+  - record: a
+    expr: b + 1
+  - record: b
+    expr: '{__name__="a"} * 2'
+`
+)
+
+func dependencyConfigMaps() *corev1.ConfigMapList {
+	return &corev1.ConfigMapList{Items: []corev1.ConfigMap{
+		conflictConfigMap("team-a", time.Hour, producerRules),
+		conflictConfigMap("team-b", time.Minute, consumerRules),
+		conflictConfigMap("team-c", time.Second, cycleRules),
+	}}
+}
+
+func TestUsedMetrics(t *testing.T) {
+	Convey("Metric names should be found in vector, range and __name__ selectors", t, func() {
+		So(usedMetrics(LanguagePromQL, `rate(a[5m]) / b{job="x"} + {__name__="c"} + {__name__=~"d.*"}`), ShouldResemble, []string{"a", "b", "c"})
+		So(usedMetrics(LanguagePromQL, `sum((`), ShouldBeEmpty)
+		So(usedMetrics(LanguageLogQL, `rate({app="a"}[5m])`), ShouldBeEmpty)
+	})
+}
+
+func TestDependencyCycles(t *testing.T) {
+	Convey("Cycles and self loops should be found, chains are no cycles", t, func() {
+		So(dependencyCycles([][]int{{1}, {2}, {}}), ShouldBeEmpty)
+		So(dependencyCycles([][]int{{1}, {2}, {0}, {3}}), ShouldResemble, [][]int{{0, 1, 2}, {3}})
+	})
+}
+
+func TestAnalyzeDependencies(t *testing.T) {
+	statuses := make(map[string][]ValidationReport)
+	dc := &Controller{
+		configmapEventRecorderFunc: events.Add,
+		configmapStatusFunc: func(p *Pipeline, cm *corev1.ConfigMap, reports []ValidationReport) {
+			statuses[cm.Namespace] = reports
+		},
+	}
+
+	Convey("Cycles, cross group dependencies and ordering should be reported", t, func() {
+		events.Clear()
+		dp := &Pipeline{Name: "deps", interestingAnnotation: myAnno}
+		dc.collectRuleGroups(dp, dependencyConfigMaps())
+
+		graph := dp.dependencyGraph()
+		So(len(graph.Nodes), ShouldEqual, 5)
+		So(len(graph.Edges), ShouldEqual, 4)
+		So(graph.Cycles, ShouldResemble, [][]string{{"team-c-slo/rules/loop/0", "team-c-slo/rules/loop/1"}})
+
+		So(len(statuses["team-a"][0].Warnings), ShouldEqual, 1)
+		So(statuses["team-a"][0].Warnings[0].Error(), ShouldContainSubstring, "is evaluated before job:http_requests:rate5m")
+		// the two uses of the same recording rule are one dependency
+		So(len(statuses["team-b"][0].Warnings), ShouldEqual, 1)
+		So(statuses["team-b"][0].Warnings[0].Error(), ShouldContainSubstring, "recorded by group http of configmap team-a-slo")
+		So(len(statuses["team-c"][0].Warnings), ShouldEqual, 1)
+		So(statuses["team-c"][0].Warnings[0].Error(), ShouldContainSubstring, "recording rules a, b depend on each other in a cycle")
+		So(events.CountWarnings(), ShouldEqual, 3)
+	})
+
+	Convey("Reordering should put recording rules before the rules of their group using them", t, func() {
+		events.Clear()
+		dp := &Pipeline{Name: "deps", interestingAnnotation: myAnno, reorderRules: true}
+		mrg := dc.collectRuleGroups(dp, dependencyConfigMaps())
+
+		So(mrg.Values[0].Groups[0].Rules[0].Record, ShouldEqual, "job:http_requests:rate5m")
+		So(mrg.Values[0].Groups[0].Rules[1].Alert, ShouldEqual, "HighRequestRate")
+		So(statuses["team-a"][0].Warnings, ShouldBeEmpty)
+		// cycles keep their order
+		So(mrg.Values[2].Groups[0].Rules[0].Record, ShouldEqual, "a")
+	})
+
+	Convey("The graph should be served as JSON and DOT", t, func() {
+		dp := &Pipeline{Name: "deps", interestingAnnotation: myAnno}
+		other := &Pipeline{Name: "other", interestingAnnotation: myAnno}
+		dc.pipelines = []*Pipeline{dp, other}
+		dc.collectRuleGroups(dp, dependencyConfigMaps())
+
+		server := httptest.NewServer(http.HandlerFunc(dc.serveDependencies))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + dependencyPath + "?pipeline=deps")
+		So(err, ShouldBeNil)
+		graph := DependencyGraph{}
+		So(json.NewDecoder(resp.Body).Decode(&graph), ShouldBeNil)
+		resp.Body.Close()
+		So(graph.Pipeline, ShouldEqual, "deps")
+		So(len(graph.Edges), ShouldEqual, 4)
+
+		resp, err = http.Get(server.URL + dependencyPath + "?pipeline=deps&format=dot")
+		So(err, ShouldBeNil)
+		dot, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(strings.HasPrefix(string(dot), `digraph "deps" {`), ShouldBeTrue)
+		So(string(dot), ShouldContainSubstring, `"team-a-slo/rules/http/1" -> "team-b-slo/rules/slo/0" [style=dashed];`)
+		So(string(dot), ShouldContainSubstring, `"team-c-slo/rules/loop/0" -> "team-c-slo/rules/loop/1" [color=red];`)
+
+		// two pipelines, one has to be picked, the other hasn't built yet
+		resp, err = http.Get(server.URL + dependencyPath)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+		resp, err = http.Get(server.URL + dependencyPath + "?pipeline=other")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// ruleFormat is the format the suffix of a configmap key asks for, empty when
+// the key gives no hint and every format is tried.
+func ruleFormat(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".json"):
+		return FormatJSON
+	case strings.HasSuffix(key, ".yaml"), strings.HasSuffix(key, ".yml"):
+		return FormatYAML
+	}
+	return ""
+}
+
+// syntaxError is a value that isn't a JSON or YAML document at all, as opposed
+// to a document that doesn't hold rules.
+type syntaxError struct {
+	error
+}
+
+// parseErrors are the problems that kept a value from being parsed, with the
+// line they are on as far as it is known.
+type parseErrors []ValidationError
+
+func (errs parseErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, verr := range errs {
+		messages = append(messages, verr.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// parseErrorList breaks an error of extractRuleGroupsAs into its problems.
+func parseErrorList(err error) []ValidationError {
+	if serr, ok := err.(syntaxError); ok {
+		err = serr.error
+	}
+	if errs, ok := err.(parseErrors); ok {
+		return errs
+	}
+	return []ValidationError{{Err: err}}
+}
+
+// looksLikeJSON is true for values that start like a JSON object or array.
+func looksLikeJSON(value string) bool {
+	trimmed := strings.TrimSpace(value)
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+}
+
+// documentMarker starts or ends a document of a YAML stream, it only counts
+// at the start of a line.
+var documentMarker = regexp.MustCompile(`^(---|\.\.\.)(\s|$)`)
+
+// splitDocuments splits the YAML stream value into its documents. The lines
+// before a document are kept as empty lines, so the lines of its errors count
+// from the start of value. Documents with nothing but comments in them are
+// left out. A value without markers is returned as is.
+func splitDocuments(value string) []string {
+	lines := strings.Split(value, "\n")
+	documents := make([]string, 0, 1)
+	start := 0
+	add := func(end int) {
+		document := strings.Repeat("\n", start) + strings.Join(lines[start:end], "\n")
+		var root interface{}
+		if err := yaml.Unmarshal([]byte(document), &root); err != nil || root != nil {
+			documents = append(documents, document)
+		}
+	}
+
+	for i, line := range lines {
+		if !documentMarker.MatchString(line) {
+			continue
+		}
+		add(i)
+		// whatever follows the marker belongs to the next document
+		lines[i] = "   " + line[3:]
+		start = i
+	}
+	if start == 0 {
+		return []string{value}
+	}
+	add(len(lines))
+
+	if len(documents) == 0 {
+		return []string{value}
+	}
+	return documents
+}
+
+// extractDocument decodes a single document of key with the parser the key
+// asks for, or with every format when it doesn't ask, and records an event for
+// every problem found. document is which document of the key value is,
+// counting from 1, or 0 if it is the only one. decoded is false when nothing
+// in the document could be read as rules.
+func (c *Controller) extractDocument(cm *corev1.ConfigMap, key string, value string, document int) (groups RuleGroups, errs []ValidationError, decoded bool) {
+	nameStub := c.createNameStub(cm)
+	// a []Rules document is named after the key, further ones need a name
+	// of their own
+	groupKey := key
+	if document > 1 {
+		groupKey = fmt.Sprintf("%s-%d", key, document)
+	}
+	errs = make([]ValidationError, 0)
+
+	var parseErr error
+	if format := ruleFormat(uncompressedKey(key)); format != "" {
+		// the suffix of the key picks the parser
+		parseErr, groups = c.extractRuleGroupsAs(format, nameStub, groupKey, value)
+	} else {
+		// try each encoding
+		// try to extract a rulegroups
+		err, rulegroups := c.extractRuleGroups(value)
+		if err != nil {
+			// try to extract a rulegroup as a rulegroups
+			err, rulegroups = c.extractRuleGroupAsRuleGroups(value)
+			if err != nil {
+				// try to extract a rules array as a rulegroups
+				_, rulegroups = c.extractRulesAsRuleGroups(nameStub, groupKey, value)
+			}
+		}
+		groups = rulegroups
+	}
+
+	// a single group that can't be decoded takes the whole document down with
+	// it, decode the groups one at a time so only the broken ones are lost,
+	// unless the parser of the key rejects the value altogether
+	decodeErrors := make([]ValidationError, 0)
+	if _, invalid := parseErr.(syntaxError); len(groups.Groups) == 0 && !invalid {
+		groups, decodeErrors = c.extractRuleGroupsPerGroup(value)
+		for _, verr := range decodeErrors {
+			verr.Document = document
+			errorMsg := fmt.Sprintf("Group failed to decode: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, key, verr.Error())
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
+			errs = append(errs, verr)
+		}
+	}
+	if len(groups.Groups) > 0 || len(decodeErrors) > 0 {
+		return groups, errs, true
+	}
+
+	// every format failed, report why the one the value looks most like did
+	if parseErr == nil {
+		format := FormatYAML
+		if looksLikeJSON(value) {
+			format = FormatJSON
+		}
+		parseErr, _ = c.extractRuleGroupsAs(format, nameStub, groupKey, value)
+	}
+
+	if parseErr != nil {
+		for _, verr := range parseErrorList(parseErr) {
+			verr.Document = document
+			errorMsg := fmt.Sprintf("Configmap: %s key: %s could not be parsed, %s. Skipping.", nameStub, key, verr.Error())
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
+			errs = append(errs, verr)
+		}
+	} else {
+		where := key
+		if document > 0 {
+			where = fmt.Sprintf("%s document: %d", key, document)
+		}
+		verr := ValidationError{Document: document, Err: fmt.Errorf("does not conform to any of the legal formats (RuleGroups, RuleGroup or []Rules)")}
+		errorMsg := fmt.Sprintf("Configmap: %s key: %s does not conform to any of the legal formats (RuleGroups, RuleGroup or []Rules. Skipping.", nameStub, where)
+		c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidKey, errorMsg)
+		errs = append(errs, verr)
+	}
+	return groups, errs, false
+}
+
+// extractRuleGroupsAs parses value with the parser of format only and picks
+// the layout (RuleGroups, RuleGroup or []Rules) from what the document holds,
+// so the error returned is the actual reason the value can't be loaded. The
+// layouts are decoded strictly, a misspelled field is an error.
+func (c *Controller) extractRuleGroupsAs(format string, nameStub string, key string, value string) (error, RuleGroups) {
+	var root interface{}
+	switch format {
+	case FormatJSON:
+		if err := json.Unmarshal([]byte(value), &root); err != nil {
+			return syntaxError{parseErrors{jsonError(value, err)}}, RuleGroups{}
+		}
+		// the layouts are decoded by the YAML decoder, which reads almost
+		// any JSON as is and keeps the lines of the errors right
+		var ignored interface{}
+		if yaml.Unmarshal([]byte(value), &ignored) != nil {
+			normalized, err := yaml.Marshal(root)
+			if err != nil {
+				return parseErrors{{Err: fmt.Errorf("invalid JSON: %s", err)}}, RuleGroups{}
+			}
+			value = string(normalized)
+		}
+	default:
+		if err := yaml.Unmarshal([]byte(value), &root); err != nil {
+			verrs := yamlErrors(value, err)
+			for i := range verrs {
+				verrs[i].Field = ""
+				verrs[i].Column = 0
+				verrs[i].Err = fmt.Errorf("invalid YAML: %s", verrs[i].Err)
+			}
+			return syntaxError{parseErrors(verrs)}, RuleGroups{}
+		}
+	}
+	name := strings.ToUpper(format)
+
+	fields := make(map[string]struct{})
+	list := false
+	switch document := root.(type) {
+	case []interface{}:
+		list = true
+	case map[string]interface{}:
+		for field := range document {
+			fields[field] = struct{}{}
+		}
+	case map[interface{}]interface{}:
+		for field := range document {
+			fields[fmt.Sprint(field)] = struct{}{}
+		}
+	case nil:
+		return parseErrors{{Err: fmt.Errorf("empty %s document", name)}}, RuleGroups{}
+	default:
+		return parseErrors{{Err: fmt.Errorf("%s document is a %T, expected an object with groups or rules, or a list of rules", name, root)}}, RuleGroups{}
+	}
+
+	var err error
+	var groups RuleGroups
+	_, hasGroups := fields["groups"]
+	_, hasRules := fields["rules"]
+	switch {
+	case list:
+		err, groups = c.extractRulesAsRuleGroups(nameStub, key, value)
+	case hasGroups:
+		err, groups = c.extractRuleGroups(value)
+	case hasRules:
+		err, groups = c.extractRuleGroupAsRuleGroups(value)
+	default:
+		return parseErrors{{Err: fmt.Errorf("%s object has neither groups nor rules", name)}}, RuleGroups{}
+	}
+	if err != nil {
+		return parseErrors(yamlErrors(value, err)), groups
+	}
+	return nil, groups
+}
+
+// decodedGroup decodes a single group of a document. A group that fails to
+// decode keeps the error, with lines counted from the start of the document,
+// instead of failing the whole document.
+type decodedGroup struct {
+	group    RuleGroup
+	err      error
+	name     string
+	interval string
+}
+
+func (d *decodedGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if d.err = unmarshal(&d.group); d.err != nil {
+		// enough to tell which group it is
+		raw := make(map[string]interface{})
+		unmarshal(&raw)
+		if name, ok := raw["name"]; ok {
+			d.name = fmt.Sprint(name)
+		}
+		if interval, ok := raw["interval"]; ok {
+			d.interval = fmt.Sprint(interval)
+		}
+	}
+	return nil
+}
+
+var (
+	// yaml.v2 puts the line, but not the column, in front of its errors
+	yamlErrorLine    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlUnknownField = regexp.MustCompile(`^field (\S+) not found in type`)
+	yamlKey          = regexp.MustCompile(`^(\s*(?:-\s+)?"?)([A-Za-z0-9_]+)"?\s*:`)
+)
+
+// yamlErrors turns an error of the YAML decoder into one ValidationError per
+// problem, with the line it is on and, where the line tells, the field and
+// its column.
+func yamlErrors(value string, err error) []ValidationError {
+	problems := []string{err.Error()}
+	if terr, ok := err.(*yaml.TypeError); ok {
+		problems = terr.Errors
+	}
+
+	lines := strings.Split(value, "\n")
+	errs := make([]ValidationError, 0, len(problems))
+	for _, problem := range problems {
+		verr := ValidationError{Err: errors.New(problem)}
+		match := yamlErrorLine.FindStringSubmatch(problem)
+		if match == nil {
+			errs = append(errs, verr)
+			continue
+		}
+		verr.Line, _ = strconv.Atoi(match[1])
+		verr.Err = errors.New(match[2])
+		if verr.Line < 1 || verr.Line > len(lines) {
+			errs = append(errs, verr)
+			continue
+		}
+
+		line := lines[verr.Line-1]
+		if unknown := yamlUnknownField.FindStringSubmatch(match[2]); unknown != nil {
+			verr.Field = unknown[1]
+			verr.Column = strings.Index(line, unknown[1]) + 1
+		} else if key := yamlKey.FindStringSubmatch(line); key != nil {
+			verr.Field = key[2]
+			verr.Column = len(key[1]) + 1
+		}
+		errs = append(errs, verr)
+	}
+	return errs
+}
+
+// jsonError adds the line and column to the errors of the JSON decoder, which
+// only know the byte offset.
+func jsonError(value string, err error) ValidationError {
+	verr := ValidationError{Err: fmt.Errorf("invalid JSON: %s", err)}
+	syntaxErr, ok := err.(*json.SyntaxError)
+	if !ok || syntaxErr.Offset < 1 || syntaxErr.Offset > int64(len(value)) {
+		return verr
+	}
+
+	// the offending byte is the last one read
+	before := value[:syntaxErr.Offset-1]
+	verr.Line = strings.Count(before, "\n") + 1
+	verr.Column = len(before) - strings.LastIndex(before, "\n")
+	return verr
+}
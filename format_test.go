@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	jsonRuleGroups = `{
+	"groups": [{
+		"name": "json",
+		"interval": "1m",
+		"rules": [{"record": "job:up:sum", "expr": "sum by (job) (up)"}]
+	}]
+}`
+	jsonRules = `[{"alert": "Down", "expr": "up == 0", "for": "5m", "labels": {"severity": "page"}}]`
+	// the comma after the expression is the mistake
+	brokenJSON = `{
+  "name": "json",
+  "rules": [{"record": "a", "expr": "up",}]
+}`
+	// YAML takes the comma above, but not a bracket that doesn't match
+	mismatchedJSON = `{
+  "name": "json",
+  "rules": [{"record": "a", "expr": "up"}}
+}`
+)
+
+func formatConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "formats",
+			Namespace:   "team-a",
+			Annotations: map[string]string{myAnno: "true"},
+		},
+		Data: data,
+	}
+}
+
+func TestRuleFormat(t *testing.T) {
+	Convey("Key suffixes should pick the parser", t, func() {
+		So(ruleFormat("rules.json"), ShouldEqual, FormatJSON)
+		So(ruleFormat("rules.yaml"), ShouldEqual, FormatYAML)
+		So(ruleFormat("rules.yml"), ShouldEqual, FormatYAML)
+		So(ruleFormat("rules"), ShouldEqual, "")
+	})
+}
+
+func TestExtractRuleGroupsAs(t *testing.T) {
+	Convey("JSON values should be loaded in every layout", t, func() {
+		err, groups := c.extractRuleGroupsAs(FormatJSON, "team-a-formats", "groups.json", jsonRuleGroups)
+		So(err, ShouldBeNil)
+		So(groups.Groups[0].Name, ShouldEqual, "json")
+		So(groups.Groups[0].Interval.String(), ShouldEqual, "1m")
+
+		err, groups = c.extractRuleGroupsAs(FormatJSON, "team-a-formats", "rules.json", jsonRules)
+		So(err, ShouldBeNil)
+		So(groups.Groups[0].Name, ShouldEqual, "team-a-formats-rules.json")
+		So(groups.Groups[0].Rules[0].Labels["severity"], ShouldEqual, "page")
+	})
+
+	Convey("Parse errors should say what is wrong and where", t, func() {
+		err, _ := c.extractRuleGroupsAs(FormatJSON, "team-a-formats", "rules.json", brokenJSON)
+		So(err.Error(), ShouldStartWith, "Line: 3, Column: 42, Error: invalid JSON: invalid character '}'")
+
+		err, _ = c.extractRuleGroupsAs(FormatJSON, "team-a-formats", "rules.json", `{"name": "json"}`)
+		So(err.Error(), ShouldEqual, "Error: JSON object has neither groups nor rules")
+
+		err, _ = c.extractRuleGroupsAs(FormatJSON, "team-a-formats", "rules.json", `"rules"`)
+		So(err.Error(), ShouldContainSubstring, "expected an object with groups or rules, or a list of rules")
+
+		// JSON is YAML, but not the other way around
+		err, _ = c.extractRuleGroupsAs(FormatJSON, "team-a-formats", "rules.json", configmapDataBlockRules.Data["rules"])
+		So(err.Error(), ShouldStartWith, "Line: 1, Column: 2, Error: invalid JSON: invalid character ' ' in numeric literal")
+
+		err, _ = c.extractRuleGroupsAs(FormatYAML, "team-a-formats", "rules.yaml", "groups:\n- name: a\n\trules: []\n")
+		So(err.Error(), ShouldStartWith, "Line: 3, Error: invalid YAML: found a tab character that violates indentation")
+	})
+}
+
+func TestExtractValuesFormats(t *testing.T) {
+	Convey("JSON keys should be accepted next to YAML keys", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, formatConfigMap(map[string]string{
+			"groups.json": jsonRuleGroups,
+			"rules":       jsonRules,
+			"yaml.yaml":   configmapDataBlockRules.Data["rules"],
+		}))
+		So(len(mrg.Values), ShouldEqual, 3)
+		So(events.CountWarnings(), ShouldEqual, 0)
+	})
+
+	Convey("Keys that can't be parsed should report the parse error", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, formatConfigMap(map[string]string{
+			"hinted.json": brokenJSON,
+			"sniffed":     mismatchedJSON,
+		}))
+		So(mrg.Values, ShouldBeEmpty)
+		So(mrg.Reports[0].Errors[0].Line, ShouldEqual, 3)
+		So(mrg.Reports[0].Errors[0].Column, ShouldEqual, 42)
+		So(mrg.Reports[0].Errors[0].Err.Error(), ShouldStartWith, "invalid JSON: invalid character '}' looking for beginning")
+		So(mrg.Reports[1].Errors[0].Error(), ShouldEqual, "Line: 3, Column: 42, Error: invalid JSON: invalid character '}' after array element")
+		So(events.Events[0].Message, ShouldContainSubstring, "could not be parsed, Line: 3, Column: 42, Error: invalid JSON")
+	})
+}
+
+func TestParseErrorLines(t *testing.T) {
+	Convey("Misspelled fields should be reported with their line, column and group", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, formatConfigMap(map[string]string{
+			"groups": `groups:
+- name: good
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+- name: typo
+  rules:
+  - alert: Down
+    expr: up == 0
+    anotations:
+      summary: down`,
+			"rules": `- alert: Down
+  expr: up == 0
+  for: [5m]`,
+			"typo.json": `{"name": "json", "rules": [
+  {"alert": "Down", "expr": "up == 0", "lables": {}}
+]}`,
+		}))
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(mrg.Values[0].Groups[0].Name, ShouldEqual, "good")
+
+		verr := mrg.Reports[0].Errors[0]
+		So(mrg.Reports[0].Key, ShouldEqual, "groups")
+		So(verr.Group, ShouldEqual, "typo")
+		So(verr.Line, ShouldEqual, 10)
+		So(verr.Column, ShouldEqual, 5)
+		So(verr.Field, ShouldEqual, "anotations")
+		So(verr.Error(), ShouldEqual, "GroupName: typo, Line: 10, Column: 5, Field: anotations, Error: field anotations not found in type rulefmt.Rule")
+
+		verr = mrg.Reports[1].Errors[0]
+		So(mrg.Reports[1].Key, ShouldEqual, "rules")
+		So(verr.Line, ShouldEqual, 3)
+		So(verr.Field, ShouldEqual, "for")
+		So(verr.Err.Error(), ShouldContainSubstring, "cannot unmarshal !!seq into string")
+
+		verr = mrg.Reports[2].Errors[0]
+		So(verr.Line, ShouldEqual, 2)
+		So(verr.Column, ShouldEqual, 41)
+		So(verr.Field, ShouldEqual, "lables")
+
+		status, err := json.Marshal(mrg.Reports[0].Errors)
+		So(err, ShouldBeNil)
+		So(string(status), ShouldContainSubstring, `"field":"anotations","line":10,"column":5`)
+		messages := make([]string, 0)
+		for _, event := range events.Events {
+			messages = append(messages, event.Message)
+		}
+		So(strings.Join(messages, "\n"), ShouldContainSubstring, "Key:groups, GroupName: typo, Line: 10, Column: 5, Field: anotations")
+	})
+}
+
+const multiDocument = `# generated, do not edit
+---
+groups:
+- name: first
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+---
+name: second
+rules:
+- alert: Down
+  expr: up == 0
+...
+---
+- record: job:up:count
+  expr: count by (job) (up)
+--- # the last one is broken
+name: broken
+rules: [{record: a, expr: up}}
+`
+
+func TestSplitDocuments(t *testing.T) {
+	Convey("Values without markers should be a single document", t, func() {
+		So(splitDocuments(jsonRuleGroups), ShouldResemble, []string{jsonRuleGroups})
+		So(splitDocuments(""), ShouldResemble, []string{""})
+	})
+
+	Convey("Streams should be split at the markers, keeping their lines", t, func() {
+		documents := splitDocuments(multiDocument)
+		So(len(documents), ShouldEqual, 4)
+		So(strings.Split(documents[1], "\n")[8], ShouldEqual, "name: second")
+		So(strings.Split(documents[3], "\n")[17], ShouldEqual, "name: broken")
+	})
+
+	Convey("A single document behind a marker should still be read", t, func() {
+		documents := splitDocuments("---\n" + configmapDataBlockRules.Data["rules"])
+		So(len(documents), ShouldEqual, 1)
+		err, groups := c.extractRuleGroupsAs(FormatYAML, "team-a-formats", "rules", documents[0])
+		So(err, ShouldBeNil)
+		So(groups.Groups, ShouldNotBeEmpty)
+	})
+}
+
+func TestExtractValuesDocuments(t *testing.T) {
+	Convey("Every document of a key should be loaded, the broken one reported", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, formatConfigMap(map[string]string{
+			"generated": multiDocument,
+		}))
+		So(len(mrg.Values), ShouldEqual, 1)
+		names := make([]string, 0)
+		for _, group := range mrg.Values[0].Groups {
+			names = append(names, group.Name)
+		}
+		So(names, ShouldResemble, []string{"first", "second", "team-a-formats-generated-3"})
+
+		So(mrg.Reports[0].Accepted, ShouldBeTrue)
+		So(len(mrg.Reports[0].Errors), ShouldEqual, 1)
+		verr := mrg.Reports[0].Errors[0]
+		So(verr.Document, ShouldEqual, 4)
+		So(verr.Line, ShouldEqual, 18)
+		So(events.CountWarnings(), ShouldEqual, 1)
+		So(events.Events[0].Message, ShouldContainSubstring, "key: generated could not be parsed, Document: 4, Line: 18")
+
+		encoded, err := json.Marshal(verr)
+		So(err, ShouldBeNil)
+		So(string(encoded), ShouldContainSubstring, `"document":4,"line":18`)
+	})
+}
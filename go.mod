@@ -4,8 +4,11 @@ go 1.12
 
 require (
 	github.com/cheekybits/is v0.0.0-20150225183255-68e9c0620927 // indirect
+	github.com/go-kit/kit v0.9.0
 	github.com/imdario/mergo v0.3.8 // indirect
+	github.com/klauspost/compress v1.9.8
 	github.com/matryer/try v0.0.0-20161228173917-9ac251b645a2 // indirect
+	github.com/prometheus/client_golang v1.2.0
 	github.com/prometheus/common v0.7.0
 	github.com/prometheus/prometheus v0.0.0-20191017095924-6f92ce560538
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	LanguagePromQL = "promql"
+	LanguageLogQL  = "logql"
+
+	lokiRulerRulesPath = "/loki/api/v1/rules"
+
+	defaultLanguageAnnotation = "nordstrom.net/prometheus2AlertsLanguage"
+)
+
+// configMapLanguage returns the query language the rules of cm are written
+// in, configmaps that don't say are PromQL.
+func configMapLanguage(p *Pipeline, cm *corev1.ConfigMap) string {
+	annotation := p.languageAnnotation
+	if annotation == "" {
+		annotation = defaultLanguageAnnotation
+	}
+	value := strings.ToLower(strings.TrimSpace(cm.GetObjectMeta().GetAnnotations()[annotation]))
+	if value == "" {
+		return LanguagePromQL
+	}
+	return value
+}
+
+// logqlRangeFunctions turn a log query into a metric query, rules have to use
+// at least one of them.
+var logqlRangeFunctions = regexp.MustCompile(`\b(rate|count_over_time|bytes_rate|bytes_over_time|absent_over_time|sum_over_time|avg_over_time|max_over_time|min_over_time|stddev_over_time|stdvar_over_time|quantile_over_time|first_over_time|last_over_time|rate_counter)\s*\(`)
+
+// logqlMetricName matches a PromQL metric name right before a selector,
+// stream selectors stand on their own.
+var logqlMetricName = regexp.MustCompile(`[a-zA-Z_:][a-zA-Z0-9_:]*\s*$`)
+
+// validateLogQL is a light check of a LogQL metric query, the Loki parser
+// isn't available here. It checks that brackets and quotes are balanced,
+// that every stream selector parses, that range durations parse and that the query uses a
+// range aggregation, log queries on their own can't be evaluated by a ruler.
+// PromQL expressions fail it for lack of a stream selector.
+func validateLogQL(expr string) error {
+	selectors := make([]string, 0)
+	ranges := make([]string, 0)
+	stack := make([]byte, 0)
+	start := 0
+
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		switch ch {
+		case '"', '`':
+			end, err := skipLogQLString(expr, i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case '(', '[', '{':
+			if ch == '{' && len(stack) > 0 && stack[len(stack)-1] == '{' {
+				return fmt.Errorf("unexpected { inside of a stream selector at position %d", i)
+			}
+			if ch == '{' && logqlMetricName.MatchString(expr[:i]) {
+				return fmt.Errorf("metric name before the selector at position %d, is this a PromQL expression?", i)
+			}
+			if ch == '{' || ch == '[' {
+				start = i
+			}
+			stack = append(stack, ch)
+		case ')', ']', '}':
+			open := map[byte]byte{')': '(', ']': '[', '}': '{'}[ch]
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("unexpected %c at position %d", ch, i)
+			}
+			stack = stack[:len(stack)-1]
+			if ch == '}' {
+				selectors = append(selectors, expr[start:i+1])
+			}
+			if ch == ']' {
+				ranges = append(ranges, expr[start+1:i])
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed %c", stack[len(stack)-1])
+	}
+
+	if len(selectors) == 0 {
+		return fmt.Errorf("no stream selector, is this a PromQL expression?")
+	}
+	for _, selector := range selectors {
+		// the parser also insists on a matcher that doesn't match everything
+		if _, err := promql.ParseMetricSelector(selector); err != nil {
+			return fmt.Errorf("invalid stream selector %s: %s", selector, err)
+		}
+	}
+
+	for _, r := range ranges {
+		if _, err := model.ParseDuration(strings.TrimSpace(r)); err != nil {
+			return fmt.Errorf("invalid range [%s]: %s", r, err)
+		}
+	}
+
+	if !logqlRangeFunctions.MatchString(expr) {
+		return fmt.Errorf("log queries can't be used in rules, use a range aggregation such as rate() or count_over_time()")
+	}
+
+	return nil
+}
+
+// skipLogQLString returns the position of the quote closing the string
+// starting at expr[start]. Only double quoted strings have escapes.
+func skipLogQLString(expr string, start int) (int, error) {
+	quote := expr[start]
+	for i := start + 1; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && quote == '"':
+			i++
+		case expr[i] == quote:
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+// queryLanguage is the language of the rules p loads.
+func (p *Pipeline) queryLanguage() string {
+	if p.language == "" {
+		return LanguagePromQL
+	}
+	return p.language
+}
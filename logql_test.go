@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateLogQL(t *testing.T) {
+	Convey("LogQL metric queries should be accepted", t, func() {
+		for _, expr := range []string{
+			`rate({app="api"}[5m]) > 10`,
+			`sum by (level) (count_over_time({app="api", env=~"prod|staging"} |= "error" [1m]))`,
+			`sum(rate({app="api"} | json | status >= 500 | line_format "{{.msg}}" [5m])) / sum(rate({app="api"}[5m]))`,
+			"count_over_time({job=\"nginx\"} |~ `GET /(api|v1)/\\w+` [10m]) > 0",
+			`quantile_over_time(0.99, {app="api"} | logfmt | unwrap latency [5m]) by (route)`,
+		} {
+			So(validateLogQL(expr), ShouldBeNil)
+		}
+	})
+
+	Convey("Broken LogQL and PromQL should be rejected", t, func() {
+		cases := map[string]string{
+			`rate(http_requests_total[5m])`:             "no stream selector",
+			`{app="api"} |= "error"`:                    "range aggregation",
+			`rate({app="api"}[5m]`:                      "unclosed (",
+			`rate({app="api"}[5m]))`:                    "unexpected )",
+			`rate({app="api"} |= "error[5m])`:           "unterminated string",
+			`rate({app=~".*"}[5m])`:                     "at least one non-empty matcher",
+			`rate({app="api"}[5 minutes])`:              "invalid range",
+			`rate({app="api", {env="prod"}}[5m])`:       "inside of a stream selector",
+			`rate({app="api" env="prod"}[5m])`:          "invalid stream selector",
+			`rate(http_requests_total{code="500"}[5m])`: "is this a PromQL expression",
+		}
+		for expr, message := range cases {
+			err := validateLogQL(expr)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, message)
+		}
+	})
+}
+
+var configmapLogQLRules = corev1.ConfigMap{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "log-rules",
+		Namespace: "default",
+		Annotations: map[string]string{
+			myAnno:                    "true",
+			defaultLanguageAnnotation: "LogQL",
+		},
+	},
+	Data: map[string]string{
+		"rules": `groups:
+- name: logs
+  rules:
+  - alert: ApiErrors
+    expr: sum(rate({app="api"} |= "error" [5m])) > 1
+    for: 5m
+    labels:
+      severity: Page
+`,
+	},
+}
+
+func TestLogQLPipelines(t *testing.T) {
+	lp, err := NewPipeline(PipelineConfig{Name: "loki", Annotation: myAnno, Language: LanguageLogQL, RulesPath: "/loki/rules.yaml", ReloadEndpoints: []string{"http://loki/reload"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Configmaps should only be loaded by the pipeline of their language", t, func() {
+		So(c.isRuleConfigMap(lp, &configmapLogQLRules), ShouldBeTrue)
+		So(c.isRuleConfigMap(lp, &configmapDataBlockRules), ShouldBeFalse)
+		So(c.isRuleConfigMap(pipeline, &configmapLogQLRules), ShouldBeFalse)
+		So(c.isRuleConfigMap(pipeline, &configmapDataBlockRules), ShouldBeTrue)
+	})
+
+	Convey("LogQL rules should be validated as LogQL", t, func() {
+		events.Clear()
+		mrg := c.extractValues(lp, &configmapLogQLRules)
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(mrg.Values[0].Groups[0].Rules[0].Alert, ShouldEqual, "ApiErrors")
+		So(events.CountWarnings(), ShouldEqual, 0)
+
+		promql := configmapLogQLRules.DeepCopy()
+		promql.Data["rules"] = strings.Replace(promql.Data["rules"], `sum(rate({app="api"} |= "error" [5m])) > 1`, `sum(rate(http_requests_total{code="500"}[5m])) > 1`, 1)
+		events.Clear()
+		mrg = c.extractValues(lp, promql)
+		So(len(mrg.Values), ShouldEqual, 0)
+		So(events.CountWarnings(), ShouldBeGreaterThan, 0)
+		So(events.Events[0].Message, ShouldContainSubstring, "is this a PromQL expression")
+	})
+
+	Convey("LogQL pipelines should refuse expression cost policies", t, func() {
+		dir, err := ioutil.TempDir("", "logql")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "policies.yaml")
+		So(ioutil.WriteFile(path, []byte("policies:\n- id: cost\n  type: expressionCost\n  maxRange: 1h\n"), 0644), ShouldBeNil)
+		_, err = NewPipeline(PipelineConfig{Name: "loki", Annotation: myAnno, Language: LanguageLogQL, PolicyFile: path})
+		So(err, ShouldNotBeNil)
+		_, err = NewPipeline(PipelineConfig{Name: "prometheus", Annotation: myAnno, PolicyFile: path})
+		So(err, ShouldBeNil)
+	})
+
+	Convey("The ruler output of a LogQL pipeline should push to the Loki rules API", t, func() {
+		var lock sync.Mutex
+		paths := make([]string, 0)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			paths = append(paths, r.Method+" "+r.URL.Path)
+			if r.Method == "GET" {
+				http.Error(w, "no rule groups found", http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		rp, err := NewPipeline(PipelineConfig{Name: "loki", Annotation: myAnno, Language: LanguageLogQL, Output: OutputRuler, RulerURL: server.URL})
+		So(err, ShouldBeNil)
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{configmapLogQLRules, configmapDataBlockRules}}
+		So(c.syncRuler(rp, c.collectRuleGroups(rp, list)), ShouldBeNil)
+		So(paths, ShouldResemble, []string{"GET " + lokiRulerRulesPath, "POST " + lokiRulerRulesPath + "/default"})
+	})
+}
@@ -9,9 +9,11 @@ import (
 	"os"
 	"time"
 
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 
 	kubeinformers "k8s.io/client-go/informers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 )
 
@@ -20,9 +22,48 @@ var (
 	// flags general
 	helpFlag            = flag.Bool("help", false, "")
 	configmapAnnotation = flag.String("annotation", "nordstrom.net/prometheus2Alerts", "Annotation that states that this configmap contains prometheus rules.")
+	target              = flag.String("target", "", "Name of the Prometheus instance this loader feeds, configmaps whose annotation value lists this name are loaded as well as the ones set to \"true\".")
+	labelSelector       = flag.String("labelselector", "", "Label selector rule configmaps have to match, applied to the configmap watch on the api server.")
 	rulesPath           = flag.String("rulespath", "/rules", "Filepath where the rules from the configmap file should be written, this should correspond to a rule_files: location in your prometheus config.")
-	reloadEndpoint      = flag.String("endpoint", "http://localhost:9090/-/reload/", "Endpoint of the Prometheus reset endpoint (eg: http://prometheus:9090/-/reload).")
+	reloadEndpoint      = flag.String("endpoint", "http://localhost:9090/-/reload/", "Endpoint of the Prometheus reset endpoint (eg: http://prometheus:9090/-/reload), comma separated when sharding, one per shard.")
+	output              = flag.String("output", OutputFile, "Where the rules are written to: \"file\" writes -rulespath, \"configmap\" writes the configmap given by -outputconfigmap, \"ruler\" pushes them to -rulerurl.")
+	outputConfigMap     = flag.String("outputconfigmap", "", "Namespace/name of the configmap the rules are written to with -output configmap, split into name-1, name-2, ... when they exceed the configmap size limit.")
+	rulerURL            = flag.String("rulerurl", "", "Address of the Cortex or Mimir ruler the rules are pushed to with -output ruler.")
+	rulerTenant         = flag.String("rulertenant", "", "Tenant sent in the X-Scope-OrgID header to the ruler, empty sends none.")
+	rulerNSPrefix       = flag.String("rulernamespaceprefix", "", "Prefix added to a kubernetes namespace to get its ruler namespace, required with -output ruler. The loader deletes groups from every ruler namespace with this prefix it has no rules for.")
+	shards              = flag.Int("shards", 0, "Number of shards to spread the rule groups over, each written to its own rules file and reloaded through its own endpoint. 0 disables sharding.")
+	shardAnnotation     = flag.String("shardannotation", "nordstrom.net/prometheus2AlertsShard", "Annotation that pins the rule groups of a configmap to a shard (0 to shards-1).")
+	language            = flag.String("language", LanguagePromQL, "Query language of the rules this loader handles, \"promql\" or \"logql\" for the Loki ruler. Configmaps of the other language are ignored.")
+	languageAnnotation  = flag.String("languageannotation", defaultLanguageAnnotation, "Annotation that marks a rule configmap as \"logql\", configmaps without it are \"promql\".")
+	backend             = flag.String("backend", BackendPrometheus, "What evaluates the rules, \"prometheus\" or \"thanos\". Decides which group fields beyond name, interval and rules are kept, eg: partial_response_strategy with thanos.")
+	strictGroupFields   = flag.Bool("strictgroupfields", false, "Reject rule groups with fields the backend doesn't support instead of dropping the fields with a warning.")
+	prometheusVersion   = flag.String("prometheusversion", "", "Version of the Prometheus the rules are written for (eg: 2.31). Groups using fields that version doesn't support, such as limit, query_offset or labels, are rejected. Empty allows every field.")
+	rejectConflicts     = flag.Bool("rejectconflicts", false, "Drop the newer of two conflicting rules from different configmaps (recording rules of the same name that differ, alerts of the same name with overlapping labels) instead of only reporting the conflict.")
+	reorderRules        = flag.Bool("reorderrules", false, "Reorder the rules of every group so recording rules come before the rules using them.")
+	seriesCheckURL      = flag.String("seriescheckurl", "", "Address of a Prometheus (eg: http://prometheus:9090) asked whether the selectors of the rules match any series, a warning event is recorded for those that don't. Empty disables the check.")
+	seriesCheckTTL      = flag.Duration("seriescheckttl", defaultSeriesCheckTTL, "How long the answers of -seriescheckurl are cached.")
+	maxDecompressed     = flag.Int("maxdecompressedbytes", defaultMaxDecompressedBytes, "Maximum size in bytes a gzip or zstd compressed rule value may decompress to.")
+	maxRatio            = flag.Int("maxcompressionratio", defaultMaxCompressionRatio, "Maximum ratio of decompressed to compressed size of a gzip or zstd compressed rule value.")
+	templateAnnotation  = flag.String("templateannotation", defaultTemplateAnnotation, "Annotation that makes a configmap a rule template, its value is the name *.template.yaml keys refer to the template by.")
+	templateNamespaces  = flag.String("templatenamespaces", "", "Comma separated list of namespace name patterns rule templates are read from, required to use templates. Only list namespaces whose configmaps every team may rely on.")
 	batchTime           = flag.Int("batchtime", 5, "Time window to batch updates (in seconds, default: 5)")
+	statusAnnotation    = flag.String("statusannotation", "nordstrom.net/prometheus2AlertsStatus", "Annotation the validation status of each rule configmap is written to, empty disables status updates.")
+	policyFile          = flag.String("policyfile", "", "Path to a YAML file with the policies every rule has to comply with.")
+	maxGroups           = flag.Int("maxgroups", 0, "Maximum number of rule groups a single namespace may contribute, 0 is unlimited.")
+	maxRules            = flag.Int("maxrules", 0, "Maximum number of rules a single namespace may contribute, 0 is unlimited.")
+	maxExprBytes        = flag.Int("maxexprbytes", 0, "Maximum total size in bytes of the rule expressions a single namespace may contribute, 0 is unlimited.")
+	quotaAnnotation     = flag.String("quotaannotation", "nordstrom.net/prometheus2AlertsQuota", "Namespace annotation that overrides the quota of that namespace, eg: groups=10,rules=200,exprbytes=65536.")
+	allowNamespaces     = flag.String("namespaces", "", "Comma separated list of namespace name patterns (eg: team-*) rules are loaded from, empty allows all namespaces.")
+	denyNamespaces      = flag.String("excludenamespaces", "", "Comma separated list of namespace name patterns rules are never loaded from.")
+	namespaceSelector   = flag.String("namespaceselector", "", "Label selector namespaces have to match for their rules to be loaded (eg: prometheus-rules=enabled).")
+	listenAddress       = flag.String("listen", ":9098", "Address to serve the /metrics and /debug/dependencies endpoints on, empty disables it.")
+	webhookAddress      = flag.String("webhooklisten", "", "Address to serve the validating admission webhook for rule configmaps on (path /validate), empty disables it.")
+	webhookCert         = flag.String("webhookcert", "", "TLS certificate the admission webhook is served with.")
+	webhookKey          = flag.String("webhookkey", "", "TLS key the admission webhook is served with.")
+	webhookMode         = flag.String("webhookmode", WebhookModeDeny, "What the admission webhook does with configmaps whose rules fail validation: \"deny\" them or \"warn\" and let them through.")
+	configFile          = flag.String("config", "", "Path to a YAML config file, watched for changes. Flags given on the commandline override its settings.")
+	configInterval      = flag.Int("configinterval", 10, "Time between checks of the config file for changes (in seconds, default: 10)")
+	validateFlag        = flag.Bool("validate", false, "Validate the configmap manifests or rule files given as arguments and exit, no cluster access needed.")
 	// flags - kubeclient
 	kubeconfigPath = flag.String("kubeconfig", "", "Path to kubeconfig. Required for out of cluster operation.")
 	masterURL      = flag.String("master", "", "The address of the kube api server. Overrides the kubeconfig value, only require for off cluster operation.")
@@ -44,16 +85,58 @@ func main() {
 	flag.Parse()
 
 	if *helpFlag ||
-		*configmapAnnotation == "" ||
-		*rulesPath == "" ||
-		*reloadEndpoint == "" {
+		(!*validateFlag && *configFile == "" && (*configmapAnnotation == "" ||
+		(*output == OutputFile && (*rulesPath == "" || *reloadEndpoint == "")))) {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	if *webhookAddress != "" {
+		if *webhookCert == "" || *webhookKey == "" {
+			log.Fatalf("The admission webhook needs -webhookcert and -webhookkey\n")
+		}
+		if *webhookMode != WebhookModeDeny && *webhookMode != WebhookModeWarn {
+			log.Fatalf("-webhookmode must be %q or %q, got %q\n", WebhookModeDeny, WebhookModeWarn, *webhookMode)
+		}
+	}
+
+	config := configFromFlags()
+	watcher := &configWatcher{path: *configFile, parse: parseConfigWithFlags}
+	if *configFile != "" {
+		var err error
+		config, watcher.digest, err = watcher.read()
+		if err != nil {
+			log.Fatalf("Error loading config: %s\n", err)
+		}
+	} else if !*validateFlag {
+		// the flags are checked like a config file would be, -validate
+		// only needs what checks the rules
+		if err := config.validate(); err != nil {
+			log.Fatalf("Error in flags: %s\n", err)
+		}
+		if err := config.validateLabelSelectors(*labelSelector); err != nil {
+			log.Fatalf("Error in flags: %s\n", err)
+		}
+	}
+
+	pipelines := make([]*Pipeline, 0)
+	for _, pipelineConfig := range config.Pipelines {
+		pipeline, err := NewPipeline(pipelineConfig)
+		if err != nil {
+			log.Fatalf("Error building pipeline: %s\n", err)
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+
+	if *validateFlag {
+		os.Exit(runOfflineValidation(flag.Args(), pipelines[0], os.Stdout))
+	}
+
 	log.Printf("Rule Updater starting.\n")
-	log.Printf("ConfigMap annotation: %s\n", *configmapAnnotation)
-	log.Printf("Rules location: %s\n", *rulesPath)
+	for _, pipeline := range pipelines {
+		log.Printf("Pipeline %s ConfigMap annotation: %s\n", pipeline.Name, pipeline.interestingAnnotation)
+		log.Printf("Pipeline %s Rules location: %s\n", pipeline.Name, pipeline.outputTarget())
+	}
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
@@ -69,14 +152,182 @@ func main() {
 	}
 
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
+	// the label selector only applies to configmaps, so they get a factory of their own
+	configmapInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = *labelSelector
+		}))
+
+	namespaceFilter, err := config.namespaceFilter()
+	if err != nil {
+		log.Fatalf("Error building namespace filter: %s\n", err)
+	}
+
+	controller := NewController(kubeClient, configmapInformerFactory.Core().V1().ConfigMaps(), kubeInformerFactory.Core().V1().Namespaces(), pipelines, &config.Quota, &config.QuotaAnnotation, namespaceFilter)
+
+	if *configFile != "" {
+		watcher.apply = controller.applyConfig
+		go func() {
+			// a config applied before the caches are synced would rebuild
+			// the changed pipelines from an empty cache
+			if cache.WaitForCacheSync(stopCh, controller.configmapsSynced, controller.namespacesSynced) {
+				watcher.run(time.Duration(*configInterval)*time.Second, stopCh)
+			}
+		}()
+	}
 
-	controller := NewController(kubeClient, kubeInformerFactory.Core().V1().ConfigMaps(), configmapAnnotation, reloadEndpoint, rulesPath)
+	if *listenAddress != "" {
+		go serveHTTP(*listenAddress, controller)
+	}
+
+	if *webhookAddress != "" {
+		go serveWebhook(*webhookAddress, *webhookCert, *webhookKey, &admissionWebhook{controller: controller, mode: *webhookMode})
+	}
 
 	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 	kubeInformerFactory.Start(stopCh)
+	configmapInformerFactory.Start(stopCh)
 
 	if err = controller.Run(2, stopCh); err != nil {
 		klog.Fatalf("Error running controller: %s", err.Error())
 	}
 }
+
+// configFromFlags describes a single pipeline and the namespace settings the
+// way the flags always did, the config file is read on top of it.
+func configFromFlags() *Config {
+	return &Config{
+		Namespaces:        *allowNamespaces,
+		ExcludeNamespaces: *denyNamespaces,
+		NamespaceSelector: *namespaceSelector,
+		Quota:             NamespaceQuota{Groups: *maxGroups, Rules: *maxRules, ExprBytes: *maxExprBytes},
+		QuotaAnnotation:   *quotaAnnotation,
+		Pipelines: []PipelineConfig{{
+			Name:                 "default",
+			Annotation:           *configmapAnnotation,
+			Target:               *target,
+			LabelSelector:        *labelSelector,
+			RulesPath:            *rulesPath,
+			Output:               *output,
+			OutputConfigMap:      *outputConfigMap,
+			RulerURL:             *rulerURL,
+			RulerTenant:          *rulerTenant,
+			RulerNamespacePrefix: *rulerNSPrefix,
+			ReloadEndpoints:      splitList(*reloadEndpoint),
+			StatusAnnotation:     *statusAnnotation,
+			PolicyFile:           *policyFile,
+			Shards:               *shards,
+			ShardAnnotation:      *shardAnnotation,
+			Language:             *language,
+			LanguageAnnotation:   *languageAnnotation,
+			Backend:              *backend,
+			StrictGroupFields:    *strictGroupFields,
+			PrometheusVersion:    *prometheusVersion,
+			RejectConflicts:      *rejectConflicts,
+			ReorderRules:         *reorderRules,
+			SeriesCheckURL:       *seriesCheckURL,
+			SeriesCheckTTL:       *seriesCheckTTL,
+			MaxDecompressedBytes: *maxDecompressed,
+			MaxCompressionRatio:  *maxRatio,
+			TemplateAnnotation:   *templateAnnotation,
+			TemplateNamespaces:   *templateNamespaces,
+		}},
+	}
+}
+
+// parseConfigWithFlags reads the config file and applies the flags that were
+// set on the commandline over it, pipeline flags apply to every pipeline.
+func parseConfigWithFlags(content []byte) (*Config, error) {
+	config, err := parseConfig(content, *configFromFlags())
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "namespaces":
+			config.Namespaces = *allowNamespaces
+		case "excludenamespaces":
+			config.ExcludeNamespaces = *denyNamespaces
+		case "namespaceselector":
+			config.NamespaceSelector = *namespaceSelector
+		case "maxgroups":
+			config.Quota.Groups = *maxGroups
+		case "maxrules":
+			config.Quota.Rules = *maxRules
+		case "maxexprbytes":
+			config.Quota.ExprBytes = *maxExprBytes
+		case "quotaannotation":
+			config.QuotaAnnotation = *quotaAnnotation
+		}
+
+		for i := range config.Pipelines {
+			pipeline := &config.Pipelines[i]
+			switch f.Name {
+			case "annotation":
+				pipeline.Annotation = *configmapAnnotation
+			case "target":
+				pipeline.Target = *target
+			case "rulespath":
+				pipeline.RulesPath = *rulesPath
+			case "output":
+				pipeline.Output = *output
+			case "outputconfigmap":
+				pipeline.OutputConfigMap = *outputConfigMap
+			case "rulerurl":
+				pipeline.RulerURL = *rulerURL
+			case "rulertenant":
+				pipeline.RulerTenant = *rulerTenant
+			case "rulernamespaceprefix":
+				pipeline.RulerNamespacePrefix = *rulerNSPrefix
+			case "endpoint":
+				pipeline.ReloadEndpoints = splitList(*reloadEndpoint)
+			case "statusannotation":
+				pipeline.StatusAnnotation = *statusAnnotation
+			case "policyfile":
+				pipeline.PolicyFile = *policyFile
+			case "shards":
+				pipeline.Shards = *shards
+			case "shardannotation":
+				pipeline.ShardAnnotation = *shardAnnotation
+			case "language":
+				pipeline.Language = *language
+			case "languageannotation":
+				pipeline.LanguageAnnotation = *languageAnnotation
+			case "backend":
+				pipeline.Backend = *backend
+			case "strictgroupfields":
+				pipeline.StrictGroupFields = *strictGroupFields
+			case "prometheusversion":
+				pipeline.PrometheusVersion = *prometheusVersion
+			case "rejectconflicts":
+				pipeline.RejectConflicts = *rejectConflicts
+			case "reorderrules":
+				pipeline.ReorderRules = *reorderRules
+			case "seriescheckurl":
+				pipeline.SeriesCheckURL = *seriesCheckURL
+			case "seriescheckttl":
+				pipeline.SeriesCheckTTL = *seriesCheckTTL
+			case "maxdecompressedbytes":
+				pipeline.MaxDecompressedBytes = *maxDecompressed
+			case "maxcompressionratio":
+				pipeline.MaxCompressionRatio = *maxRatio
+			case "templateannotation":
+				pipeline.TemplateAnnotation = *templateAnnotation
+			case "templatenamespaces":
+				pipeline.TemplateNamespaces = *templateNamespaces
+			}
+		}
+	})
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	// the watch only ever gets -labelselector, a pipeline can narrow it
+	// down but not widen it
+	if err := config.validateLabelSelectors(*labelSelector); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+const metricsNamespace = "prometheus_rule_loader"
+
+var (
+	configmapsOverQuota = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "configmaps_over_quota",
+		Help:      "Number of rule configmaps rejected in the last rebuild of a pipeline because their namespace exceeded its quota.",
+	}, []string{"pipeline", "namespace"})
+
+	shardRuleGroups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shard_rule_groups",
+		Help:      "Number of rule groups written to each shard of a sharded pipeline.",
+	}, []string{"pipeline", "shard"})
+
+	ruleConflicts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_conflicts",
+		Help:      "Number of conflicting recording rules and duplicate alerts between configmaps found in the last rebuild of a pipeline.",
+	}, []string{"pipeline"})
+
+	seriesQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "series_queries_total",
+		Help:      "Number of selectors looked up in Prometheus by the series check, by result (found, missing or error). Cached answers are not counted.",
+	}, []string{"result"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of attempts to apply a changed config file, by result.",
+	}, []string{"result"})
+
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last attempt to apply a changed config file succeeded.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configmapsOverQuota)
+	prometheus.MustRegister(shardRuleGroups)
+	prometheus.MustRegister(ruleConflicts)
+	prometheus.MustRegister(seriesQueries)
+	prometheus.MustRegister(configReloads)
+	prometheus.MustRegister(configLastReloadSuccessful)
+}
+
+// serveHTTP exposes the metrics and the debug endpoints of c, it blocks so run
+// it in a go routine.
+func serveHTTP(address string, c *Controller) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc(dependencyPath, c.serveDependencies)
+
+	klog.Infof("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Fatalf("Error serving metrics: %s", err.Error())
+	}
+}
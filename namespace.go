@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ErrNamespaceNotAllowed = "NamespaceNotAllowed"
+)
+
+// NamespaceFilter restricts the namespaces rule configmaps are loaded from.
+// A namespace has to match one of Allow (if any are given), none of Deny and
+// the Selector (if given) on its labels.
+type NamespaceFilter struct {
+	Allow    []string
+	Deny     []string
+	Selector labels.Selector
+}
+
+// NewNamespaceFilter builds a filter from the comma separated name patterns
+// and the label selector given on the commandline.
+func NewNamespaceFilter(allow, deny, selector string) (*NamespaceFilter, error) {
+	filter := &NamespaceFilter{
+		Allow: splitList(allow),
+		Deny:  splitList(deny),
+	}
+
+	for _, pattern := range append(filter.Allow, filter.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %q: %s", pattern, err)
+		}
+	}
+
+	if selector != "" {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace selector %q: %s", selector, err)
+		}
+		filter.Selector = s
+	}
+
+	return filter, nil
+}
+
+func splitList(value string) []string {
+	patterns := make([]string, 0)
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// allows returns whether rules may be loaded from namespace and if not, why.
+// ns is only needed when the filter has a label selector.
+func (f *NamespaceFilter) allows(namespace string, ns *corev1.Namespace) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+
+	for _, pattern := range f.Deny {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return false, fmt.Sprintf("namespace matches excluded pattern %q", pattern)
+		}
+	}
+
+	if len(f.Allow) > 0 {
+		allowed := false
+		for _, pattern := range f.Allow {
+			if ok, _ := path.Match(pattern, namespace); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, fmt.Sprintf("namespace matches none of the allowed patterns %q", strings.Join(f.Allow, ","))
+		}
+	}
+
+	if f.Selector != nil && !f.Selector.Empty() {
+		if ns == nil {
+			return false, "namespace could not be looked up to match its labels"
+		}
+		if !f.Selector.Matches(labels.Set(ns.Labels)) {
+			return false, fmt.Sprintf("namespace labels do not match selector %q", f.Selector.String())
+		}
+	}
+
+	return true, ""
+}
+
+// isNamespaceAllowed checks the namespace filter for the namespace of cm.
+func (c *Controller) isNamespaceAllowed(cm *corev1.ConfigMap) (bool, string) {
+	if c.namespaceFilter == nil {
+		return true, ""
+	}
+
+	var ns *corev1.Namespace
+	if c.namespaceFilter.Selector != nil && c.getNamespace != nil {
+		ns, _ = c.getNamespace(cm.Namespace)
+	}
+
+	return c.namespaceFilter.allows(cm.Namespace, ns)
+}
+
+// handleNamespaceUpdate triggers a rebuild when a change to a namespace can
+// change which of its configmaps are loaded or what quota applies to them.
+func (c *Controller) handleNamespaceUpdate(old, new interface{}) {
+	oldNS := old.(*corev1.Namespace)
+	newNS := new.(*corev1.Namespace)
+
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+
+	labelsChanged := !reflect.DeepEqual(oldNS.Labels, newNS.Labels)
+	quotaChanged := c.quotaAnnotation != nil && *c.quotaAnnotation != "" &&
+		oldNS.Annotations[*c.quotaAnnotation] != newNS.Annotations[*c.quotaAnnotation]
+	if !labelsChanged && !quotaChanged {
+		return
+	}
+
+	configmaps, err := c.configmapsLister.ConfigMaps(newNS.Name).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Unable to list configmaps in namespace %s: %s", newNS.Name, err))
+		return
+	}
+
+	for _, p := range c.pipelines {
+		for _, cm := range configmaps {
+			if !c.isRuleConfigMap(p, cm) {
+				continue
+			}
+			key, err := cache.MetaNamespaceKeyFunc(cm)
+			if err != nil {
+				utilruntime.HandleError(err)
+				continue
+			}
+			// the configmap itself didn't change, forget it so the next sync rebuilds
+			c.forgetConfigMap(p, cm)
+			p.workqueue.Add(key)
+		}
+	}
+}
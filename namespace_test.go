@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	Convey("Namespaces should be filtered by name patterns and labels", t, func() {
+		filter, err := NewNamespaceFilter("team-*, monitoring", "team-sandbox-*", "rules=enabled")
+		So(err, ShouldBeNil)
+
+		enabled := &corev1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Labels: map[string]string{"rules": "enabled"}}}
+		disabled := &corev1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Labels: map[string]string{"rules": "disabled"}}}
+
+		ok, _ := filter.allows("team-a", enabled)
+		So(ok, ShouldBeTrue)
+		ok, _ = filter.allows("monitoring", enabled)
+		So(ok, ShouldBeTrue)
+
+		ok, reason := filter.allows("team-a", disabled)
+		So(ok, ShouldBeFalse)
+		So(reason, ShouldContainSubstring, "selector")
+
+		ok, reason = filter.allows("team-sandbox-1", enabled)
+		So(ok, ShouldBeFalse)
+		So(reason, ShouldContainSubstring, "excluded")
+
+		ok, reason = filter.allows("default", enabled)
+		So(ok, ShouldBeFalse)
+		So(reason, ShouldContainSubstring, "none of the allowed")
+
+		ok, _ = filter.allows("team-a", nil)
+		So(ok, ShouldBeFalse)
+
+		var none *NamespaceFilter
+		ok, _ = none.allows("anything", nil)
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Broken patterns and selectors should be refused", t, func() {
+		_, err := NewNamespaceFilter("team-[", "", "")
+		So(err, ShouldNotBeNil)
+		_, err = NewNamespaceFilter("", "", "rules in (")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestBuildFinalConfigNamespaceFilter(t *testing.T) {
+	Convey("Configmaps in disallowed namespaces should be ignored with a warning", t, func() {
+		events.Clear()
+		oldFilter := c.namespaceFilter
+		defer func() { c.namespaceFilter = oldFilter }()
+
+		filter, err := NewNamespaceFilter("", "sandbox-*", "")
+		So(err, ShouldBeNil)
+		c.namespaceFilter = filter
+
+		sandboxed := configmapDataBlockRules.DeepCopy()
+		sandboxed.Namespace = "sandbox-1"
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{configmapDataBlockRules, *sandboxed}}
+
+		rgs := c.buildFinalConfig(pipeline, list)
+		So(countRuleGroupsRules(*rgs), ShouldEqual, 2)
+
+		ignored := 0
+		for _, e := range events.Events {
+			if e.Reason == ErrNamespaceNotAllowed {
+				So(e.CMNamespace, ShouldEqual, "sandbox-1")
+				ignored++
+			}
+		}
+		So(ignored, ShouldEqual, 1)
+	})
+
+	Convey("An ignored configmap should only be told again when the reason changes", t, func() {
+		events.Clear()
+		oldFilter := c.namespaceFilter
+		defer func() { c.namespaceFilter = oldFilter }()
+
+		sandboxed := configmapDataBlockRules.DeepCopy()
+		sandboxed.Namespace = "sandbox-1"
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{*sandboxed}}
+		ip := &Pipeline{Name: "ignored", interestingAnnotation: myAnno}
+
+		c.namespaceFilter = &NamespaceFilter{Deny: []string{"sandbox-*"}}
+		c.buildFinalConfig(ip, list)
+		c.buildFinalConfig(ip, list)
+		So(events.CountWarnings(), ShouldEqual, 1)
+
+		c.namespaceFilter = &NamespaceFilter{Allow: []string{"team-*"}}
+		c.buildFinalConfig(ip, list)
+		So(events.CountWarnings(), ShouldEqual, 2)
+		So(events.Events[1].Message, ShouldContainSubstring, "none of the allowed patterns")
+	})
+}
+
+func TestHandleNamespaceUpdate(t *testing.T) {
+	Convey("A label change on a namespace should requeue its rule configmaps", t, func() {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		rules := configmapDataBlockRules.DeepCopy()
+		rules.ResourceVersion = "1"
+		other := configmapNoAnnotation.DeepCopy()
+		other.Name = "not-rules"
+		So(indexer.Add(rules), ShouldBeNil)
+		So(indexer.Add(other), ShouldBeNil)
+
+		np, err := NewPipeline(PipelineConfig{Name: "rules", Annotation: myAnno})
+		So(err, ShouldBeNil)
+		op, err := NewPipeline(PipelineConfig{Name: "other", Annotation: "other-annotation"})
+		So(err, ShouldBeNil)
+		defer np.workqueue.ShutDown()
+		defer op.workqueue.ShutDown()
+
+		nc := &Controller{
+			configmapsLister: corev1listers.NewConfigMapLister(indexer),
+			pipelines:        []*Pipeline{np, op},
+		}
+
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{*rules}}
+		So(nc.haveConfigMapsChanged(np, list), ShouldBeTrue)
+		So(nc.haveConfigMapsChanged(np, list), ShouldBeFalse)
+
+		oldNS := &corev1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "default", Labels: map[string]string{"rules": "enabled"}}}
+		newNS := oldNS.DeepCopy()
+
+		// nothing relevant changed
+		nc.handleNamespaceUpdate(oldNS, newNS)
+		So(np.workqueue.Len(), ShouldEqual, 0)
+
+		newNS.Labels["rules"] = "disabled"
+		nc.handleNamespaceUpdate(oldNS, newNS)
+		So(np.workqueue.Len(), ShouldEqual, 1)
+		So(op.workqueue.Len(), ShouldEqual, 0)
+		key, _ := np.workqueue.Get()
+		So(key, ShouldEqual, "default/rules")
+		So(nc.haveConfigMapsChanged(np, list), ShouldBeTrue)
+	})
+}
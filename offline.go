@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// runOfflineValidation loads every file given on the commandline the same way
+// the controller loads configmaps and prints the validation reports. Files
+// that hold ConfigMap manifests are validated key by key, anything else is
+// treated as the value of a single key named after the file.
+//
+// The policies of pipeline p are applied as well. Returns the exit code, 1 if
+// anything failed validation.
+func runOfflineValidation(paths []string, p *Pipeline, out io.Writer) int {
+	c := &Controller{
+		configmapEventRecorderFunc: func(cm *corev1.ConfigMap, eventtype, reason, msg string) {},
+	}
+
+	if len(paths) == 0 {
+		fmt.Fprintln(out, "No files to validate.")
+		return 1
+	}
+
+	exitCode := 0
+	// templates are looked up in every file given, not only the one
+	// referring to them
+	files := make(map[string][]corev1.ConfigMap, len(paths))
+	all := make([]*corev1.ConfigMap, 0)
+	for _, path := range paths {
+		configmaps, err := readConfigMapsFromFile(path)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %s\n", path, err)
+			exitCode = 1
+			continue
+		}
+		files[path] = configmaps
+		for i := range configmaps {
+			all = append(all, &configmaps[i])
+		}
+	}
+	c.listConfigMaps = func() ([]*corev1.ConfigMap, error) { return all, nil }
+
+	for _, path := range paths {
+		configmaps, ok := files[path]
+		if !ok {
+			continue
+		}
+
+		for i := range configmaps {
+			// templates are only validated through the keys using them
+			if _, ok := p.templateName(&configmaps[i]); ok {
+				continue
+			}
+			mrg := c.extractValues(p, &configmaps[i])
+			for _, report := range mrg.Reports {
+				if !printValidationReport(out, path, report) {
+					exitCode = 1
+				}
+			}
+		}
+	}
+
+	return exitCode
+}
+
+// printValidationReport prints a single report and returns true if it was clean.
+func printValidationReport(out io.Writer, path string, report ValidationReport) bool {
+	if report.Accepted {
+		fmt.Fprintf(out, "%s: %s key: %s Accepted with %d rulegroups and %d total rules.\n", path, report.ConfigMap, report.Key, report.Groups, report.Rules)
+	} else {
+		fmt.Fprintf(out, "%s: %s key: %s Rejected.\n", path, report.ConfigMap, report.Key)
+	}
+	for _, verr := range report.Errors {
+		fmt.Fprintf(out, "  %s\n", verr.Error())
+	}
+	for _, verr := range report.Warnings {
+		fmt.Fprintf(out, "  Warning: %s\n", verr.Error())
+	}
+
+	return report.Accepted && len(report.Errors) == 0
+}
+
+func readConfigMapsFromFile(path string) ([]corev1.ConfigMap, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	configmaps := make([]corev1.ConfigMap, 0)
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(content), 4096)
+	for {
+		cm := corev1.ConfigMap{}
+		if err := decoder.Decode(&cm); err != nil {
+			if err == io.EOF {
+				break
+			}
+			// not a manifest, fall through to treating it as a plain rules file
+			configmaps = configmaps[:0]
+			break
+		}
+		if cm.Kind != "ConfigMap" {
+			configmaps = configmaps[:0]
+			break
+		}
+		configmaps = append(configmaps, cm)
+	}
+
+	if len(configmaps) == 0 {
+		key := filepath.Base(path)
+		configmaps = append(configmaps, corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: key},
+			Data:       map[string]string{key: string(content)},
+		})
+	}
+
+	return configmaps, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRunOfflineValidation(t *testing.T) {
+	Convey("Offline validation should load manifests and plain rule files", t, func() {
+		dir, err := ioutil.TempDir("", "offline")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		manifest := filepath.Join(dir, "cm.yaml")
+		// spacing inside of `` is sacrosanct do not over-format
+		err = ioutil.WriteFile(manifest, []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: rules
+  namespace: default
+data:
+  good: |
+    - record: job:up:sum
+      expr: sum(up) by (job)
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: more-rules
+  namespace: default
+data:
+  bad: |
+    - record: job:up:sum
+      expr: sum(up) by (job
+`), 0644)
+		So(err, ShouldBeNil)
+
+		plain := filepath.Join(dir, "rules.yaml")
+		err = ioutil.WriteFile(plain, testRuleGroups, 0644)
+		So(err, ShouldBeNil)
+
+		out := &bytes.Buffer{}
+		So(runOfflineValidation([]string{plain}, pipeline, out), ShouldEqual, 0)
+		So(out.String(), ShouldContainSubstring, "key: rules.yaml Accepted with 1 rulegroups and 2 total rules.")
+
+		out.Reset()
+		So(runOfflineValidation([]string{manifest, plain}, pipeline, out), ShouldEqual, 1)
+		So(out.String(), ShouldContainSubstring, "default-rules key: good Accepted")
+		So(out.String(), ShouldContainSubstring, "default-more-rules key: bad Rejected.")
+		So(out.String(), ShouldContainSubstring, "Field: expr")
+
+		out.Reset()
+		So(runOfflineValidation([]string{filepath.Join(dir, "missing.yaml")}, pipeline, out), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	OutputFile      = "file"
+	OutputConfigMap = "configmap"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	// pipelineLabel names the pipeline owning an output configmap, outputLabel
+	// the output it is a part of.
+	pipelineLabel         = "nordstrom.net/prometheus2AlertsPipeline"
+	outputLabel           = "nordstrom.net/prometheus2AlertsOutput"
+	contentHashAnnotation = "nordstrom.net/prometheus2AlertsHash"
+	outputPartAnnotation  = "nordstrom.net/prometheus2AlertsPart"
+
+	// configmaps are limited to 1MiB, leave room for the metadata
+	maxConfigMapDataBytes = 1000 * 1024
+)
+
+// writeRules persists rgs for pipeline p. target is a file path or, when the
+// pipeline writes to configmaps, the namespace/name of the output configmap.
+// Returns true if anything was changed.
+func (c *Controller) writeRules(p *Pipeline, target string, rgs *RuleGroups) (bool, error) {
+	if p.output == OutputConfigMap {
+		return c.writeRulesConfigMap(p, target, rgs)
+	}
+
+	rulesBytes, err := yaml.Marshal(*rgs)
+	if err != nil {
+		return false, err
+	}
+	if current, err := ioutil.ReadFile(target); err == nil && bytes.Equal(current, rulesBytes) {
+		return false, nil
+	}
+	return true, c.writeRulesFile(target, rgs)
+}
+
+// writeRulesConfigMap writes rgs to the configmap target, namespace/name. Rules
+// that don't fit into a single configmap are split by group into target,
+// target-1, target-2 and so on, parts left over from a bigger rule set are
+// deleted. Parts are only updated when their content hash changed.
+func (c *Controller) writeRulesConfigMap(p *Pipeline, target string, rgs *RuleGroups) (bool, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(target)
+	if err != nil {
+		return false, err
+	}
+
+	parts, err := splitRuleGroups(rgs, maxConfigMapDataBytes)
+	if err != nil {
+		return false, fmt.Errorf("Unable to split rules for configmap %s: %s", target, err)
+	}
+
+	client := c.kubeclientset.CoreV1().ConfigMaps(namespace)
+	changed := false
+	for i, content := range parts {
+		partName := name
+		if i > 0 {
+			partName = fmt.Sprintf("%s-%d", name, i)
+		}
+
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      partName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					managedByLabel: controllerAgentName,
+					pipelineLabel:  p.Name,
+					outputLabel:    name,
+				},
+				Annotations: map[string]string{
+					contentHashAnnotation: hash,
+					outputPartAnnotation:  strconv.Itoa(i),
+				},
+			},
+			Data: map[string]string{partName + ".yaml": string(content)},
+		}
+
+		current, err := client.Get(partName, metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			if _, err := client.Create(cm); err != nil {
+				return changed, fmt.Errorf("Unable to create rules configmap %s/%s: %s", namespace, partName, err)
+			}
+		case err != nil:
+			return changed, fmt.Errorf("Unable to get rules configmap %s/%s: %s", namespace, partName, err)
+		case current.Labels[managedByLabel] != controllerAgentName || current.Labels[pipelineLabel] != p.Name:
+			return changed, fmt.Errorf("Refusing to overwrite configmap %s/%s, it isn't managed by pipeline %s", namespace, partName, p.Name)
+		case current.Annotations[contentHashAnnotation] == hash:
+			continue
+		default:
+			cm.ResourceVersion = current.ResourceVersion
+			if _, err := client.Update(cm); err != nil {
+				return changed, fmt.Errorf("Unable to update rules configmap %s/%s: %s", namespace, partName, err)
+			}
+		}
+		klog.Infof("Wrote %d bytes to configmap %s/%s.", len(content), namespace, partName)
+		changed = true
+	}
+
+	// drop the parts a bigger rule set needed
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: controllerAgentName, pipelineLabel: p.Name, outputLabel: name})
+	existing, err := client.List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return changed, fmt.Errorf("Unable to list rules configmaps of %s: %s", target, err)
+	}
+	for _, cm := range existing.Items {
+		part, err := strconv.Atoi(cm.Annotations[outputPartAnnotation])
+		if err != nil || part < len(parts) {
+			continue
+		}
+		if err := client.Delete(cm.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return changed, fmt.Errorf("Unable to delete rules configmap %s/%s: %s", namespace, cm.Name, err)
+		}
+		klog.Infof("Deleted unused rules configmap %s/%s.", namespace, cm.Name)
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// outputNames returns the names of the output configmaps pipeline p writes,
+// one per shard when it is sharded.
+func (p *Pipeline) outputNames() map[string]struct{} {
+	targets := []string{p.outputTarget()}
+	if p.shards > 0 {
+		targets = make([]string, 0, p.shards)
+		for i := 0; i < p.shards; i++ {
+			targets = append(targets, shardPath(p.outputTarget(), i))
+		}
+	}
+
+	names := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		if _, name, err := cache.SplitMetaNamespaceKey(target); err == nil {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+// pruneOutputConfigMaps deletes the configmaps pipeline p wrote for outputs
+// other than keep, the ones left behind by fewer shards, a renamed output or,
+// with an empty keep, a removed pipeline.
+func (c *Controller) pruneOutputConfigMaps(p *Pipeline, keep map[string]struct{}) error {
+	if p.output != OutputConfigMap {
+		return nil
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(p.outputConfigMap)
+	if err != nil {
+		return err
+	}
+
+	client := c.kubeclientset.CoreV1().ConfigMaps(namespace)
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: controllerAgentName, pipelineLabel: p.Name})
+	existing, err := client.List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("Unable to list rules configmaps of pipeline %s: %s", p.Name, err)
+	}
+	for _, cm := range existing.Items {
+		if _, ok := keep[cm.Labels[outputLabel]]; ok {
+			continue
+		}
+		if err := client.Delete(cm.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("Unable to delete rules configmap %s/%s: %s", namespace, cm.Name, err)
+		}
+		klog.Infof("Deleted rules configmap %s/%s, pipeline %s doesn't write it anymore.", namespace, cm.Name, p.Name)
+	}
+	return nil
+}
+
+// sameNamespace is true if the namespace/name keys a and b are in the same
+// namespace.
+func sameNamespace(a, b string) bool {
+	namespaceA, _, errA := cache.SplitMetaNamespaceKey(a)
+	namespaceB, _, errB := cache.SplitMetaNamespaceKey(b)
+	return errA == nil && errB == nil && namespaceA == namespaceB
+}
+
+// reloadsPrometheus is true if pipeline p has to tell Prometheus about new
+// rules, a configmap output reaches it through the kubelet syncing the volume.
+func (p *Pipeline) reloadsPrometheus() bool {
+	return p.output != OutputConfigMap && p.output != OutputRuler
+}
+
+// splitRuleGroups marshals rgs into as few documents of at most limit bytes as
+// possible, keeping the groups in order. A single group bigger than limit is
+// an error.
+func splitRuleGroups(rgs *RuleGroups, limit int) ([][]byte, error) {
+	whole, err := yaml.Marshal(*rgs)
+	if err != nil {
+		return nil, err
+	}
+	if len(whole) <= limit {
+		return [][]byte{whole}, nil
+	}
+
+	// groups are list items at the top level, the items of several
+	// marshalled documents concatenate into a valid document
+	header := []byte("groups:\n")
+	parts := make([][]byte, 0)
+	current := append([]byte{}, header...)
+	for _, group := range rgs.Groups {
+		single, err := yaml.Marshal(RuleGroups{Groups: []RuleGroup{group}})
+		if err != nil {
+			return nil, err
+		}
+		item := bytes.TrimPrefix(single, header)
+		if len(header)+len(item) > limit {
+			return nil, fmt.Errorf("group %s alone is %d bytes, more than the limit of %d", group.Name, len(single), limit)
+		}
+
+		if len(current)+len(item) > limit {
+			parts = append(parts, current)
+			current = append([]byte{}, header...)
+		}
+		current = append(current, item...)
+	}
+	parts = append(parts, current)
+
+	return parts, nil
+}
+
+// outputTarget is the rules file or, when writing to configmaps, the
+// namespace/name of the configmap of pipeline p.
+func (p *Pipeline) outputTarget() string {
+	if p.output == OutputConfigMap {
+		return p.outputConfigMap
+	}
+	return p.rulesPath
+}
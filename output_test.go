@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// bigRuleGroups builds count groups of roughly size bytes each.
+func bigRuleGroups(count, size int) *RuleGroups {
+	rgs := &RuleGroups{}
+	for i := 0; i < count; i++ {
+		rgs.Groups = append(rgs.Groups, RuleGroup{
+			Name: fmt.Sprintf("group-%d", i),
+			Rules: []rulefmt.Rule{{
+				Record: "job:up:sum",
+				Expr:   "sum(up{job=\"" + strings.Repeat("x", size) + "\"})",
+			}},
+		})
+	}
+	return rgs
+}
+
+func TestSplitRuleGroups(t *testing.T) {
+	Convey("Rule groups should be split into documents under the limit that parse back", t, func() {
+		rgs := bigRuleGroups(5, 100)
+
+		parts, err := splitRuleGroups(rgs, 1<<20)
+		So(err, ShouldBeNil)
+		So(len(parts), ShouldEqual, 1)
+
+		parts, err = splitRuleGroups(rgs, 400)
+		So(err, ShouldBeNil)
+		So(len(parts), ShouldBeGreaterThan, 1)
+
+		names := make([]string, 0)
+		for _, part := range parts {
+			So(len(part), ShouldBeLessThanOrEqualTo, 400)
+			parsed := RuleGroups{}
+			So(yaml.UnmarshalStrict(part, &parsed), ShouldBeNil)
+			for _, group := range parsed.Groups {
+				names = append(names, group.Name)
+			}
+		}
+		So(names, ShouldResemble, []string{"group-0", "group-1", "group-2", "group-3", "group-4"})
+
+		_, err = splitRuleGroups(bigRuleGroups(2, 1000), 400)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestWriteRulesConfigMap(t *testing.T) {
+	Convey("Rules should be written to labelled configmaps, split when they are too big", t, func() {
+		client := fake.NewSimpleClientset()
+		oc := &Controller{kubeclientset: client}
+		op := &Pipeline{Name: "central", output: OutputConfigMap, outputConfigMap: "monitoring/rules"}
+		configmaps := client.CoreV1().ConfigMaps("monitoring")
+
+		changed, err := oc.writeRules(op, op.outputTarget(), bigRuleGroups(2, 10))
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+
+		cm, err := configmaps.Get("rules", meta_v1.GetOptions{})
+		So(err, ShouldBeNil)
+		So(cm.Labels[managedByLabel], ShouldEqual, controllerAgentName)
+		So(cm.Labels[pipelineLabel], ShouldEqual, "central")
+		So(cm.Annotations[contentHashAnnotation], ShouldNotBeEmpty)
+		So(cm.Data["rules.yaml"], ShouldContainSubstring, "group-1")
+
+		// same rules, nothing to update
+		changed, err = oc.writeRules(op, op.outputTarget(), bigRuleGroups(2, 10))
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeFalse)
+
+		// three groups of 400KiB don't fit into one configmap
+		changed, err = oc.writeRules(op, op.outputTarget(), bigRuleGroups(3, 400*1024))
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		list, err := configmaps.List(meta_v1.ListOptions{})
+		So(err, ShouldBeNil)
+		So(len(list.Items), ShouldEqual, 2)
+		part, err := configmaps.Get("rules-1", meta_v1.GetOptions{})
+		So(err, ShouldBeNil)
+		So(part.Data["rules-1.yaml"], ShouldContainSubstring, "group-2")
+
+		// shrinking again drops the second part
+		changed, err = oc.writeRules(op, op.outputTarget(), bigRuleGroups(1, 10))
+		So(err, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		list, err = configmaps.List(meta_v1.ListOptions{})
+		So(err, ShouldBeNil)
+		So(len(list.Items), ShouldEqual, 1)
+	})
+
+	Convey("Configmaps the pipeline doesn't manage should never be overwritten", t, func() {
+		foreign := &corev1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: "rules", Namespace: "monitoring"}}
+		client := fake.NewSimpleClientset(foreign)
+		oc := &Controller{kubeclientset: client}
+		op := &Pipeline{Name: "central", output: OutputConfigMap, outputConfigMap: "monitoring/rules"}
+
+		_, err := oc.writeRules(op, op.outputTarget(), bigRuleGroups(1, 10))
+		So(err, ShouldNotBeNil)
+		cm, err := client.CoreV1().ConfigMaps("monitoring").Get("rules", meta_v1.GetOptions{})
+		So(err, ShouldBeNil)
+		So(cm.Data, ShouldBeEmpty)
+	})
+
+	Convey("Output configmaps the pipeline doesn't write anymore should be pruned", t, func() {
+		client := fake.NewSimpleClientset()
+		oc := &Controller{kubeclientset: client}
+		op := &Pipeline{Name: "central", output: OutputConfigMap, outputConfigMap: "monitoring/rules", shards: 3}
+		configmaps := client.CoreV1().ConfigMaps("monitoring")
+		for i := 0; i < 3; i++ {
+			_, err := oc.writeRules(op, shardPath(op.outputTarget(), i), bigRuleGroups(1, 10))
+			So(err, ShouldBeNil)
+		}
+
+		// down to two shards
+		op.shards = 2
+		So(oc.pruneOutputConfigMaps(op, op.outputNames()), ShouldBeNil)
+		list, err := configmaps.List(meta_v1.ListOptions{})
+		So(err, ShouldBeNil)
+		So(len(list.Items), ShouldEqual, 2)
+		_, err = configmaps.Get("rules-2", meta_v1.GetOptions{})
+		So(err, ShouldNotBeNil)
+
+		// a removed pipeline takes all of them
+		So(oc.pruneOutputConfigMaps(op, nil), ShouldBeNil)
+		list, err = configmaps.List(meta_v1.ListOptions{})
+		So(err, ShouldBeNil)
+		So(list.Items, ShouldBeEmpty)
+	})
+
+	Convey("Only pipelines writing rules files should reload Prometheus", t, func() {
+		So((&Pipeline{}).reloadsPrometheus(), ShouldBeTrue)
+		So((&Pipeline{output: OutputFile}).reloadsPrometheus(), ShouldBeTrue)
+		So((&Pipeline{output: OutputConfigMap}).reloadsPrometheus(), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Pipeline turns the rule configmaps it selects into a single rules file and
+// reloads the Prometheus instances reading it. Every pipeline has its own
+// workqueue, a change to the sources of one pipeline never rebuilds another.
+type Pipeline struct {
+	Name string
+
+	config                PipelineConfig
+	interestingAnnotation string
+	target                string
+	selector              labels.Selector
+	rulesPath             string
+	// output is OutputFile, OutputConfigMap to write to the configmap
+	// outputConfigMap (namespace/name) or OutputRuler to push to rulerURL.
+	output          string
+	outputConfigMap string
+	// the ruler API the rules are pushed to with OutputRuler
+	rulerURL             string
+	rulerTenant          string
+	rulerNamespacePrefix string
+	reloadEndpoints      []string
+	statusAnnotation     string
+	policies             *PolicySet
+	// shards is the number of rules files the groups are spread over, 0
+	// writes everything to rulesPath.
+	shards          int
+	shardAnnotation string
+	// language is the query language of the rules, configmaps of another
+	// language belong to other pipelines.
+	language           string
+	languageAnnotation string
+	// backend evaluates the rules, it decides which group fields beyond
+	// those of rulefmt are kept.
+	backend           string
+	strictGroupFields bool
+	// prometheusVersion rejects group fields newer than it, nil allows all
+	prometheusVersion *PrometheusVersion
+	// rejectConflicts drops the newer of two conflicting rules instead of
+	// only reporting the conflict
+	rejectConflicts bool
+	// reorderRules puts recording rules before the rules of their group
+	// using them
+	reorderRules bool
+	// seriesChecker warns about selectors that match no series, nil
+	// disables the check
+	seriesChecker *seriesChecker
+	// compressed values may not decompress to more than
+	// maxDecompressedBytes or maxCompressionRatio times their size, 0 uses
+	// the defaults
+	maxDecompressedBytes int
+	maxCompressionRatio  int
+	// templateAnnotation names the template a configmap defines, templates
+	// are only read from namespaces matching templateNamespaces
+	templateAnnotation string
+	templateNamespaces []string
+
+	workqueue workqueue.RateLimitingInterface
+	// resourceVersionMap holds the configMapVersion of every configmap the
+	// last rebuild loaded, by name stub
+	resourceVersionMap  map[string]string
+	resourceVersionLock sync.Mutex
+
+	// overQuota holds the configmaps rejected for their quota by the last
+	// rebuild, by namespace
+	overQuota     map[string]int
+	overQuotaLock sync.Mutex
+
+	// ignored holds why the configmaps the last rebuild left out for their
+	// namespace were ignored, by name stub
+	ignored     map[string]string
+	ignoredLock sync.Mutex
+
+	// graph is the dependency graph of the last rebuild
+	graph     *DependencyGraph
+	graphLock sync.Mutex
+
+	// done is closed when the pipeline is retired by a config reload
+	done     chan struct{}
+	stopOnce sync.Once
+	// workers counts the workers that haven't exited yet
+	workers sync.WaitGroup
+}
+
+// NewPipeline builds a pipeline from its configuration, loading its policies.
+func NewPipeline(config PipelineConfig) (*Pipeline, error) {
+	selector := labels.Everything()
+	if config.LabelSelector != "" {
+		var err error
+		selector, err = labels.Parse(config.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("Pipeline %s: invalid label selector %q: %s", config.Name, config.LabelSelector, err)
+		}
+	}
+
+	policies, err := loadPolicies(config.PolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Pipeline %s: %s", config.Name, err)
+	}
+
+	var version *PrometheusVersion
+	if config.PrometheusVersion != "" {
+		if version, err = parsePrometheusVersion(config.PrometheusVersion); err != nil {
+			return nil, fmt.Errorf("Pipeline %s: %s", config.Name, err)
+		}
+	}
+
+	language := config.Language
+	if language == "" {
+		language = LanguagePromQL
+	}
+	languageAnnotation := config.LanguageAnnotation
+	if languageAnnotation == "" {
+		languageAnnotation = defaultLanguageAnnotation
+	}
+	if language == LanguageLogQL {
+		// the expression cost checks walk the PromQL syntax tree
+		for _, spec := range policies.specs() {
+			if spec.Type == "expressionCost" {
+				return nil, fmt.Errorf("Pipeline %s: policy %s can't check LogQL rules", config.Name, spec.ID)
+			}
+		}
+	}
+
+	var checker *seriesChecker
+	if config.SeriesCheckURL != "" {
+		ttl := config.SeriesCheckTTL
+		if ttl == 0 {
+			ttl = defaultSeriesCheckTTL
+		}
+		checker = newSeriesChecker(config.SeriesCheckURL, ttl)
+	}
+
+	return &Pipeline{
+		Name:                  config.Name,
+		config:                config,
+		interestingAnnotation: config.Annotation,
+		target:                config.Target,
+		selector:              selector,
+		rulesPath:             config.RulesPath,
+		output:                config.Output,
+		outputConfigMap:       config.OutputConfigMap,
+		rulerURL:              config.RulerURL,
+		rulerTenant:           config.RulerTenant,
+		rulerNamespacePrefix:  config.RulerNamespacePrefix,
+		reloadEndpoints:       config.ReloadEndpoints,
+		statusAnnotation:      config.StatusAnnotation,
+		policies:              policies,
+		shards:                config.Shards,
+		shardAnnotation:       config.ShardAnnotation,
+		language:              language,
+		languageAnnotation:    languageAnnotation,
+		backend:               config.Backend,
+		strictGroupFields:     config.StrictGroupFields,
+		prometheusVersion:     version,
+		rejectConflicts:       config.RejectConflicts,
+		reorderRules:          config.ReorderRules,
+		seriesChecker:         checker,
+		maxDecompressedBytes:  config.MaxDecompressedBytes,
+		maxCompressionRatio:   config.MaxCompressionRatio,
+		templateAnnotation:    config.TemplateAnnotation,
+		templateNamespaces:    splitList(config.TemplateNamespaces),
+		workqueue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "configmaps-"+config.Name),
+		resourceVersionMap:    make(map[string]string),
+		done:                  make(chan struct{}),
+	}, nil
+}
+
+// start runs threadiness workers for the pipeline until stopCh is closed or
+// the pipeline is stopped.
+func (p *Pipeline) start(c *Controller, threadiness int, stopCh <-chan struct{}) {
+	p.workers.Add(threadiness)
+	for i := 0; i < threadiness; i++ {
+		go func() {
+			defer p.workers.Done()
+			wait.Until(func() { c.runWorker(p) }, time.Second, p.done)
+		}()
+	}
+	go func() {
+		select {
+		case <-stopCh:
+		case <-p.done:
+		}
+		p.workqueue.ShutDown()
+	}()
+}
+
+// stop retires the pipeline, its workers exit once the item they are working
+// on is done.
+func (p *Pipeline) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		p.exportOverQuota(nil)
+	})
+}
+
+// wait blocks until the workers of the stopped pipeline have exited.
+func (p *Pipeline) wait() {
+	p.workers.Wait()
+}
+
+// forgetResourceVersions makes the next sync of the pipeline rebuild its rules
+// even if none of its configmaps changed.
+func (p *Pipeline) forgetResourceVersions() {
+	p.resourceVersionLock.Lock()
+	defer p.resourceVersionLock.Unlock()
+
+	p.resourceVersionMap = make(map[string]string)
+}
+
+// hasResourceVersion is true if the last rebuild of the pipeline loaded the
+// configmap with name stub stub.
+func (p *Pipeline) hasResourceVersion(stub string) bool {
+	p.resourceVersionLock.Lock()
+	defer p.resourceVersionLock.Unlock()
+
+	_, ok := p.resourceVersionMap[stub]
+	return ok
+}
+
+// sameAs is true if other would select, validate and write rules exactly
+// like p does.
+func (p *Pipeline) sameAs(other *Pipeline) bool {
+	return reflect.DeepEqual(p.config, other.config) &&
+		reflect.DeepEqual(p.policies.specs(), other.policies.specs())
+}
+
+func (p *Pipeline) dependencyGraph() *DependencyGraph {
+	p.graphLock.Lock()
+	defer p.graphLock.Unlock()
+
+	return p.graph
+}
+
+func (p *Pipeline) setDependencyGraph(graph *DependencyGraph) {
+	p.graphLock.Lock()
+	defer p.graphLock.Unlock()
+
+	p.graph = graph
+}
+
+// setIgnored stores why the configmaps of a rebuild were ignored and returns
+// the ones the rebuild before didn't ignore for the same reason.
+func (p *Pipeline) setIgnored(ignored map[string]string) map[string]bool {
+	p.ignoredLock.Lock()
+	defer p.ignoredLock.Unlock()
+
+	changed := make(map[string]bool)
+	for stub, reason := range ignored {
+		if last, ok := p.ignored[stub]; !ok || last != reason {
+			changed[stub] = true
+		}
+	}
+	p.ignored = ignored
+	return changed
+}
+
+// statusChanged is true if reports differ from the status annotation of cm,
+// always if the pipeline doesn't write one.
+func (p *Pipeline) statusChanged(cm *corev1.ConfigMap, reports []ValidationReport) bool {
+	if p.statusAnnotation == "" {
+		return true
+	}
+	status, err := json.Marshal(reports)
+	if err != nil {
+		return true
+	}
+	current, ok := cm.GetAnnotations()[p.statusAnnotation]
+	return !ok || current != string(status)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	ErrPolicyViolation = "PolicyViolation"
+
+	PolicyActionWarn   = "warn"
+	PolicyActionReject = "reject"
+
+	// level:metric:operations, see https://prometheus.io/docs/practices/rules/
+	defaultRecordingRuleNamePattern = `^[a-zA-Z_][a-zA-Z0-9_]*:[a-zA-Z_][a-zA-Z0-9_]*:[a-zA-Z0-9_]+$`
+)
+
+// PolicyConfig is the layout of the policy file.
+//
+//	policies:
+//	- id: alert-labels
+//	  type: requiredLabels
+//	  action: reject
+//	  labels: [severity, team]
+type PolicyConfig struct {
+	Policies []PolicySpec `yaml:"policies"`
+}
+
+// PolicySpec configures a single policy. Only the fields used by its type
+// need to be set.
+type PolicySpec struct {
+	ID     string `yaml:"id"`
+	Type   string `yaml:"type"`
+	Action string `yaml:"action,omitempty"`
+	// RuleType limits the policy to "alert" or "record" rules, empty means both.
+	RuleType string `yaml:"ruleType,omitempty"`
+	// Match limits the policy to rules carrying all of these labels.
+	Match map[string]string `yaml:"match,omitempty"`
+
+	Labels      []string       `yaml:"labels,omitempty"`
+	Annotations []string       `yaml:"annotations,omitempty"`
+	For         model.Duration `yaml:"for,omitempty"`
+	Pattern     string         `yaml:"pattern,omitempty"`
+
+	// expressionCost thresholds, zero values are not checked
+	MaxRange              model.Duration `yaml:"maxRange,omitempty"`
+	RequireMatchers       bool           `yaml:"requireMatchers,omitempty"`
+	HighCardinalityLabels []string       `yaml:"highCardinalityLabels,omitempty"`
+	MaxSubqueryDepth      int            `yaml:"maxSubqueryDepth,omitempty"`
+}
+
+// Policy checks rules against an organisational standard. Check is only
+// called for rules the policy applies to and returns one error per violation,
+// none if the rule complies.
+type Policy interface {
+	Spec() PolicySpec
+	Check(rule rulefmt.Rule) []error
+}
+
+// policyFactories maps the type of a policy in the policy file to its
+// constructor, new kinds of policies are added here.
+var policyFactories = map[string]func(spec PolicySpec) (Policy, error){
+	"requiredLabels":      newRequiredLabelsPolicy,
+	"requiredAnnotations": newRequiredAnnotationsPolicy,
+	"minFor":              newMinForPolicy,
+	"recordingRuleName":   newRecordingRuleNamePolicy,
+	"expressionCost":      newExpressionCostPolicy,
+}
+
+// PolicySet is the set of policies loaded from the policy file.
+type PolicySet struct {
+	Policies []Policy
+}
+
+// specs lists the specs of the policies in the set, two sets with the same
+// specs check rules the same way.
+func (s *PolicySet) specs() []PolicySpec {
+	specs := make([]PolicySpec, 0)
+	if s == nil {
+		return specs
+	}
+	for _, policy := range s.Policies {
+		specs = append(specs, policy.Spec())
+	}
+	return specs
+}
+
+func loadPolicies(path string) (*PolicySet, error) {
+	if path == "" {
+		return &PolicySet{}, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read policy file %s: %s", path, err)
+	}
+
+	return parsePolicies(content)
+}
+
+func parsePolicies(content []byte) (*PolicySet, error) {
+	config := PolicyConfig{}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse policies: %s", err)
+	}
+
+	set := &PolicySet{}
+	ids := make(map[string]struct{})
+	for _, spec := range config.Policies {
+		if spec.ID == "" {
+			return nil, fmt.Errorf("Policy of type %q has no id", spec.Type)
+		}
+		if _, ok := ids[spec.ID]; ok {
+			return nil, fmt.Errorf("Policy id %q is used more than once", spec.ID)
+		}
+		ids[spec.ID] = struct{}{}
+
+		if spec.Action == "" {
+			spec.Action = PolicyActionWarn
+		}
+		if spec.Action != PolicyActionWarn && spec.Action != PolicyActionReject {
+			return nil, fmt.Errorf("Policy %s: action must be %q or %q, got %q", spec.ID, PolicyActionWarn, PolicyActionReject, spec.Action)
+		}
+		if spec.RuleType != "" && spec.RuleType != "alert" && spec.RuleType != "record" {
+			return nil, fmt.Errorf("Policy %s: ruleType must be \"alert\" or \"record\", got %q", spec.ID, spec.RuleType)
+		}
+
+		factory, ok := policyFactories[spec.Type]
+		if !ok {
+			return nil, fmt.Errorf("Policy %s: unknown type %q", spec.ID, spec.Type)
+		}
+		policy, err := factory(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Policy %s: %s", spec.ID, err)
+		}
+		set.Policies = append(set.Policies, policy)
+	}
+
+	return set, nil
+}
+
+// policyApplies checks the ruleType and match selectors of a policy.
+func policyApplies(spec PolicySpec, rule rulefmt.Rule) bool {
+	if spec.RuleType == "alert" && rule.Alert == "" {
+		return false
+	}
+	if spec.RuleType == "record" && rule.Record == "" {
+		return false
+	}
+	for k, v := range spec.Match {
+		if rule.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// applyPolicies runs every policy of pipeline p against every rule in groups.
+// Violations of "warn" policies are only reported, rules violating a "reject"
+// policy are dropped as well.
+func (c *Controller) applyPolicies(p *Pipeline, cm *corev1.ConfigMap, keyname string, groups RuleGroups) (RuleGroups, []ValidationError, []ValidationError) {
+	errs := make([]ValidationError, 0)
+	warnings := make([]ValidationError, 0)
+	if p.policies == nil || len(p.policies.Policies) == 0 {
+		return groups, errs, warnings
+	}
+
+	nameStub := c.createNameStub(cm)
+	for i := 0; i < len(groups.Groups); i++ {
+		remove := make([]int, 0)
+
+		for j, rule := range groups.Groups[i].Rules {
+			name := rule.Alert
+			if name == "" {
+				name = rule.Record
+			}
+
+			rejected := false
+			for _, policy := range p.policies.Policies {
+				spec := policy.Spec()
+				if !policyApplies(spec, rule) {
+					continue
+				}
+				for _, err := range policy.Check(rule) {
+					verr := ValidationError{Group: groups.Groups[i].Name, Rule: name, Policy: spec.ID, Err: err}
+					errorMsg := fmt.Sprintf("Rule violates policy: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, keyname, verr.Error())
+					c.recordEvent(cm, corev1.EventTypeWarning, ErrPolicyViolation, errorMsg)
+
+					if spec.Action == PolicyActionReject {
+						errs = append(errs, verr)
+						rejected = true
+					} else {
+						warnings = append(warnings, verr)
+					}
+				}
+			}
+
+			if rejected {
+				remove = append(remove, j)
+			}
+		}
+
+		c.removeRules(&groups.Groups[i], remove)
+	}
+
+	return groups, errs, warnings
+}
+
+type requiredLabelsPolicy struct {
+	spec PolicySpec
+}
+
+func newRequiredLabelsPolicy(spec PolicySpec) (Policy, error) {
+	if len(spec.Labels) == 0 {
+		return nil, fmt.Errorf("requiredLabels needs at least one label")
+	}
+	return &requiredLabelsPolicy{spec: spec}, nil
+}
+
+func (p *requiredLabelsPolicy) Spec() PolicySpec {
+	return p.spec
+}
+
+func (p *requiredLabelsPolicy) Check(rule rulefmt.Rule) []error {
+	return checkRequiredKeys("label", p.spec.Labels, rule.Labels)
+}
+
+type requiredAnnotationsPolicy struct {
+	spec PolicySpec
+}
+
+func newRequiredAnnotationsPolicy(spec PolicySpec) (Policy, error) {
+	if len(spec.Annotations) == 0 {
+		return nil, fmt.Errorf("requiredAnnotations needs at least one annotation")
+	}
+	return &requiredAnnotationsPolicy{spec: spec}, nil
+}
+
+func (p *requiredAnnotationsPolicy) Spec() PolicySpec {
+	return p.spec
+}
+
+func (p *requiredAnnotationsPolicy) Check(rule rulefmt.Rule) []error {
+	return checkRequiredKeys("annotation", p.spec.Annotations, rule.Annotations)
+}
+
+func checkRequiredKeys(kind string, required []string, present map[string]string) []error {
+	missing := make([]string, 0)
+	for _, k := range required {
+		if v, ok := present[k]; !ok || v == "" {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return []error{fmt.Errorf("missing required %s(s): %s", kind, strings.Join(missing, ", "))}
+	}
+	return nil
+}
+
+type minForPolicy struct {
+	spec PolicySpec
+}
+
+func newMinForPolicy(spec PolicySpec) (Policy, error) {
+	if spec.For <= 0 {
+		return nil, fmt.Errorf("minFor needs a positive for duration")
+	}
+	// for only makes sense on alerts
+	spec.RuleType = "alert"
+	return &minForPolicy{spec: spec}, nil
+}
+
+func (p *minForPolicy) Spec() PolicySpec {
+	return p.spec
+}
+
+func (p *minForPolicy) Check(rule rulefmt.Rule) []error {
+	if rule.For < p.spec.For {
+		return []error{fmt.Errorf("for duration %s is shorter than the required %s", rule.For, p.spec.For)}
+	}
+	return nil
+}
+
+type recordingRuleNamePolicy struct {
+	spec    PolicySpec
+	pattern *regexp.Regexp
+}
+
+func newRecordingRuleNamePolicy(spec PolicySpec) (Policy, error) {
+	if spec.Pattern == "" {
+		spec.Pattern = defaultRecordingRuleNamePattern
+	}
+	pattern, err := regexp.Compile(spec.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", err)
+	}
+	spec.RuleType = "record"
+	return &recordingRuleNamePolicy{spec: spec, pattern: pattern}, nil
+}
+
+func (p *recordingRuleNamePolicy) Spec() PolicySpec {
+	return p.spec
+}
+
+func (p *recordingRuleNamePolicy) Check(rule rulefmt.Rule) []error {
+	if !p.pattern.MatchString(rule.Record) {
+		return []error{fmt.Errorf("recording rule name does not match %s", p.spec.Pattern)}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// spacing inside of the raw string is sacrosanct do not over-format
+const testPolicyFile = `policies:
+- id: alert-labels
+  type: requiredLabels
+  ruleType: alert
+  action: reject
+  labels: [severity, team]
+- id: alert-runbook
+  type: requiredAnnotations
+  ruleType: alert
+  annotations: [runbook_url]
+- id: page-for
+  type: minFor
+  action: reject
+  match:
+    severity: page
+  for: 5m
+- id: record-name
+  type: recordingRuleName
+`
+
+func TestParsePolicies(t *testing.T) {
+	Convey("A policy file should be parsed into policies", t, func() {
+		set, err := parsePolicies([]byte(testPolicyFile))
+		So(err, ShouldBeNil)
+		So(len(set.Policies), ShouldEqual, 4)
+		So(set.Policies[1].Spec().Action, ShouldEqual, PolicyActionWarn)
+		So(set.Policies[2].Spec().RuleType, ShouldEqual, "alert")
+	})
+
+	Convey("Broken policy files should be refused", t, func() {
+		broken := []string{
+			"policies:\n- type: requiredLabels\n  labels: [team]\n",
+			"policies:\n- id: a\n  type: requiredLabels\n  labels: [team]\n- id: a\n  type: requiredLabels\n  labels: [team]\n",
+			"policies:\n- id: a\n  type: unknownType\n",
+			"policies:\n- id: a\n  type: requiredLabels\n  action: explode\n  labels: [team]\n",
+			"policies:\n- id: a\n  type: requiredLabels\n",
+			"policies:\n- id: a\n  type: minFor\n",
+			"policies:\n- id: a\n  type: recordingRuleName\n  pattern: '(('\n",
+			"policies:\n- id: a\n  type: requiredLabels\n  lables: [team]\n",
+		}
+		for _, policy := range broken {
+			_, err := parsePolicies([]byte(policy))
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("No policy file means no policies", t, func() {
+		set, err := loadPolicies("")
+		So(err, ShouldBeNil)
+		So(len(set.Policies), ShouldEqual, 0)
+	})
+}
+
+func TestApplyPolicies(t *testing.T) {
+	Convey("Rules should be checked against every policy that applies to them", t, func() {
+		set, err := parsePolicies([]byte(testPolicyFile))
+		So(err, ShouldBeNil)
+
+		oldPolicies := pipeline.policies
+		pipeline.policies = set
+		defer func() { pipeline.policies = oldPolicies }()
+		events.Clear()
+
+		rgs := RuleGroups{Groups: []RuleGroup{{Name: "policies", Rules: []rulefmt.Rule{
+			// compliant
+			{Alert: "Good", Expr: "up == 0", For: model.Duration(10 * time.Minute),
+				Labels:      map[string]string{"severity": "page", "team": "a"},
+				Annotations: map[string]string{"runbook_url": "http://runbook"}},
+			// missing the team label, rejected
+			{Alert: "NoTeam", Expr: "up == 0",
+				Labels:      map[string]string{"severity": "ticket"},
+				Annotations: map[string]string{"runbook_url": "http://runbook"}},
+			// missing runbook, warning only
+			{Alert: "NoRunbook", Expr: "up == 0",
+				Labels: map[string]string{"severity": "ticket", "team": "a"}},
+			// page with a short for, rejected
+			{Alert: "QuickPage", Expr: "up == 0", For: model.Duration(time.Minute),
+				Labels:      map[string]string{"severity": "page", "team": "a"},
+				Annotations: map[string]string{"runbook_url": "http://runbook"}},
+			// badly named recording rule, warning only
+			{Record: "http_requests_rate", Expr: "rate(http_requests_total[5m])"},
+			{Record: "job:http_requests:rate5m", Expr: "sum(rate(http_requests_total[5m])) by (job)"},
+		}}}}
+
+		validated, errs, warnings := c.applyPolicies(pipeline, &configmapDataBlockRules, "rules", rgs)
+
+		remaining := make([]string, 0)
+		for _, r := range validated.Groups[0].Rules {
+			remaining = append(remaining, r.Alert+r.Record)
+		}
+		So(remaining, ShouldResemble, []string{"Good", "NoRunbook", "http_requests_rate", "job:http_requests:rate5m"})
+
+		So(len(errs), ShouldEqual, 2)
+		So(errs[0].Rule, ShouldEqual, "NoTeam")
+		So(errs[0].Policy, ShouldEqual, "alert-labels")
+		So(errs[0].Err.Error(), ShouldEqual, "missing required label(s): team")
+		So(errs[1].Rule, ShouldEqual, "QuickPage")
+		So(errs[1].Policy, ShouldEqual, "page-for")
+
+		So(len(warnings), ShouldEqual, 2)
+		So(warnings[0].Rule, ShouldEqual, "NoRunbook")
+		So(warnings[0].Policy, ShouldEqual, "alert-runbook")
+		So(warnings[1].Rule, ShouldEqual, "http_requests_rate")
+		So(warnings[1].Policy, ShouldEqual, "record-name")
+
+		So(events.CountWarnings(), ShouldEqual, 4)
+	})
+}
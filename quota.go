@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	ErrQuotaExceeded = "QuotaExceeded"
+)
+
+// NamespaceQuota limits what a single namespace can contribute to the final
+// rules, zero means unlimited.
+type NamespaceQuota struct {
+	Groups    int `yaml:"groups,omitempty"`
+	Rules     int `yaml:"rules,omitempty"`
+	ExprBytes int `yaml:"exprBytes,omitempty"`
+}
+
+// namespaceUsage is what a namespace or a single configmap contributes.
+type namespaceUsage struct {
+	Groups    int
+	Rules     int
+	ExprBytes int
+}
+
+func (u *namespaceUsage) add(o namespaceUsage) {
+	u.Groups += o.Groups
+	u.Rules += o.Rules
+	u.ExprBytes += o.ExprBytes
+}
+
+func measureUsage(rgs []RuleGroups) namespaceUsage {
+	usage := namespaceUsage{}
+	for _, rg := range rgs {
+		usage.Groups += len(rg.Groups)
+		for _, g := range rg.Groups {
+			usage.Rules += len(g.Rules)
+			for _, r := range g.Rules {
+				usage.ExprBytes += len(r.Expr)
+			}
+		}
+	}
+	return usage
+}
+
+// exceeds returns a description of every limit of q that usage is over.
+func (q NamespaceQuota) exceeds(usage namespaceUsage) []string {
+	over := make([]string, 0)
+	if q.Groups > 0 && usage.Groups > q.Groups {
+		over = append(over, fmt.Sprintf("groups %d/%d", usage.Groups, q.Groups))
+	}
+	if q.Rules > 0 && usage.Rules > q.Rules {
+		over = append(over, fmt.Sprintf("rules %d/%d", usage.Rules, q.Rules))
+	}
+	if q.ExprBytes > 0 && usage.ExprBytes > q.ExprBytes {
+		over = append(over, fmt.Sprintf("exprbytes %d/%d", usage.ExprBytes, q.ExprBytes))
+	}
+	return over
+}
+
+// parseNamespaceQuota reads the quota annotation of a namespace, eg:
+// "groups=10,rules=200,exprbytes=65536". Limits that aren't mentioned keep
+// the value from defaults.
+func parseNamespaceQuota(value string, defaults NamespaceQuota) (NamespaceQuota, error) {
+	quota := defaults
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return defaults, fmt.Errorf("expected limit=value, got %q", part)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || limit < 0 {
+			return defaults, fmt.Errorf("invalid value for %s: %q", kv[0], kv[1])
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "groups":
+			quota.Groups = limit
+		case "rules":
+			quota.Rules = limit
+		case "exprbytes":
+			quota.ExprBytes = limit
+		default:
+			return defaults, fmt.Errorf("unknown limit %q", kv[0])
+		}
+	}
+	return quota, nil
+}
+
+// quotaForNamespace returns the quota of a namespace, the default quota
+// unless the namespace overrides it with the quota annotation.
+func (c *Controller) quotaForNamespace(namespace string) NamespaceQuota {
+	if c.namespaceQuota == nil {
+		return NamespaceQuota{}
+	}
+	if c.quotaAnnotation == nil || *c.quotaAnnotation == "" || c.getNamespace == nil {
+		return *c.namespaceQuota
+	}
+
+	ns, err := c.getNamespace(namespace)
+	if err != nil {
+		// without the namespace there is no override
+		return *c.namespaceQuota
+	}
+	value, ok := ns.GetAnnotations()[*c.quotaAnnotation]
+	if !ok {
+		return *c.namespaceQuota
+	}
+	quota, err := parseNamespaceQuota(value, *c.namespaceQuota)
+	if err != nil {
+		klog.Warningf("Ignoring quota annotation of namespace %s: %s", namespace, err)
+		return *c.namespaceQuota
+	}
+	return quota
+}
+
+// enforceQuota checks if the rules of cm still fit into quota given what its
+// namespace already contributed. Configmaps that don't fit are rejected as a
+// whole, used is only updated for the ones that do.
+func (c *Controller) enforceQuota(cm *corev1.ConfigMap, cmRules *MultiRuleGroups, quota NamespaceQuota, used map[string]*namespaceUsage) bool {
+	if _, ok := used[cm.Namespace]; !ok {
+		used[cm.Namespace] = &namespaceUsage{}
+	}
+
+	cmUsage := measureUsage(cmRules.Values)
+	total := *used[cm.Namespace]
+	total.add(cmUsage)
+
+	over := quota.exceeds(total)
+	if len(over) == 0 {
+		used[cm.Namespace].add(cmUsage)
+		return true
+	}
+
+	errorMsg := fmt.Sprintf("Configmap: %s Rejected, namespace %s would exceed its rule quota (%s).", c.createNameStub(cm), cm.Namespace, strings.Join(over, ", "))
+	c.recordEvent(cm, corev1.EventTypeWarning, ErrQuotaExceeded, errorMsg)
+
+	quotaErr := ValidationError{Err: fmt.Errorf("namespace quota exceeded (%s)", strings.Join(over, ", "))}
+	for i := range cmRules.Reports {
+		if cmRules.Reports[i].Accepted {
+			cmRules.Reports[i].Accepted = false
+			cmRules.Reports[i].Errors = append(cmRules.Reports[i].Errors, quotaErr)
+		}
+	}
+	cmRules.Values = nil
+	cmRules.Keys = nil
+
+	return false
+}
+
+// exportOverQuota sets the number of configmaps per namespace the last rebuild
+// of pipeline p rejected for their quota. The namespaces of the rebuild before
+// that without any are dropped, the other pipelines are left alone.
+func (p *Pipeline) exportOverQuota(counts map[string]int) {
+	p.overQuotaLock.Lock()
+	defer p.overQuotaLock.Unlock()
+
+	for namespace := range p.overQuota {
+		if _, ok := counts[namespace]; !ok {
+			configmapsOverQuota.DeleteLabelValues(p.Name, namespace)
+		}
+	}
+	for namespace, count := range counts {
+		configmapsOverQuota.WithLabelValues(p.Name, namespace).Set(float64(count))
+	}
+	p.overQuota = counts
+}
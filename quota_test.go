@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseNamespaceQuota(t *testing.T) {
+	Convey("Quota annotations should override only the limits they mention", t, func() {
+		defaults := NamespaceQuota{Groups: 10, Rules: 100, ExprBytes: 1000}
+
+		quota, err := parseNamespaceQuota("rules=200, exprbytes=0", defaults)
+		So(err, ShouldBeNil)
+		So(quota, ShouldResemble, NamespaceQuota{Groups: 10, Rules: 200, ExprBytes: 0})
+
+		for _, broken := range []string{"rules", "rules=many", "rules=-1", "alerts=5"} {
+			quota, err = parseNamespaceQuota(broken, defaults)
+			So(err, ShouldNotBeNil)
+			So(quota, ShouldResemble, defaults)
+		}
+	})
+}
+
+func TestBuildFinalConfigQuota(t *testing.T) {
+	Convey("Configmaps that push a namespace over its quota should be rejected, oldest first", t, func() {
+		events.Clear()
+		oldQuota, oldAnnotation, oldGetNamespace := c.namespaceQuota, c.quotaAnnotation, c.getNamespace
+		defer func() { c.namespaceQuota, c.quotaAnnotation, c.getNamespace = oldQuota, oldAnnotation, oldGetNamespace }()
+
+		anno := "quota"
+		c.namespaceQuota = &NamespaceQuota{Rules: 4}
+		c.quotaAnnotation = &anno
+		c.getNamespace = func(name string) (*corev1.Namespace, error) {
+			if name == "generous" {
+				return &corev1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: name, Annotations: map[string]string{anno: "rules=100"}}}, nil
+			}
+			return nil, fmt.Errorf("namespace %s not found", name)
+		}
+
+		now := time.Now()
+		list := &corev1.ConfigMapList{}
+		for i, namespace := range []string{"default", "default", "default", "generous", "generous", "generous"} {
+			cm := configmapDataBlockRules.DeepCopy()
+			cm.Namespace = namespace
+			cm.Name = fmt.Sprintf("rules-%d", i)
+			// list them newest first, the quota should go to the oldest regardless
+			cm.CreationTimestamp = meta_v1.NewTime(now.Add(-time.Duration(i) * time.Minute))
+			list.Items = append(list.Items, *cm)
+		}
+
+		rgs := c.buildFinalConfig(pipeline, list)
+		So(countRuleGroupsRules(*rgs), ShouldEqual, 10)
+
+		quotaEvents := make([]string, 0)
+		for _, e := range events.Events {
+			if e.Reason == ErrQuotaExceeded {
+				quotaEvents = append(quotaEvents, e.CMNamespace+"/"+e.CMName)
+			}
+		}
+		So(quotaEvents, ShouldResemble, []string{"default/rules-0"})
+		So(testutil.ToFloat64(configmapsOverQuota.WithLabelValues(pipeline.Name, "default")), ShouldEqual, 1)
+
+		// a rebuild of another pipeline leaves the series of the first alone
+		other := &Pipeline{Name: "other", interestingAnnotation: myAnno, resourceVersionMap: make(map[string]string)}
+		c.buildFinalConfig(other, list)
+		defer other.exportOverQuota(nil)
+		So(testutil.ToFloat64(configmapsOverQuota.WithLabelValues(pipeline.Name, "default")), ShouldEqual, 1)
+
+		// without rejected configmaps the namespace is dropped
+		c.buildFinalConfig(pipeline, &corev1.ConfigMapList{})
+		So(configmapsOverQuota.DeleteLabelValues(pipeline.Name, "default"), ShouldBeFalse)
+		So(testutil.ToFloat64(configmapsOverQuota.WithLabelValues(other.Name, "default")), ShouldEqual, 1)
+	})
+}
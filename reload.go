@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// rebuildKey is queued to make a pipeline rebuild its rules, whether it
+// selects any configmap or not.
+const rebuildKey = ""
+
+// configWatcher polls the config file and the policy files it references and
+// applies the config whenever their content changes. Polling copes with the
+// symlink swaps the kubelet uses to update mounted configmaps, which file
+// notifications tend to miss.
+type configWatcher struct {
+	path string
+	// parse turns the content of the config file into a config, including
+	// the flags that override it.
+	parse func(content []byte) (*Config, error)
+	apply func(config *Config) error
+
+	// digest of the content last applied or rejected, a rejected config is
+	// only retried once something changes.
+	digest string
+}
+
+// read loads the config file and returns the config along with the digest of
+// everything it was built from.
+func (w *configWatcher) read() (*Config, string, error) {
+	content, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, "read error: " + err.Error(), fmt.Errorf("Unable to read config file %s: %s", w.path, err)
+	}
+
+	hash := sha256.New()
+	hash.Write(content)
+
+	config, err := w.parse(content)
+	if err != nil {
+		return nil, hex.EncodeToString(hash.Sum(nil)), err
+	}
+
+	for _, pipeline := range config.Pipelines {
+		if pipeline.PolicyFile == "" {
+			continue
+		}
+		policies, err := ioutil.ReadFile(pipeline.PolicyFile)
+		if err != nil {
+			// NewPipeline reports it, it still has to count as a change
+			policies = []byte(err.Error())
+		}
+		fmt.Fprintf(hash, "\x00%s\x00", pipeline.PolicyFile)
+		hash.Write(policies)
+	}
+
+	return config, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// check applies the config if it changed since the last check.
+func (w *configWatcher) check() {
+	config, digest, err := w.read()
+	if digest == w.digest {
+		return
+	}
+	w.digest = digest
+
+	if err == nil {
+		err = w.apply(config)
+	}
+	if err != nil {
+		klog.Errorf("Rejected config %s, keeping the running config: %s", w.path, err)
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+
+	klog.Infof("Applied config %s", w.path)
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+}
+
+// run checks the config every interval until stopCh is closed.
+func (w *configWatcher) run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(w.check, interval, stopCh)
+}
+
+// applyConfig swaps in a new config at runtime. Pipelines that didn't change
+// keep running and only rebuild when the namespace settings changed, new or
+// changed pipelines start from scratch and removed ones are stopped. The new
+// pipelines only start once the old ones finished their work, so an old
+// pipeline never writes over a new one. Nothing is touched when any part of
+// the new config is broken.
+func (c *Controller) applyConfig(config *Config) error {
+	filter, err := config.namespaceFilter()
+	if err != nil {
+		return err
+	}
+
+	pipelines := make([]*Pipeline, 0, len(config.Pipelines))
+	for _, pipelineConfig := range config.Pipelines {
+		p, err := NewPipeline(pipelineConfig)
+		if err != nil {
+			for _, p := range pipelines {
+				p.workqueue.ShutDown()
+			}
+			return err
+		}
+		pipelines = append(pipelines, p)
+	}
+
+	quota := config.Quota
+	quotaAnnotation := config.QuotaAnnotation
+
+	c.settingsLock.Lock()
+	settingsChanged := c.namespaceQuota == nil || *c.namespaceQuota != quota ||
+		c.quotaAnnotation == nil || *c.quotaAnnotation != quotaAnnotation ||
+		!sameNamespaceFilter(c.namespaceFilter, filter)
+
+	running := make(map[string]*Pipeline)
+	for _, p := range c.pipelines {
+		running[p.Name] = p
+	}
+
+	next := make([]*Pipeline, 0, len(pipelines))
+	started := make([]*Pipeline, 0)
+	resync := make([]*Pipeline, 0)
+	for _, p := range pipelines {
+		if old, ok := running[p.Name]; ok && old.sameAs(p) {
+			p.workqueue.ShutDown()
+			delete(running, p.Name)
+			next = append(next, old)
+			if settingsChanged {
+				resync = append(resync, old)
+			}
+			continue
+		}
+
+		next = append(next, p)
+		started = append(started, p)
+		resync = append(resync, p)
+	}
+
+	names := make(map[string]*Pipeline, len(next))
+	for _, p := range next {
+		names[p.Name] = p
+	}
+	retired := make([]*Pipeline, 0)
+	stopped := make([]*Pipeline, 0, len(running))
+	for _, old := range running {
+		if old.output == OutputConfigMap {
+			klog.Infof("Stopping pipeline %s", old.Name)
+			// a successor writing to the same namespace prunes the
+			// configmaps it doesn't need itself
+			if p, ok := names[old.Name]; !ok || p.output != OutputConfigMap || !sameNamespace(p.outputConfigMap, old.outputConfigMap) {
+				retired = append(retired, old)
+			}
+		} else {
+			klog.Infof("Stopping pipeline %s, its rules file %s is left as is", old.Name, old.rulesPath)
+		}
+		old.stop()
+		stopped = append(stopped, old)
+	}
+
+	c.pipelines = next
+	c.namespaceQuota = &quota
+	c.quotaAnnotation = &quotaAnnotation
+	c.namespaceFilter = filter
+	threadiness, stopCh := c.threadiness, c.stopCh
+	c.settingsLock.Unlock()
+
+	// the workers of the old pipelines take the settings lock, it has to be
+	// released before waiting for them
+	for _, old := range stopped {
+		old.wait()
+	}
+	if stopCh != nil {
+		for _, p := range started {
+			p.start(c, threadiness, stopCh)
+		}
+	}
+
+	for _, old := range retired {
+		if err := c.pruneOutputConfigMaps(old, nil); err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+	for _, p := range resync {
+		c.resyncPipeline(p)
+	}
+
+	return nil
+}
+
+// resyncPipeline makes pipeline p rebuild its rules from the configmaps in the
+// cache, even if none of them changed or it selects none. Its output is
+// written either way.
+func (c *Controller) resyncPipeline(p *Pipeline) {
+	p.forgetResourceVersions()
+	p.workqueue.Add(rebuildKey)
+}
+
+func sameNamespaceFilter(a, b *NamespaceFilter) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	selector := func(f *NamespaceFilter) string {
+		if f.Selector == nil {
+			return ""
+		}
+		return f.Selector.String()
+	}
+	return strings.Join(a.Allow, ",") == strings.Join(b.Allow, ",") &&
+		strings.Join(a.Deny, ",") == strings.Join(b.Deny, ",") &&
+		selector(a) == selector(b)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/tools/cache"
+
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApplyConfig(t *testing.T) {
+	Convey("Applying a config should only restart the pipelines that changed", t, func() {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		rules := configmapDataBlockRules.DeepCopy()
+		So(indexer.Add(rules), ShouldBeNil)
+
+		pipelineConfig := PipelineConfig{Name: "rules", Annotation: myAnno, RulesPath: "/rules", ReloadEndpoints: []string{"e"}}
+		running, err := NewPipeline(pipelineConfig)
+		So(err, ShouldBeNil)
+		defer running.workqueue.ShutDown()
+
+		quota, anno := NamespaceQuota{}, ""
+		ac := &Controller{
+			configmapsLister: corev1listers.NewConfigMapLister(indexer),
+			pipelines:        []*Pipeline{running},
+			namespaceQuota:   &quota,
+			quotaAnnotation:  &anno,
+			namespaceFilter:  &NamespaceFilter{},
+		}
+
+		// same pipeline, same settings: nothing to do
+		So(ac.applyConfig(&Config{Pipelines: []PipelineConfig{pipelineConfig}}), ShouldBeNil)
+		So(ac.pipelines[0], ShouldEqual, running)
+		So(running.workqueue.Len(), ShouldEqual, 0)
+
+		// new quota: the pipeline keeps running but rebuilds
+		So(ac.applyConfig(&Config{Quota: NamespaceQuota{Rules: 10}, Pipelines: []PipelineConfig{pipelineConfig}}), ShouldBeNil)
+		So(ac.pipelines[0], ShouldEqual, running)
+		So(ac.namespaceQuota.Rules, ShouldEqual, 10)
+		So(running.workqueue.Len(), ShouldEqual, 1)
+
+		// changed pipeline: replaced and the old one stopped
+		changed := pipelineConfig
+		changed.RulesPath = "/other"
+		So(ac.applyConfig(&Config{Quota: NamespaceQuota{Rules: 10}, Pipelines: []PipelineConfig{changed}}), ShouldBeNil)
+		So(ac.pipelines[0], ShouldNotEqual, running)
+		So(ac.pipelines[0].rulesPath, ShouldEqual, "/other")
+		So(ac.pipelines[0].workqueue.Len(), ShouldEqual, 1)
+		_, open := <-running.done
+		So(open, ShouldBeFalse)
+		replaced := ac.pipelines[0]
+		defer replaced.workqueue.ShutDown()
+
+		// broken config: everything stays as it was
+		broken := changed
+		broken.PolicyFile = "/does/not/exist"
+		So(ac.applyConfig(&Config{Pipelines: []PipelineConfig{broken}}), ShouldNotBeNil)
+		So(ac.pipelines[0], ShouldEqual, replaced)
+		So(ac.namespaceQuota.Rules, ShouldEqual, 10)
+	})
+
+	Convey("A resynced pipeline should write its output even when it selects nothing", t, func() {
+		dir, err := ioutil.TempDir("", "resync")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		So(indexer.Add(configmapDataBlockRules.DeepCopy()), ShouldBeNil)
+		rp, err := NewPipeline(PipelineConfig{Name: "empty", Annotation: "selects-nothing", RulesPath: filepath.Join(dir, "rules.yaml")})
+		So(err, ShouldBeNil)
+		defer rp.workqueue.ShutDown()
+		rc := &Controller{configmapsLister: corev1listers.NewConfigMapLister(indexer), configmapEventRecorderFunc: events.Add}
+
+		rc.resyncPipeline(rp)
+		key, _ := rp.workqueue.Get()
+		So(key, ShouldEqual, rebuildKey)
+		So(rc.syncHandler(rp, key.(string)), ShouldBeNil)
+		_, err = os.Stat(rp.rulesPath)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("A stopped pipeline should be waited for until its workers are done", t, func() {
+		wp, err := NewPipeline(PipelineConfig{Name: "waited", Annotation: myAnno})
+		So(err, ShouldBeNil)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+
+		wp.start(&Controller{}, 2, stopCh)
+		wp.stop()
+		waited := make(chan struct{})
+		go func() {
+			wp.wait()
+			close(waited)
+		}()
+		drained := false
+		select {
+		case <-waited:
+			drained = true
+		case <-time.After(10 * time.Second):
+		}
+		So(drained, ShouldBeTrue)
+	})
+}
+
+func TestConfigWatcher(t *testing.T) {
+	Convey("The config watcher should apply changed configs and keep the old one when the new one is broken", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "config.yaml")
+		valid := "pipelines:\n- name: a\n  annotation: x\n  rulesPath: /a\n  reloadEndpoints: [e]\n"
+		So(ioutil.WriteFile(path, []byte(valid), 0644), ShouldBeNil)
+
+		applied := make([]*Config, 0)
+		w := &configWatcher{
+			path:  path,
+			parse: func(content []byte) (*Config, error) { return parseConfig(content, Config{}) },
+			apply: func(config *Config) error {
+				applied = append(applied, config)
+				return nil
+			},
+		}
+		failures := testutil.ToFloat64(configReloads.WithLabelValues("failure"))
+
+		w.check()
+		w.check()
+		So(len(applied), ShouldEqual, 1)
+		So(testutil.ToFloat64(configLastReloadSuccessful), ShouldEqual, 1)
+
+		So(ioutil.WriteFile(path, []byte("pipelines: [}"), 0644), ShouldBeNil)
+		w.check()
+		w.check()
+		So(len(applied), ShouldEqual, 1)
+		So(testutil.ToFloat64(configReloads.WithLabelValues("failure")), ShouldEqual, failures+1)
+		So(testutil.ToFloat64(configLastReloadSuccessful), ShouldEqual, 0)
+
+		// a change to a policy file counts as a change of the config
+		policies := filepath.Join(dir, "policies.yaml")
+		So(ioutil.WriteFile(policies, []byte("policies: []\n"), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(path, []byte(valid+"  policyFile: "+policies+"\n"), 0644), ShouldBeNil)
+		w.check()
+		So(len(applied), ShouldEqual, 2)
+		So(ioutil.WriteFile(policies, []byte("policies: []\n# changed\n"), 0644), ShouldBeNil)
+		w.check()
+		So(len(applied), ShouldEqual, 3)
+		So(testutil.ToFloat64(configLastReloadSuccessful), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	BackendPrometheus = "prometheus"
+	BackendThanos     = "thanos"
+
+	ErrUnsupportedField = "UnsupportedField"
+)
+
+// RuleGroups is rulefmt.RuleGroups made of RuleGroup.
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is rulefmt.RuleGroup plus the group fields of newer Prometheus
+// releases and the ones rulefmt doesn't know at all, such as
+// partial_response_strategy of the Thanos Ruler. rulefmt drops them on
+// unmarshal, Extra keeps them so they are written to the rules file again.
+// Extra takes any key, checkGroupFields rejects the ones no backend knows.
+type RuleGroup struct {
+	Name        string            `yaml:"name"`
+	Interval    model.Duration    `yaml:"interval,omitempty"`
+	QueryOffset model.Duration    `yaml:"query_offset,omitempty"`
+	Limit       int               `yaml:"limit,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Rules       []rulefmt.Rule    `yaml:"rules"`
+
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+// extraFields returns the names of the extra fields of the group, sorted.
+func (g *RuleGroup) extraFields() []string {
+	fields := make([]string, 0, len(g.Extra))
+	for field := range g.Extra {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// backendGroupFields lists the group fields every backend accepts on top of
+// name, interval and rules, along with a check of their value.
+var backendGroupFields = map[string]map[string]func(value interface{}) error{
+	BackendPrometheus: {},
+	BackendThanos: {
+		"partial_response_strategy": validatePartialResponseStrategy,
+	},
+}
+
+// knownGroupField is true if any backend accepts the group field, a field
+// none of them knows is a typo rather than a field of another backend.
+func knownGroupField(field string) bool {
+	for _, fields := range backendGroupFields {
+		if _, ok := fields[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePartialResponseStrategy(value interface{}) error {
+	strategy, _ := value.(string)
+	switch strings.ToLower(strategy) {
+	case "warn", "abort":
+		return nil
+	}
+	return fmt.Errorf("must be \"warn\" or \"abort\", got %v", value)
+}
+
+// PrometheusVersion is a major.minor Prometheus release.
+type PrometheusVersion struct {
+	Major, Minor int
+}
+
+var prometheusVersionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)(\.\d+)?$`)
+
+// parsePrometheusVersion reads versions like 2.31, 2.31.1 or v2.31.1.
+func parsePrometheusVersion(version string) (*PrometheusVersion, error) {
+	match := prometheusVersionPattern.FindStringSubmatch(strings.TrimSpace(version))
+	if match == nil {
+		return nil, fmt.Errorf("invalid Prometheus version %q, expected major.minor such as 2.31", version)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return &PrometheusVersion{Major: major, Minor: minor}, nil
+}
+
+func (v PrometheusVersion) before(other PrometheusVersion) bool {
+	return v.Major < other.Major || (v.Major == other.Major && v.Minor < other.Minor)
+}
+
+func (v PrometheusVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// versionedGroupFields are the group fields Prometheus added after the
+// rulefmt this loader is built with, along with the release that added them.
+var versionedGroupFields = []struct {
+	field string
+	since PrometheusVersion
+	isSet func(group *RuleGroup) bool
+}{
+	{"limit", PrometheusVersion{2, 31}, func(group *RuleGroup) bool { return group.Limit != 0 }},
+	{"query_offset", PrometheusVersion{2, 53}, func(group *RuleGroup) bool { return group.QueryOffset != 0 }},
+	{"labels", PrometheusVersion{3, 0}, func(group *RuleGroup) bool { return len(group.Labels) > 0 }},
+}
+
+// ruleBackend is the backend evaluating the rules of p.
+func (p *Pipeline) ruleBackend() string {
+	if p.backend == "" {
+		return BackendPrometheus
+	}
+	return p.backend
+}
+
+// checkGroupFields checks the extra fields of every group against the fields
+// the backend of pipeline p accepts. A field no backend knows, usually a typo
+// such as intervall, rejects its group. Fields of other backends are dropped
+// with a warning, or reject their group when p is strict about group fields.
+// A field the backend knows but with an invalid value always rejects its
+// group, so does a field newer than the Prometheus version p targets.
+func (c *Controller) checkGroupFields(p *Pipeline, cm *corev1.ConfigMap, keyname string, groups RuleGroups) (RuleGroups, []ValidationError, []ValidationError) {
+	errs := make([]ValidationError, 0)
+	warnings := make([]ValidationError, 0)
+
+	nameStub := c.createNameStub(cm)
+	backend := p.ruleBackend()
+	checked := RuleGroups{}
+	for _, group := range groups.Groups {
+		rejected := false
+		for _, versioned := range versionedGroupFields {
+			if p.prometheusVersion == nil || !versioned.isSet(&group) || !p.prometheusVersion.before(versioned.since) {
+				continue
+			}
+			verr := ValidationError{Group: group.Name, Field: versioned.field, Err: fmt.Errorf("needs Prometheus %s, the target is %s", versioned.since, p.prometheusVersion)}
+			rejected = true
+			errs = append(errs, verr)
+
+			errorMsg := fmt.Sprintf("Group field failed validation: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, keyname, verr.Error())
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrUnsupportedField, errorMsg)
+		}
+
+		for _, field := range group.extraFields() {
+			verr := ValidationError{Group: group.Name, Field: field}
+			check, known := backendGroupFields[backend][field]
+			switch {
+			case known:
+				if verr.Err = check(group.Extra[field]); verr.Err == nil {
+					continue
+				}
+				rejected = true
+				errs = append(errs, verr)
+			case !knownGroupField(field):
+				verr.Err = fmt.Errorf("unknown field")
+				rejected = true
+				errs = append(errs, verr)
+			case p.strictGroupFields:
+				verr.Err = fmt.Errorf("not supported by %s", backend)
+				rejected = true
+				errs = append(errs, verr)
+			default:
+				verr.Err = fmt.Errorf("not supported by %s, dropped", backend)
+				delete(group.Extra, field)
+				warnings = append(warnings, verr)
+			}
+
+			errorMsg := fmt.Sprintf("Group field failed validation: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, keyname, verr.Error())
+			c.recordEvent(cm, corev1.EventTypeWarning, ErrUnsupportedField, errorMsg)
+		}
+
+		if !rejected {
+			checked.Groups = append(checked.Groups, group)
+		}
+	}
+
+	return checked, errs, warnings
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func thanosConfigMap(strategy string) *corev1.ConfigMap {
+	cm := configmapDataBlockRules.DeepCopy()
+	cm.Data = map[string]string{"rules": `groups:
+- name: thanos
+  partial_response_strategy: ` + strategy + `
+  rules:
+  - alert: HighErrorRate
+    expr: rate(http_errors_total[5m]) > 1
+`}
+	return cm
+}
+
+func TestCheckGroupFields(t *testing.T) {
+	Convey("Thanos pipelines should keep partial_response_strategy all the way to the rules file", t, func() {
+		events.Clear()
+		tp := &Pipeline{Name: "thanos", interestingAnnotation: myAnno, backend: BackendThanos}
+		mrg := c.extractValues(tp, thanosConfigMap("warn"))
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(events.CountWarnings(), ShouldEqual, 0)
+
+		out, err := yaml.Marshal(c.decomposeMultiRuleGroupIntoRuleGroups(&mrg))
+		So(err, ShouldBeNil)
+		So(string(out), ShouldContainSubstring, "partial_response_strategy: warn")
+
+		events.Clear()
+		mrg = c.extractValues(tp, thanosConfigMap("sometimes"))
+		So(len(mrg.Values), ShouldEqual, 0)
+		So(mrg.Reports[0].Errors[0].Field, ShouldEqual, "partial_response_strategy")
+		So(events.CountWarnings(), ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Fields the backend doesn't know should be dropped with a warning, or reject the group when strict", t, func() {
+		events.Clear()
+		pp := &Pipeline{Name: "prometheus", interestingAnnotation: myAnno}
+		mrg := c.extractValues(pp, thanosConfigMap("warn"))
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(mrg.Values[0].Groups[0].Extra, ShouldBeEmpty)
+		So(len(mrg.Reports[0].Warnings), ShouldEqual, 1)
+		So(mrg.Reports[0].Warnings[0].Error(), ShouldContainSubstring, "not supported by prometheus")
+
+		events.Clear()
+		pp.strictGroupFields = true
+		mrg = c.extractValues(pp, thanosConfigMap("warn"))
+		So(len(mrg.Values), ShouldEqual, 0)
+		So(len(mrg.Reports[0].Errors), ShouldEqual, 1)
+		So(mrg.Reports[0].Accepted, ShouldBeFalse)
+	})
+
+	Convey("Fields no backend knows should reject the group", t, func() {
+		for _, backend := range []string{BackendPrometheus, BackendThanos} {
+			events.Clear()
+			cm := configmapDataBlockRules.DeepCopy()
+			cm.Data = map[string]string{"rules": "groups:\n- name: typo\n  intervall: 1m\n  rules:\n  - alert: Down\n    expr: up == 0\n"}
+			mrg := c.extractValues(&Pipeline{Name: backend, interestingAnnotation: myAnno, backend: backend}, cm)
+			So(mrg.Values, ShouldBeEmpty)
+			So(mrg.Reports[0].Errors[0].Field, ShouldEqual, "intervall")
+			So(mrg.Reports[0].Errors[0].Error(), ShouldContainSubstring, "unknown field")
+			So(events.CountWarnings(), ShouldBeGreaterThan, 0)
+		}
+	})
+
+	Convey("Groups without extra fields should marshal exactly like rulefmt groups", t, func() {
+		mrg := c.extractValues(pipeline, &configmapDataBlockRules)
+		out, err := yaml.Marshal(mrg.Values[0])
+		So(err, ShouldBeNil)
+
+		upstream := rulefmt.RuleGroups{}
+		So(yaml.Unmarshal(out, &upstream), ShouldBeNil)
+		upstreamOut, err := yaml.Marshal(upstream)
+		So(err, ShouldBeNil)
+		So(string(out), ShouldEqual, string(upstreamOut))
+	})
+}
+
+func newerFieldsConfigMap() *corev1.ConfigMap {
+	cm := configmapDataBlockRules.DeepCopy()
+	cm.Data = map[string]string{"rules": `groups:
+- name: newer
+  interval: 1m
+  query_offset: 30s
+  limit: 10
+  labels:
+    team: payments
+  rules:
+  - record: job:http_requests:rate5m
+    expr: sum by (job) (rate(http_requests_total[5m]))
+`}
+	return cm
+}
+
+func TestVersionedGroupFields(t *testing.T) {
+	Convey("Prometheus versions should parse with or without patch and v prefix", t, func() {
+		for version, expected := range map[string]PrometheusVersion{"2.31": {2, 31}, "2.53.1": {2, 53}, "v3.0.0": {3, 0}} {
+			parsed, err := parsePrometheusVersion(version)
+			So(err, ShouldBeNil)
+			So(*parsed, ShouldResemble, expected)
+		}
+		for _, version := range []string{"", "2", "latest", "2.x"} {
+			_, err := parsePrometheusVersion(version)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("limit, query_offset and labels should round trip to the rules file", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, newerFieldsConfigMap())
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(events.CountWarnings(), ShouldEqual, 0)
+
+		group := mrg.Values[0].Groups[0]
+		So(group.Limit, ShouldEqual, 10)
+		So(group.QueryOffset.String(), ShouldEqual, "30s")
+		So(group.Labels, ShouldResemble, map[string]string{"team": "payments"})
+
+		out, err := yaml.Marshal(mrg.Values[0])
+		So(err, ShouldBeNil)
+		roundTrip := RuleGroups{}
+		So(yaml.UnmarshalStrict(out, &roundTrip), ShouldBeNil)
+		So(roundTrip, ShouldResemble, mrg.Values[0])
+	})
+
+	Convey("Fields newer than the target Prometheus should reject the group", t, func() {
+		cases := []struct {
+			version string
+			fields  []string
+		}{
+			{"2.30", []string{"limit", "query_offset", "labels"}},
+			{"2.31", []string{"query_offset", "labels"}},
+			{"2.53", []string{"labels"}},
+			{"3.0", []string{}},
+		}
+		for _, tc := range cases {
+			events.Clear()
+			version, _ := parsePrometheusVersion(tc.version)
+			vp := &Pipeline{Name: "versioned", interestingAnnotation: myAnno, prometheusVersion: version}
+			mrg := c.extractValues(vp, newerFieldsConfigMap())
+
+			fields := make([]string, 0)
+			for _, verr := range mrg.Reports[0].Errors {
+				fields = append(fields, verr.Field)
+			}
+			So(fields, ShouldResemble, tc.fields)
+			So(mrg.Reports[0].Accepted, ShouldEqual, len(tc.fields) == 0)
+		}
+	})
+
+	Convey("Invalid values of the newer fields should reject the group", t, func() {
+		cm := newerFieldsConfigMap()
+		cm.Data["rules"] = strings.Replace(strings.Replace(cm.Data["rules"], "limit: 10", "limit: -1", 1), "team: payments", "0team: payments", 1)
+		mrg := c.extractValues(pipeline, cm)
+		So(len(mrg.Values), ShouldEqual, 0)
+		So(len(mrg.Reports[0].Errors), ShouldEqual, 2)
+	})
+}
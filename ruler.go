@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"k8s.io/klog"
+)
+
+const (
+	OutputRuler = "ruler"
+
+	rulerRulesPath = "/prometheus/config/v1/rules"
+	// rulerTenantHeader selects the tenant on Cortex and Mimir
+	rulerTenantHeader = "X-Scope-OrgID"
+)
+
+// rulerClient talks to the ruler configuration API of Cortex and Mimir,
+// Loki's ruler has the same API under lokiRulerRulesPath.
+type rulerClient struct {
+	url    string
+	path   string
+	tenant string
+	client *http.Client
+}
+
+func newRulerClient(address, path, tenant string) *rulerClient {
+	return &rulerClient{
+		url:    strings.TrimSuffix(address, "/"),
+		path:   path,
+		tenant: tenant,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends a request to the rules API, statuses other than 2xx are errors
+// unless they are listed in ok.
+func (r *rulerClient) do(method, path string, body []byte, ok ...int) (int, []byte, error) {
+	req, err := http.NewRequest(method, r.url+r.path+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if r.tenant != "" {
+		req.Header.Set(rulerTenantHeader, r.tenant)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s %s failed: %s", method, req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, respBody, nil
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp.StatusCode, respBody, nil
+		}
+	}
+	return resp.StatusCode, respBody, fmt.Errorf("%s %s failed, Reponse StatusCode: %d, Response Body: %s", method, req.URL, resp.StatusCode, string(respBody))
+}
+
+// listRuleGroups returns the rule groups of every namespace of the tenant.
+func (r *rulerClient) listRuleGroups() (map[string][]RuleGroup, error) {
+	// a tenant without any rules is a 404 on Cortex
+	status, body, err := r.do("GET", "", nil, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]RuleGroup)
+	if status == http.StatusNotFound {
+		return groups, nil
+	}
+	if err := yaml.Unmarshal(body, &groups); err != nil {
+		return nil, fmt.Errorf("Unable to parse the rules of the ruler: %s", err)
+	}
+	return groups, nil
+}
+
+// setRuleGroup creates the group in namespace or replaces the one of the same name.
+func (r *rulerClient) setRuleGroup(namespace string, group RuleGroup) error {
+	body, err := yaml.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, _, err = r.do("POST", "/"+url.PathEscape(namespace), body)
+	return err
+}
+
+func (r *rulerClient) deleteRuleGroup(namespace, group string) error {
+	_, _, err := r.do("DELETE", "/"+url.PathEscape(namespace)+"/"+url.PathEscape(group), nil, http.StatusNotFound)
+	return err
+}
+
+// rulerNamespaces sorts the groups of mrg into the ruler namespaces their
+// kubernetes namespaces map to. Group names only have to be unique within a
+// ruler namespace, repeated names get a numbered suffix in the order the
+// configmaps were collected in so they stay the same between syncs.
+func rulerNamespaces(p *Pipeline, mrg *MultiRuleGroups) map[string][]RuleGroup {
+	namespaces := make(map[string][]RuleGroup)
+	used := make(map[string]map[string]struct{})
+	for i, rgs := range mrg.Values {
+		namespace := p.rulerNamespacePrefix + mrg.Sources[i].Namespace
+		if _, ok := used[namespace]; !ok {
+			used[namespace] = make(map[string]struct{})
+		}
+
+		for _, group := range rgs.Groups {
+			name := group.Name
+			for n := 2; ; n++ {
+				if _, ok := used[namespace][name]; !ok {
+					break
+				}
+				name = fmt.Sprintf("%s-%d", group.Name, n)
+			}
+			used[namespace][name] = struct{}{}
+			group.Name = name
+			namespaces[namespace] = append(namespaces[namespace], group)
+		}
+	}
+	return namespaces
+}
+
+// syncRuler makes the rules of the ruler namespaces owned by pipeline p match
+// mrg, sending only the groups that were added, changed or removed. The
+// pipeline owns every ruler namespace starting with its namespace prefix.
+func (c *Controller) syncRuler(p *Pipeline, mrg *MultiRuleGroups) error {
+	path := rulerRulesPath
+	if p.language == LanguageLogQL {
+		path = lokiRulerRulesPath
+	}
+	client := newRulerClient(p.rulerURL, path, p.rulerTenant)
+
+	current, err := client.listRuleGroups()
+	if err != nil {
+		return err
+	}
+	desired := rulerNamespaces(p, mrg)
+
+	namespaces := make([]string, 0, len(desired))
+	for namespace := range desired {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	created, updated, deleted := 0, 0, 0
+	for _, namespace := range namespaces {
+		existing := make(map[string]RuleGroup)
+		for _, group := range current[namespace] {
+			existing[group.Name] = group
+		}
+
+		for _, group := range desired[namespace] {
+			old, ok := existing[group.Name]
+			if ok && sameRuleGroup(old, group) {
+				continue
+			}
+			if err := client.setRuleGroup(namespace, group); err != nil {
+				return err
+			}
+			if ok {
+				updated++
+			} else {
+				created++
+			}
+		}
+	}
+
+	owned := make([]string, 0)
+	for namespace := range current {
+		// without a prefix the loader can't tell its namespaces apart
+		if p.rulerNamespacePrefix != "" && strings.HasPrefix(namespace, p.rulerNamespacePrefix) {
+			owned = append(owned, namespace)
+		}
+	}
+	sort.Strings(owned)
+
+	for _, namespace := range owned {
+		keep := make(map[string]struct{})
+		for _, group := range desired[namespace] {
+			keep[group.Name] = struct{}{}
+		}
+		for _, group := range current[namespace] {
+			if _, ok := keep[group.Name]; ok {
+				continue
+			}
+			if err := client.deleteRuleGroup(namespace, group.Name); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+
+	klog.Infof("Pipeline %s: synced ruler %s, %d groups created, %d updated, %d deleted.", p.Name, p.rulerURL, created, updated, deleted)
+	return nil
+}
+
+// sameRuleGroup compares the groups the way the ruler stores them.
+func sameRuleGroup(a, b RuleGroup) bool {
+	aBytes, errA := yaml.Marshal(a)
+	bBytes, errB := yaml.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aBytes, bBytes)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeRuler is an in memory stand-in for the rules API of a Cortex ruler.
+type fakeRuler struct {
+	sync.Mutex
+	tenant   string
+	groups   map[string]map[string]RuleGroup
+	requests []string
+	fail     bool
+}
+
+func (f *fakeRuler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, rulerRulesPath)
+	f.requests = append(f.requests, r.Method+" "+path)
+	if f.fail {
+		http.Error(w, "ruler unavailable", http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get(rulerTenantHeader) != f.tenant {
+		http.Error(w, "no org id", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case r.Method == "GET" && path == "":
+		if len(f.groups) == 0 {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		all := make(map[string][]RuleGroup)
+		for namespace, groups := range f.groups {
+			for _, group := range groups {
+				all[namespace] = append(all[namespace], group)
+			}
+		}
+		out, _ := yaml.Marshal(all)
+		w.Write(out)
+	case r.Method == "POST" && len(parts) == 1:
+		body, _ := ioutil.ReadAll(r.Body)
+		group := RuleGroup{}
+		if err := yaml.UnmarshalStrict(body, &group); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.groups[parts[0]]; !ok {
+			f.groups[parts[0]] = make(map[string]RuleGroup)
+		}
+		f.groups[parts[0]][group.Name] = group
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "DELETE" && len(parts) == 2:
+		delete(f.groups[parts[0]], parts[1])
+		if len(f.groups[parts[0]]) == 0 {
+			delete(f.groups, parts[0])
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// writes lists the requests that changed something, sorted.
+func (f *fakeRuler) writes() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	writes := make([]string, 0)
+	for _, request := range f.requests {
+		if !strings.HasPrefix(request, "GET") {
+			writes = append(writes, request)
+		}
+	}
+	sort.Strings(writes)
+	f.requests = nil
+	return writes
+}
+
+func rulerConfigMaps(namespaces ...string) *corev1.ConfigMapList {
+	list := &corev1.ConfigMapList{}
+	for _, namespace := range namespaces {
+		cm := configmapDataBlockRules.DeepCopy()
+		cm.Namespace = namespace
+		list.Items = append(list.Items, *cm)
+	}
+	return list
+}
+
+func TestSyncRuler(t *testing.T) {
+	Convey("Rules should be pushed to the ruler namespace of their kubernetes namespace, changes only", t, func() {
+		ruler := &fakeRuler{tenant: "team-a", groups: map[string]map[string]RuleGroup{
+			"other-tool": {"theirs": RuleGroup{Name: "theirs"}},
+		}}
+		server := httptest.NewServer(ruler)
+		defer server.Close()
+
+		rp := &Pipeline{
+			Name:                  "ruler",
+			interestingAnnotation: myAnno,
+			output:                OutputRuler,
+			rulerURL:              server.URL + "/",
+			rulerTenant:           "team-a",
+			rulerNamespacePrefix:  "k8s-",
+		}
+
+		list := rulerConfigMaps("default", "monitoring")
+		So(c.syncRuler(rp, c.collectRuleGroups(rp, list)), ShouldBeNil)
+		So(ruler.writes(), ShouldResemble, []string{"POST /k8s-default", "POST /k8s-monitoring"})
+		So(ruler.groups["k8s-default"], ShouldContainKey, "default-rules-rules")
+
+		// nothing changed, nothing is sent
+		So(c.syncRuler(rp, c.collectRuleGroups(rp, list)), ShouldBeNil)
+		So(ruler.writes(), ShouldBeEmpty)
+
+		// a changed rule updates only its group
+		changed := rulerConfigMaps("default", "monitoring")
+		changed.Items[1].Data = map[string]string{"rules": strings.Replace(configmapDataBlockRules.Data["rules"], "severity: Page", "severity: Ticket", 1)}
+		So(changed.Items[1].Data["rules"], ShouldNotEqual, configmapDataBlockRules.Data["rules"])
+		So(c.syncRuler(rp, c.collectRuleGroups(rp, changed)), ShouldBeNil)
+		So(ruler.writes(), ShouldResemble, []string{"POST /k8s-monitoring"})
+
+		// a removed configmap deletes its groups, other namespaces of the tenant stay
+		So(c.syncRuler(rp, c.collectRuleGroups(rp, rulerConfigMaps("default"))), ShouldBeNil)
+		So(ruler.writes(), ShouldResemble, []string{"DELETE /k8s-monitoring/monitoring-rules-rules"})
+		So(ruler.groups, ShouldContainKey, "other-tool")
+
+		ruler.fail = true
+		So(c.syncRuler(rp, c.collectRuleGroups(rp, list)), ShouldNotBeNil)
+	})
+
+	Convey("Repeated group names within a ruler namespace should get stable suffixes", t, func() {
+		rp := &Pipeline{Name: "ruler", interestingAnnotation: myAnno}
+		mrg := &MultiRuleGroups{}
+		for _, name := range []string{"a", "b"} {
+			cm := configmapDataBlockRules.DeepCopy()
+			cm.Name = name
+			mrg.Values = append(mrg.Values, RuleGroups{Groups: []RuleGroup{{Name: "shared"}}})
+			mrg.Sources = append(mrg.Sources, cm)
+		}
+
+		namespaces := rulerNamespaces(rp, mrg)
+		So(len(namespaces["default"]), ShouldEqual, 2)
+		So(namespaces["default"][0].Name, ShouldEqual, "shared")
+		So(namespaces["default"][1].Name, ShouldEqual, "shared-2")
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	ErrSeriesNotFound = "SeriesNotFound"
+
+	seriesPath = "/api/v1/series"
+	// seriesLookback is how far back a selector has to have matched series,
+	// series that disappeared longer ago don't count
+	seriesLookback = time.Hour
+
+	defaultSeriesCheckTTL = 10 * time.Minute
+	// an answer that expired is still used while Prometheus can't be asked,
+	// for at most seriesKeepStale
+	seriesKeepStale = 24 * time.Hour
+	// seriesCheckTimeout bounds the lookups of one rebuild, selectors that
+	// weren't looked up in time are not checked
+	seriesCheckTimeout = 30 * time.Second
+)
+
+type seriesCacheEntry struct {
+	found   bool
+	expires time.Time
+}
+
+// seriesChecker asks a Prometheus whether selectors match any series. Answers
+// are cached for ttl, errors are not. When Prometheus can't be asked the last
+// answer stands, the warnings don't come and go with its availability.
+type seriesChecker struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	now    func() time.Time
+
+	cache     map[string]seriesCacheEntry
+	cacheLock sync.Mutex
+}
+
+func newSeriesChecker(address string, ttl time.Duration) *seriesChecker {
+	return &seriesChecker{
+		url:    strings.TrimSuffix(address, "/"),
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		cache:  make(map[string]seriesCacheEntry),
+	}
+}
+
+// hasSeries is true if selector matched a series within seriesLookback. When
+// the lookup fails the last answer is returned, an error only when there is
+// none.
+func (s *seriesChecker) hasSeries(ctx context.Context, selector string) (bool, error) {
+	now := s.now()
+
+	s.cacheLock.Lock()
+	entry, ok := s.cache[selector]
+	s.cacheLock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.found, nil
+	}
+
+	found, err := s.lookup(ctx, selector, now)
+	if err != nil {
+		if ok {
+			return entry.found, nil
+		}
+		return false, err
+	}
+
+	s.cacheLock.Lock()
+	s.cache[selector] = seriesCacheEntry{found: found, expires: now.Add(s.ttl)}
+	s.cacheLock.Unlock()
+	return found, nil
+}
+
+// lookup asks Prometheus whether selector matched a series within
+// seriesLookback before now.
+func (s *seriesChecker) lookup(ctx context.Context, selector string, now time.Time) (bool, error) {
+	query := url.Values{}
+	query.Set("match[]", selector)
+	query.Set("start", fmt.Sprintf("%d", now.Add(-seriesLookback).Unix()))
+	query.Set("end", fmt.Sprintf("%d", now.Unix()))
+
+	req, err := http.NewRequest(http.MethodGet, s.url+seriesPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		seriesQueries.WithLabelValues("error").Inc()
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		seriesQueries.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("GET %s failed, Reponse StatusCode: %d, Response Body: %s", s.url+seriesPath, resp.StatusCode, string(body))
+	}
+
+	result := struct {
+		Status string              `json:"status"`
+		Data   []map[string]string `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil || result.Status != "success" {
+		seriesQueries.WithLabelValues("error").Inc()
+		return false, fmt.Errorf("Unable to parse the series of %s: %s", selector, string(body))
+	}
+
+	found := len(result.Data) > 0
+	if found {
+		seriesQueries.WithLabelValues("found").Inc()
+	} else {
+		seriesQueries.WithLabelValues("missing").Inc()
+	}
+	return found, nil
+}
+
+// prune forgets the answers that expired longer than seriesKeepStale ago.
+func (s *seriesChecker) prune() {
+	now := s.now()
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	for selector, entry := range s.cache {
+		if !now.Before(entry.expires.Add(seriesKeepStale)) {
+			delete(s.cache, selector)
+		}
+	}
+}
+
+// ruleSelectors returns the selectors of expr that are expected to match
+// series, without ranges and offsets. Selectors of series the pipeline
+// records itself are left out, they may not have been evaluated yet, and so
+// are the arguments of absent() which are meant to match nothing.
+func ruleSelectors(expr string, recorded map[string]struct{}) []string {
+	parsed, err := promql.ParseExpr(expr)
+	if err != nil {
+		return nil
+	}
+
+	selectors := make([]string, 0)
+	seen := make(map[string]struct{})
+	promql.Inspect(parsed, func(node promql.Node, path []promql.Node) error {
+		for _, parent := range path {
+			if call, ok := parent.(*promql.Call); ok && (call.Func.Name == "absent" || call.Func.Name == "absent_over_time") {
+				return nil
+			}
+		}
+
+		var selector *promql.VectorSelector
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			selector = &promql.VectorSelector{Name: n.Name, LabelMatchers: n.LabelMatchers}
+		case *promql.MatrixSelector:
+			selector = &promql.VectorSelector{Name: n.Name, LabelMatchers: n.LabelMatchers}
+		default:
+			return nil
+		}
+		for _, name := range usedMetrics(LanguagePromQL, selector.String()) {
+			if _, ok := recorded[name]; ok {
+				return nil
+			}
+		}
+		if _, ok := seen[selector.String()]; !ok {
+			seen[selector.String()] = struct{}{}
+			selectors = append(selectors, selector.String())
+		}
+		return nil
+	})
+	return selectors
+}
+
+// checkSeries warns on the configmaps whose rules select series the
+// Prometheus of pipeline p doesn't have, usually a typo in a metric name or
+// a label. Selectors Prometheus can't be asked about are not checked, nor
+// are the ones left when the lookups take longer than seriesCheckTimeout.
+func (c *Controller) checkSeries(p *Pipeline, loaded []*corev1.ConfigMap, loadedRules []*MultiRuleGroups) {
+	if p.seriesChecker == nil || p.queryLanguage() != LanguagePromQL {
+		return
+	}
+	p.seriesChecker.prune()
+
+	ctx, cancel := context.WithTimeout(context.Background(), seriesCheckTimeout)
+	defer cancel()
+	unchecked := 0
+	var lastErr error
+
+	recorded := make(map[string]struct{})
+	for _, mrg := range loadedRules {
+		for _, rgs := range mrg.Values {
+			for _, group := range rgs.Groups {
+				for _, rule := range group.Rules {
+					if rule.Record != "" {
+						recorded[rule.Record] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+
+	for i, cm := range loaded {
+		mrg := loadedRules[i]
+		nameStub := c.createNameStub(cm)
+		for v, rgs := range mrg.Values {
+			for _, group := range rgs.Groups {
+				for _, rule := range group.Rules {
+					name := rule.Alert
+					if name == "" {
+						name = rule.Record
+					}
+					for _, selector := range ruleSelectors(rule.Expr, recorded) {
+						found, err := p.seriesChecker.hasSeries(ctx, selector)
+						if err != nil {
+							unchecked++
+							lastErr = err
+							continue
+						}
+						if found {
+							continue
+						}
+						verr := ValidationError{Group: group.Name, Rule: name, Field: "expr", Err: fmt.Errorf("%s matches no series in %s", selector, p.seriesChecker.url)}
+						addReportWarning(mrg, mrg.Keys[v], verr)
+						errorMsg := fmt.Sprintf("Series not found: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, mrg.Keys[v], verr.Error())
+						c.recordEvent(cm, corev1.EventTypeWarning, ErrSeriesNotFound, errorMsg)
+					}
+				}
+			}
+		}
+	}
+
+	if unchecked > 0 {
+		klog.Warningf("Pipeline %s: unable to check the series of %d selectors, skipping them: %s", p.Name, unchecked, lastErr)
+	}
+}
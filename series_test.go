@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const seriesRules = `
+groups:
+- name: series
+  rules:
+  - record: job:http_requests:rate5m
+    expr: sum by (job) (rate(http_requests_total[5m]))
+  - alert: RequestsLow
+    expr: job:http_requests:rate5m < 1 and on(job) up{job="api"} offset 5m
+  - alert: TypoInMetric
+    expr: rate(http_reqests_total[5m]) > 0
+  - alert: ApiGone
+    expr: absent(up{job="gone"})
+`
+
+// seriesStub is a Prometheus that has series for http_requests_total and up,
+// it counts the lookups it answers.
+func seriesStub(lookups *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != seriesPath || r.URL.Query().Get("start") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(lookups, 1)
+		selector := r.URL.Query().Get("match[]")
+		if strings.HasPrefix(selector, "http_requests_total") || strings.HasPrefix(selector, "up") {
+			fmt.Fprintf(w, `{"status":"success","data":[{"__name__":"%s"}]}`, strings.SplitN(selector, "{", 2)[0])
+			return
+		}
+		fmt.Fprint(w, `{"status":"success","data":[]}`)
+	}))
+}
+
+func TestRuleSelectors(t *testing.T) {
+	Convey("Selectors should lose ranges and offsets, recorded series and absent() should be skipped", t, func() {
+		recorded := map[string]struct{}{"job:http_requests:rate5m": {}}
+		So(ruleSelectors(`rate(a{job="x"}[5m] offset 1h) / a{job="x"} + job:http_requests:rate5m`, recorded), ShouldResemble, []string{`a{job="x"}`})
+		So(ruleSelectors(`absent(b{job="x"}) or d`, recorded), ShouldResemble, []string{"d"})
+		So(ruleSelectors(`sum((`, recorded), ShouldBeEmpty)
+	})
+}
+
+func TestSeriesChecker(t *testing.T) {
+	var lookups int32
+	server := seriesStub(&lookups)
+	defer server.Close()
+
+	Convey("Answers should be cached until the ttl expires", t, func() {
+		now := time.Now()
+		checker := newSeriesChecker(server.URL+"/", time.Minute)
+		checker.now = func() time.Time { return now }
+
+		found, err := checker.hasSeries(context.Background(), `up{job="api"}`)
+		So(err, ShouldBeNil)
+		So(found, ShouldBeTrue)
+		found, err = checker.hasSeries(context.Background(), `missing`)
+		So(err, ShouldBeNil)
+		So(found, ShouldBeFalse)
+		checker.hasSeries(context.Background(), `up{job="api"}`)
+		checker.hasSeries(context.Background(), `missing`)
+		So(atomic.LoadInt32(&lookups), ShouldEqual, 2)
+
+		now = now.Add(2 * time.Minute)
+		checker.hasSeries(context.Background(), `missing`)
+		So(atomic.LoadInt32(&lookups), ShouldEqual, 3)
+
+		now = now.Add(seriesKeepStale)
+		checker.prune()
+		So(len(checker.cache), ShouldEqual, 1)
+		now = now.Add(2 * time.Minute)
+		checker.prune()
+		So(len(checker.cache), ShouldEqual, 0)
+	})
+
+	Convey("Errors should not be cached", t, func() {
+		checker := newSeriesChecker(server.URL+"/nowhere", time.Minute)
+		_, err := checker.hasSeries(context.Background(), "up")
+		So(err, ShouldNotBeNil)
+		So(len(checker.cache), ShouldEqual, 0)
+	})
+
+	Convey("The last answer should stand while Prometheus can't be asked", t, func() {
+		now := time.Now()
+		checker := newSeriesChecker(server.URL, time.Minute)
+		checker.now = func() time.Time { return now }
+		found, err := checker.hasSeries(context.Background(), "missing")
+		So(err, ShouldBeNil)
+		So(found, ShouldBeFalse)
+
+		checker.url = server.URL + "/nowhere"
+		now = now.Add(2 * time.Minute)
+		found, err = checker.hasSeries(context.Background(), "missing")
+		So(err, ShouldBeNil)
+		So(found, ShouldBeFalse)
+	})
+}
+
+func TestCheckSeries(t *testing.T) {
+	var lookups int32
+	server := seriesStub(&lookups)
+	defer server.Close()
+
+	statuses := make(map[string][]ValidationReport)
+	sc := &Controller{
+		configmapEventRecorderFunc: events.Add,
+		configmapStatusFunc: func(p *Pipeline, cm *corev1.ConfigMap, reports []ValidationReport) {
+			statuses[cm.Namespace] = reports
+		},
+	}
+
+	Convey("Selectors without series should be warned about but keep their rules", t, func() {
+		events.Clear()
+		sp := &Pipeline{Name: "series", interestingAnnotation: myAnno, seriesChecker: newSeriesChecker(server.URL, time.Minute)}
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{conflictConfigMap("team-a", time.Hour, seriesRules)}}
+		mrg := sc.collectRuleGroups(sp, list)
+
+		So(len(mrg.Values[0].Groups[0].Rules), ShouldEqual, 4)
+		So(events.CountWarnings(), ShouldEqual, 1)
+		So(len(statuses["team-a"][0].Warnings), ShouldEqual, 1)
+		So(statuses["team-a"][0].Warnings[0].Error(), ShouldContainSubstring, "http_reqests_total matches no series in "+server.URL)
+		So(atomic.LoadInt32(&lookups), ShouldEqual, 3)
+
+		// the second rebuild is answered from the cache
+		sc.collectRuleGroups(sp, list)
+		So(atomic.LoadInt32(&lookups), ShouldEqual, 3)
+	})
+
+	Convey("Without a Prometheus to ask the check should be skipped", t, func() {
+		events.Clear()
+		sp := &Pipeline{Name: "series", interestingAnnotation: myAnno, seriesChecker: newSeriesChecker(server.URL+"/nowhere", time.Minute)}
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{conflictConfigMap("team-a", time.Hour, seriesRules)}}
+		sc.collectRuleGroups(sp, list)
+		So(events.CountWarnings(), ShouldEqual, 0)
+	})
+
+	Convey("A failing lookup should skip its selector only", t, func() {
+		events.Clear()
+		partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Query().Get("match[]"), "http_requests_total") {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"status":"success","data":[]}`)
+		}))
+		defer partial.Close()
+
+		sp := &Pipeline{Name: "series", interestingAnnotation: myAnno, seriesChecker: newSeriesChecker(partial.URL, time.Minute)}
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{
+			conflictConfigMap("team-a", time.Hour, seriesRules),
+			conflictConfigMap("team-b", time.Minute, "- alert: Other\n  expr: other_total > 0\n"),
+		}}
+		sc.collectRuleGroups(sp, list)
+		// the selectors after the failing one and the next configmap are still checked
+		So(len(statuses["team-a"][0].Warnings), ShouldEqual, 2)
+		So(len(statuses["team-b"][0].Warnings), ShouldEqual, 1)
+		So(events.CountWarnings(), ShouldEqual, 3)
+	})
+
+	Convey("The settings should not be locked while Prometheus is asked", t, func() {
+		var blocked int32
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a config reload has to get through while the lookup is running
+			locked := make(chan struct{})
+			go func() {
+				sc.settingsLock.Lock()
+				sc.settingsLock.Unlock()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+			case <-time.After(5 * time.Second):
+				atomic.StoreInt32(&blocked, 1)
+			}
+			fmt.Fprint(w, `{"status":"success","data":[]}`)
+		}))
+		defer slow.Close()
+
+		sp := &Pipeline{Name: "series", interestingAnnotation: myAnno, seriesChecker: newSeriesChecker(slow.URL, time.Minute)}
+		list := &corev1.ConfigMapList{Items: []corev1.ConfigMap{conflictConfigMap("team-a", time.Hour, "- alert: Down\n  expr: up == 0\n")}}
+		sc.collectRuleGroups(sp, list)
+		So(atomic.LoadInt32(&blocked), ShouldEqual, 0)
+	})
+}
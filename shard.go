@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const (
+	ErrInvalidShard = "InvalidShard"
+
+	// shardPlaceholder is replaced by the shard number in the rules path of a
+	// sharded pipeline.
+	shardPlaceholder = "{shard}"
+)
+
+// jumpHash is the jump consistent hash of Lamping and Veach. When the number
+// of buckets grows from n to n+1 only 1/(n+1) of the keys move, all of them
+// to the new bucket.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// shardOfConfigMap returns the shard the shard annotation of cm pins its
+// groups to, -1 if it has none or an invalid one.
+func (c *Controller) shardOfConfigMap(p *Pipeline, cm *corev1.ConfigMap) int {
+	if p.shardAnnotation == "" {
+		return -1
+	}
+	value, ok := cm.GetAnnotations()[p.shardAnnotation]
+	if !ok {
+		return -1
+	}
+
+	shard, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || shard < 0 || shard >= p.shards {
+		errorMsg := fmt.Sprintf("Configmap: %s shard %q is not a number between 0 and %d, sharding by hash instead.", c.createNameStub(cm), value, p.shards-1)
+		c.recordEvent(cm, corev1.EventTypeWarning, ErrInvalidShard, errorMsg)
+		return -1
+	}
+	return shard
+}
+
+// shardRuleGroups spreads the groups of mrg over the shards of pipeline p.
+// Groups go to the shard pinned by their configmap's shard annotation, the
+// others are placed by a hash of namespace/configmap/group so they stay put
+// as long as the number of shards doesn't change.
+func (c *Controller) shardRuleGroups(p *Pipeline, mrg *MultiRuleGroups) []*RuleGroups {
+	shards := make([]*RuleGroups, p.shards)
+	for i := range shards {
+		shards[i] = &RuleGroups{}
+	}
+
+	for i, rgs := range mrg.Values {
+		cm := mrg.Sources[i]
+		pinned := c.shardOfConfigMap(p, cm)
+		for _, group := range rgs.Groups {
+			shard := pinned
+			if shard < 0 {
+				h := fnv.New64a()
+				fmt.Fprintf(h, "%s/%s/%s", cm.Namespace, cm.Name, group.Name)
+				shard = jumpHash(h.Sum64(), p.shards)
+			}
+			shards[shard].Groups = append(shards[shard].Groups, group)
+		}
+	}
+
+	for i := range shards {
+		shardRuleGroups.WithLabelValues(p.Name, strconv.Itoa(i)).Set(float64(len(shards[i].Groups)))
+		shards[i] = c.saltRuleGroupNames(shards[i])
+	}
+	return shards
+}
+
+// shardPath is the rules file of a shard, the shard number replaces {shard}
+// in the rules path or, lacking that, is appended to the file name.
+func shardPath(rulesPath string, shard int) string {
+	if strings.Contains(rulesPath, shardPlaceholder) {
+		return strings.Replace(rulesPath, shardPlaceholder, strconv.Itoa(shard), -1)
+	}
+	ext := filepath.Ext(rulesPath)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(rulesPath, ext), shard, ext)
+}
+
+// syncShards writes the rules of every shard of pipeline p and reloads the
+// endpoint of each shard whose rules changed, shard i belongs to the i-th
+// reload endpoint.
+func (c *Controller) syncShards(p *Pipeline, mapList *corev1.ConfigMapList) {
+	c.writeShards(p, c.collectRuleGroups(p, mapList))
+}
+
+// writeShards writes the collected rules of pipeline p to its shards.
+func (c *Controller) writeShards(p *Pipeline, mrg *MultiRuleGroups) {
+	shards := c.shardRuleGroups(p, mrg)
+	for i, rgs := range shards {
+		changed, err := c.writeRules(p, shardPath(p.outputTarget(), i), rgs)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		if changed && p.reloadsPrometheus() && i < len(p.reloadEndpoints) {
+			c.tryEndpointReload(p.reloadEndpoints[i])
+		}
+	}
+	if err := c.pruneOutputConfigMaps(p, p.outputNames()); err != nil {
+		utilruntime.HandleError(err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJumpHash(t *testing.T) {
+	Convey("Adding a shard should only move keys to the new shard", t, func() {
+		counts := make([]int, 4)
+		moved := 0
+		for key := uint64(0); key < 10000; key++ {
+			before := jumpHash(key*0x9E3779B97F4A7C15, 4)
+			after := jumpHash(key*0x9E3779B97F4A7C15, 5)
+			counts[before]++
+			if before != after {
+				So(after, ShouldEqual, 4)
+				moved++
+			}
+		}
+		// roughly a fifth of the keys move, every shard gets roughly a quarter
+		So(moved, ShouldBeBetween, 1500, 2500)
+		for _, count := range counts {
+			So(count, ShouldBeBetween, 2000, 3000)
+		}
+	})
+}
+
+func TestShardPath(t *testing.T) {
+	Convey("Shard paths should replace the placeholder or extend the file name", t, func() {
+		So(shardPath("/rules/shard-{shard}/rules.yaml", 2), ShouldEqual, "/rules/shard-2/rules.yaml")
+		So(shardPath("/rules/rules.yaml", 1), ShouldEqual, "/rules/rules-1.yaml")
+		So(shardPath("/rules", 0), ShouldEqual, "/rules-0")
+	})
+}
+
+func shardedConfigMaps(count int) *corev1.ConfigMapList {
+	list := &corev1.ConfigMapList{}
+	for i := 0; i < count; i++ {
+		cm := configmapDataBlockRules.DeepCopy()
+		cm.Name = fmt.Sprintf("rules-%d", i)
+		list.Items = append(list.Items, *cm)
+	}
+	return list
+}
+
+func TestShardRuleGroups(t *testing.T) {
+	Convey("Groups should be spread over the shards and honour the shard annotation", t, func() {
+		events.Clear()
+		sp := &Pipeline{Name: "sharded", interestingAnnotation: myAnno, shards: 3, shardAnnotation: "shard"}
+
+		list := shardedConfigMaps(30)
+		list.Items[0].Annotations["shard"] = "2"
+		list.Items[1].Annotations["shard"] = "7"
+
+		shards := c.shardRuleGroups(sp, c.collectRuleGroups(sp, list))
+		So(len(shards), ShouldEqual, 3)
+
+		total := 0
+		placed := make(map[string]int)
+		for i, shard := range shards {
+			So(len(shard.Groups), ShouldBeGreaterThan, 0)
+			total += len(shard.Groups)
+			for _, group := range shard.Groups {
+				placed[group.Name] = i
+			}
+		}
+		So(total, ShouldEqual, 30)
+		So(placed[c.createNameStub(&list.Items[0])+"-rules"], ShouldEqual, 2)
+
+		invalid := 0
+		for _, e := range events.Events {
+			if e.Reason == ErrInvalidShard {
+				invalid++
+			}
+		}
+		So(invalid, ShouldEqual, 1)
+
+		// the same input lands on the same shards
+		again := c.shardRuleGroups(sp, c.collectRuleGroups(sp, list))
+		So(again, ShouldResemble, shards)
+	})
+}
+
+func TestSyncShards(t *testing.T) {
+	Convey("Only the endpoints of shards whose rules changed should be reloaded", t, func() {
+		dir, err := ioutil.TempDir("", "shards")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		var lock sync.Mutex
+		reloads := make(map[string]int)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			reloads[r.URL.Path]++
+		}))
+		defer server.Close()
+
+		sp := &Pipeline{
+			Name:                  "sharded",
+			interestingAnnotation: myAnno,
+			rulesPath:             filepath.Join(dir, "rules-{shard}.yaml"),
+			reloadEndpoints:       []string{server.URL + "/0", server.URL + "/1"},
+			shards:                2,
+			shardAnnotation:       "shard",
+		}
+
+		list := shardedConfigMaps(10)
+		c.syncShards(sp, list)
+		So(reloads, ShouldResemble, map[string]int{"/0": 1, "/1": 1})
+		for i := 0; i < 2; i++ {
+			_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("rules-%d.yaml", i)))
+			So(err, ShouldBeNil)
+		}
+
+		c.syncShards(sp, list)
+		So(reloads, ShouldResemble, map[string]int{"/0": 1, "/1": 1})
+
+		pinned := configmapDataBlockRules.DeepCopy()
+		pinned.Name = "pinned"
+		pinned.Annotations["shard"] = "1"
+		list.Items = append(list.Items, *pinned)
+		c.syncShards(sp, list)
+		So(reloads, ShouldResemble, map[string]int{"/0": 1, "/1": 2})
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ErrTemplateFailed = "TemplateFailed"
+
+	defaultTemplateAnnotation = "nordstrom.net/prometheus2AlertsTemplate"
+
+	// the delimiters leave {{ }} to the alert templates of Prometheus
+	templateLeftDelim  = "[["
+	templateRightDelim = "]]"
+)
+
+// templateReference is a document of a template key, it asks for the rules of
+// a template with params filled in.
+type templateReference struct {
+	Template string                 `yaml:"template"`
+	Params   map[string]interface{} `yaml:"params,omitempty"`
+}
+
+// isTemplateKey is true for the keys that hold template references instead
+// of rules.
+func isTemplateKey(key string) bool {
+	key = uncompressedKey(key)
+	return strings.HasSuffix(key, ".template.yaml") || strings.HasSuffix(key, ".template.yml")
+}
+
+func (p *Pipeline) ruleTemplateAnnotation() string {
+	if p.templateAnnotation == "" {
+		return defaultTemplateAnnotation
+	}
+	return p.templateAnnotation
+}
+
+// templateName returns the name of the template cm defines for pipeline p,
+// false if it isn't a template or lives in a namespace templates aren't read
+// from. Without template namespaces templates aren't read from any, whoever
+// could create a template could otherwise shadow the ones of the platform.
+func (p *Pipeline) templateName(cm *corev1.ConfigMap) (string, bool) {
+	if cm == nil {
+		return "", false
+	}
+	name := strings.TrimSpace(cm.Annotations[p.ruleTemplateAnnotation()])
+	if name == "" {
+		return "", false
+	}
+	for _, pattern := range p.templateNamespaces {
+		if ok, _ := path.Match(pattern, cm.Namespace); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ruleTemplate looks up the configmap defining the template name.
+func (c *Controller) ruleTemplate(p *Pipeline, name string) (*corev1.ConfigMap, error) {
+	if c.listConfigMaps == nil {
+		return nil, fmt.Errorf("rule templates are not available")
+	}
+	if len(p.templateNamespaces) == 0 {
+		return nil, fmt.Errorf("rule templates are disabled, no template namespaces are configured")
+	}
+	cms, err := c.listConfigMaps()
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up template %s: %s", name, err)
+	}
+
+	found := make([]*corev1.ConfigMap, 0, 1)
+	for _, cm := range cms {
+		if templateName, ok := p.templateName(cm); ok && templateName == name {
+			found = append(found, cm)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("template %s not found", name)
+	case 1:
+		return found[0], nil
+	}
+	stubs := make([]string, 0, len(found))
+	for _, cm := range found {
+		stubs = append(stubs, c.createNameStub(cm))
+	}
+	sort.Strings(stubs)
+	return nil, fmt.Errorf("template %s is defined by more than one configmap: %s", name, strings.Join(stubs, ", "))
+}
+
+// expandTemplates renders the templates every document of value refers to
+// with its params and returns the rules as a stream of documents. A reference
+// that fails is left out, its error carries the number of its document when
+// value holds several.
+func (c *Controller) expandTemplates(p *Pipeline, cm *corev1.ConfigMap, value string) (string, []ValidationError) {
+	documents := splitDocuments(value)
+	expanded := make([]string, 0, len(documents))
+	errs := make([]ValidationError, 0)
+	for i, document := range documents {
+		number := 0
+		if len(documents) > 1 {
+			number = i + 1
+		}
+		rules, err := c.expandTemplate(p, cm, document)
+		if err != nil {
+			errs = append(errs, ValidationError{Document: number, Err: err})
+			continue
+		}
+		expanded = append(expanded, rules...)
+	}
+	return strings.Join(expanded, "\n---\n"), errs
+}
+
+// expandTemplate renders every key of the template a single reference refers
+// to. Params not given are an error, except namespace which defaults to the
+// namespace of cm.
+func (c *Controller) expandTemplate(p *Pipeline, cm *corev1.ConfigMap, document string) ([]string, error) {
+	reference := templateReference{}
+	if err := yaml.UnmarshalStrict([]byte(document), &reference); err != nil {
+		return nil, fmt.Errorf("invalid template reference: %s", err)
+	}
+	if reference.Template == "" {
+		return nil, fmt.Errorf("template reference names no template")
+	}
+
+	templateCM, err := c.ruleTemplate(p, reference.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]interface{}, len(reference.Params)+1)
+	for name, value := range reference.Params {
+		params[name] = value
+	}
+	if _, ok := params["namespace"]; !ok {
+		params["namespace"] = cm.Namespace
+	}
+
+	values := configMapValues(templateCM)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rendered := make([]string, 0, len(keys))
+	for _, key := range keys {
+		text, err := p.decompressValue(key, values[key])
+		if err != nil {
+			return nil, fmt.Errorf("template %s key %s: %s", reference.Template, key, err)
+		}
+		tmpl, err := template.New(reference.Template+"/"+key).
+			Delims(templateLeftDelim, templateRightDelim).
+			Option("missingkey=error").
+			Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, params); err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, out.String())
+	}
+	return rendered, nil
+}
+
+// requeueTemplateUsers rebuilds the rules of pipeline p when one of its
+// templates changes, the configmaps referring to it didn't change themselves.
+func (c *Controller) requeueTemplateUsers(p *Pipeline) {
+	cms, err := c.listConfigMaps()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Unable to collect configmaps from the cache; %s", err))
+		return
+	}
+
+	for _, cm := range cms {
+		if !c.isRuleConfigMap(p, cm) {
+			continue
+		}
+		for key := range configMapValues(cm) {
+			if !isTemplateKey(key) {
+				continue
+			}
+			name, err := cache.MetaNamespaceKeyFunc(cm)
+			if err != nil {
+				utilruntime.HandleError(err)
+				break
+			}
+			// forget it so the next sync rebuilds
+			c.forgetConfigMap(p, cm)
+			p.workqueue.Add(name)
+			break
+		}
+	}
+}
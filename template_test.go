@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	crashloopingTemplate = `groups:
+- name: "[[ .namespace ]]-crashlooping"
+  rules:
+  - alert: PodCrashLooping
+    expr: rate(kube_pod_container_status_restarts_total{namespace="[[ .namespace ]]"}[15m]) * 60 * 5 > [[ .restarts ]]
+    labels:
+      severity: "[[ .severity ]]"
+    annotations:
+      summary: "{{ $labels.pod }} is restarting"
+`
+	crashloopingReference = `template: crashlooping
+params:
+  restarts: 3
+  severity: page
+`
+)
+
+func templateConfigMap(namespace, name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "templates",
+			Namespace:   namespace,
+			Annotations: map[string]string{defaultTemplateAnnotation: name},
+		},
+		Data: map[string]string{"rules.yaml": crashloopingTemplate},
+	}
+}
+
+func templateController(templates ...*corev1.ConfigMap) *Controller {
+	return &Controller{
+		configmapEventRecorderFunc: events.Add,
+		listConfigMaps: func() ([]*corev1.ConfigMap, error) {
+			return templates, nil
+		},
+	}
+}
+
+func TestIsTemplateKey(t *testing.T) {
+	Convey("Only .template.yaml keys should hold template references", t, func() {
+		So(isTemplateKey("crashlooping.template.yaml"), ShouldBeTrue)
+		So(isTemplateKey("crashlooping.template.yml.gz"), ShouldBeTrue)
+		So(isTemplateKey("template.yaml"), ShouldBeFalse)
+		So(isTemplateKey("rules"), ShouldBeFalse)
+	})
+}
+
+func TestExpandTemplates(t *testing.T) {
+	tc := templateController(templateConfigMap("platform", "crashlooping"))
+	tp := &Pipeline{Name: "templates", interestingAnnotation: myAnno, templateNamespaces: []string{"platform", "monitoring"}}
+
+	Convey("References should be expanded with their params and the namespace", t, func() {
+		events.Clear()
+		mrg := tc.extractValues(tp, formatConfigMap(map[string]string{
+			"alerts.template.yaml": crashloopingReference,
+		}))
+		So(events.CountWarnings(), ShouldEqual, 0)
+		So(len(mrg.Values), ShouldEqual, 1)
+		group := mrg.Values[0].Groups[0]
+		So(group.Name, ShouldEqual, "team-a-crashlooping")
+		So(group.Rules[0].Expr, ShouldContainSubstring, `{namespace="team-a"}[15m]) * 60 * 5 > 3`)
+		So(group.Rules[0].Labels["severity"], ShouldEqual, "page")
+		// the alert templates are left alone
+		So(group.Rules[0].Annotations["summary"], ShouldEqual, "{{ $labels.pod }} is restarting")
+	})
+
+	Convey("Missing params should be reported on the referring configmap", t, func() {
+		events.Clear()
+		mrg := tc.extractValues(tp, formatConfigMap(map[string]string{
+			"alerts.template.yaml": "template: crashlooping\nparams:\n  restarts: 3\n",
+		}))
+		So(mrg.Values, ShouldBeEmpty)
+		So(mrg.Reports[0].Accepted, ShouldBeFalse)
+		So(events.CountWarnings(), ShouldEqual, 1)
+		So(events.Events[0].Reason, ShouldEqual, ErrTemplateFailed)
+		So(events.Events[0].Message, ShouldContainSubstring, `map has no entry for key "severity"`)
+	})
+
+	Convey("A broken reference should not take the others of the key down", t, func() {
+		events.Clear()
+		mrg := tc.extractValues(tp, formatConfigMap(map[string]string{
+			"alerts.template.yaml": crashloopingReference + "---\ntemplate: missing\n---\ntemplate: crashlooping\nparms: {}\n",
+		}))
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(len(mrg.Reports[0].Errors), ShouldEqual, 2)
+		So(mrg.Reports[0].Errors[0].Error(), ShouldEqual, "Document: 2, Error: template missing not found")
+		So(mrg.Reports[0].Errors[1].Document, ShouldEqual, 3)
+		So(mrg.Reports[0].Errors[1].Err.Error(), ShouldContainSubstring, "invalid template reference")
+		So(events.CountWarnings(), ShouldEqual, 2)
+	})
+
+	Convey("Templates should only be read from the template namespaces", t, func() {
+		events.Clear()
+		mp := &Pipeline{interestingAnnotation: myAnno, templateNamespaces: []string{"monitoring"}}
+		mrg := tc.extractValues(mp, formatConfigMap(map[string]string{
+			"alerts.template.yaml": crashloopingReference,
+		}))
+		So(mrg.Values, ShouldBeEmpty)
+		So(events.Events[0].Message, ShouldContainSubstring, "template crashlooping not found")
+	})
+
+	Convey("A template defined twice should not be picked at random", t, func() {
+		events.Clear()
+		twice := templateController(templateConfigMap("platform", "crashlooping"), templateConfigMap("monitoring", "crashlooping"))
+		twice.extractValues(tp, formatConfigMap(map[string]string{
+			"alerts.template.yaml": crashloopingReference,
+		}))
+		So(events.Events[0].Message, ShouldContainSubstring, "defined by more than one configmap: monitoring-templates, platform-templates")
+	})
+
+	Convey("Without a cluster templates can't be expanded", t, func() {
+		events.Clear()
+		mrg := c.extractValues(tp, formatConfigMap(map[string]string{
+			"alerts.template.yaml": crashloopingReference,
+		}))
+		So(mrg.Values, ShouldBeEmpty)
+		So(events.Events[0].Message, ShouldContainSubstring, "rule templates are not available")
+	})
+
+	Convey("Without template namespaces templates should not be read from anywhere", t, func() {
+		events.Clear()
+		mrg := tc.extractValues(&Pipeline{interestingAnnotation: myAnno}, formatConfigMap(map[string]string{
+			"alerts.template.yaml": crashloopingReference,
+		}))
+		So(mrg.Values, ShouldBeEmpty)
+		So(events.Events[0].Message, ShouldContainSubstring, "rule templates are disabled")
+		_, ok := (&Pipeline{}).templateName(templateConfigMap("platform", "crashlooping"))
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestRequeueTemplateUsers(t *testing.T) {
+	Convey("An updated template should requeue its users once", t, func() {
+		tp, err := NewPipeline(PipelineConfig{Name: "templates", Annotation: myAnno, TemplateNamespaces: "platform"})
+		So(err, ShouldBeNil)
+		defer tp.workqueue.ShutDown()
+
+		lookups := 0
+		user := formatConfigMap(map[string]string{"alerts.template.yaml": crashloopingReference})
+		tc := &Controller{
+			pipelines: []*Pipeline{tp},
+			listConfigMaps: func() ([]*corev1.ConfigMap, error) {
+				lookups++
+				return []*corev1.ConfigMap{user}, nil
+			},
+		}
+
+		old, updated := templateConfigMap("platform", "crashlooping"), templateConfigMap("platform", "crashlooping")
+		updated.Data["rules.yaml"] += "\n"
+		tc.enqueueConfigMaps(old, updated)
+		So(lookups, ShouldEqual, 1)
+		So(tp.workqueue.Len(), ShouldEqual, 1)
+	})
+}
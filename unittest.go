@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	ErrRuleTestFailed = "RuleTestFailed"
+
+	// unitTestMaxEvaluations and unitTestMaxSamples bound the work a single
+	// test group can cause, the tests run inside the controller
+	unitTestMaxEvaluations = 10000
+	unitTestMaxSamples     = 100000
+
+	// unitTestWorkers tests run at the same time, a result is kept for
+	// unitTestResultTTL after it was last asked for
+	unitTestWorkers   = 2
+	unitTestResultTTL = time.Hour
+)
+
+// configmap keys with these suffixes hold unit tests instead of rules
+var unitTestKeySuffixes = []string{".test.yaml", ".test.yml"}
+
+// seriesExpansion matches the values of input_series repeated by an expanding
+// notation like 0+1x100
+var seriesExpansion = regexp.MustCompile(`x(\d+)$`)
+
+func isUnitTestKey(key string) bool {
+	key = uncompressedKey(key)
+	for _, suffix := range unitTestKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unitTestFile is a unit test key, it uses the format of promtool test rules.
+// The tests are run by a copy of promtool's loop, its engine is part of the
+// promtool command and can't be imported. Unlike promtool rule_files names
+// configmap keys, the rules are the validated ones, the runs are bounded and
+// alert annotations are compared without expanding their templates.
+// RuleFiles names the keys of the configmap whose rules are tested, empty
+// tests the rules of all keys.
+type unitTestFile struct {
+	RuleFiles          []string        `yaml:"rule_files,omitempty"`
+	EvaluationInterval model.Duration  `yaml:"evaluation_interval,omitempty"`
+	GroupEvalOrder     []string        `yaml:"group_eval_order,omitempty"`
+	Tests              []unitTestGroup `yaml:"tests"`
+}
+
+// unitTestGroup is a set of input series and the tests run against them.
+type unitTestGroup struct {
+	Interval        model.Duration    `yaml:"interval,omitempty"`
+	InputSeries     []unitTestSeries  `yaml:"input_series"`
+	AlertRuleTests  []alertTestCase   `yaml:"alert_rule_test,omitempty"`
+	PromqlExprTests []promqlTestCase  `yaml:"promql_expr_test,omitempty"`
+	ExternalLabels  map[string]string `yaml:"external_labels,omitempty"`
+}
+
+type unitTestSeries struct {
+	Series string `yaml:"series"`
+	Values string `yaml:"values"`
+}
+
+type alertTestCase struct {
+	EvalTime  model.Duration  `yaml:"eval_time"`
+	Alertname string          `yaml:"alertname"`
+	ExpAlerts []expectedAlert `yaml:"exp_alerts"`
+}
+
+type expectedAlert struct {
+	ExpLabels      map[string]string `yaml:"exp_labels"`
+	ExpAnnotations map[string]string `yaml:"exp_annotations"`
+}
+
+type promqlTestCase struct {
+	Expr       string           `yaml:"expr"`
+	EvalTime   model.Duration   `yaml:"eval_time"`
+	ExpSamples []expectedSample `yaml:"exp_samples"`
+}
+
+type expectedSample struct {
+	Labels string  `yaml:"labels"`
+	Value  float64 `yaml:"value"`
+}
+
+// runUnitTests runs the unit test keys of cm against the rules extracted
+// from its other keys. When a test fails none of the rules of cm are loaded,
+// every failed assertion is reported on the test key.
+func (c *Controller) runUnitTests(p *Pipeline, cm *corev1.ConfigMap, mrg *MultiRuleGroups) {
+	nameStub := c.createNameStub(cm)
+
+	values := configMapValues(cm)
+	keys := make([]string, 0)
+	for key := range values {
+		if isUnitTestKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	failed := make([]string, 0)
+	for _, key := range keys {
+		report := ValidationReport{ConfigMap: nameStub, Key: key}
+
+		var errs []ValidationError
+		if p.queryLanguage() != LanguagePromQL {
+			errs = []ValidationError{{Err: fmt.Errorf("unit tests can only be run against PromQL rules")}}
+		} else if value, err := p.decompressValue(key, values[key]); err != nil {
+			errs = []ValidationError{{Err: err}}
+		} else if c.unitTests == nil {
+			errs = runUnitTestFile(value, mrg)
+		} else {
+			var done bool
+			tested, hash := unitTestSnapshot(value, mrg)
+			errs, done = c.unitTests.result(hash, func() []ValidationError {
+				return runUnitTestFile(value, tested)
+			}, func() {
+				c.requeueConfigMap(p, cm)
+			})
+			if !done {
+				// the rules wait for the result, the configmap is rebuilt
+				// once it is in
+				mrg.Pending = true
+				report.Accepted = true
+				report.Warnings = append(report.Warnings, ValidationError{Err: fmt.Errorf("the unit tests are still running")})
+				mrg.Reports = append(mrg.Reports, report)
+				continue
+			}
+		}
+
+		if len(errs) > 0 {
+			failed = append(failed, key)
+			report.Errors = errs
+			for _, verr := range errs {
+				errorMsg := fmt.Sprintf("Unit test failed: Namespace-ConfigMap:%s, Key:%s, %s", nameStub, key, verr.Error())
+				c.recordEvent(cm, corev1.EventTypeWarning, ErrRuleTestFailed, errorMsg)
+			}
+		} else {
+			report.Accepted = true
+			successMessage := fmt.Sprintf("Configmap: %s key: %s unit tests passed.", nameStub, key)
+			c.recordEvent(cm, corev1.EventTypeNormal, ValidKey, successMessage)
+		}
+		mrg.Reports = append(mrg.Reports, report)
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	rejected := ValidationError{Err: fmt.Errorf("rejected, the unit tests in %s failed", strings.Join(failed, ", "))}
+	for i := range mrg.Reports {
+		if isUnitTestKey(mrg.Reports[i].Key) || !mrg.Reports[i].Accepted {
+			continue
+		}
+		mrg.Reports[i].Accepted = false
+		mrg.Reports[i].Groups = 0
+		mrg.Reports[i].Rules = 0
+		mrg.Reports[i].Errors = append(mrg.Reports[i].Errors, rejected)
+	}
+	mrg.Values = nil
+	mrg.Keys = nil
+
+	failMessage := fmt.Sprintf("Configmap: %s Rejected, the unit tests in %s failed.", nameStub, strings.Join(failed, ", "))
+	c.recordEvent(cm, corev1.EventTypeWarning, ErrRuleTestFailed, failMessage)
+}
+
+// unitTestSnapshot returns a copy of the rules of mrg the tests in value can
+// run against while mrg changes, and the hash of both the tests are cached
+// by.
+func unitTestSnapshot(value string, mrg *MultiRuleGroups) (*MultiRuleGroups, string) {
+	order := make([]int, len(mrg.Values))
+	for i := range order {
+		order[i] = i
+	}
+	// the keys of a configmap are extracted in no particular order
+	sort.SliceStable(order, func(i, j int) bool { return mrg.Keys[order[i]] < mrg.Keys[order[j]] })
+
+	snapshot := &MultiRuleGroups{}
+	hash := sha256.New()
+	hash.Write([]byte(value))
+	for _, i := range order {
+		data, err := yaml.Marshal(mrg.Values[i])
+		rgs := RuleGroups{}
+		if err != nil || yaml.Unmarshal(data, &rgs) != nil {
+			// not expected from rules that were just parsed, the tests
+			// run against the rules themselves then
+			rgs = mrg.Values[i]
+		}
+		fmt.Fprintf(hash, "\x00%s\x00%s", mrg.Keys[i], data)
+		snapshot.Values = append(snapshot.Values, rgs)
+		snapshot.Keys = append(snapshot.Keys, mrg.Keys[i])
+	}
+	return snapshot, hex.EncodeToString(hash.Sum(nil))
+}
+
+// unitTestRunner runs unit tests in the background, a few at a time, and
+// keeps their results by the hash of the tests and the rules they test.
+// The same tests against the same rules only run once, however often the
+// configmap is rebuilt or reviewed.
+type unitTestRunner struct {
+	lock    sync.Mutex
+	results map[string]unitTestResult
+	waiting map[string][]func()
+	slots   chan struct{}
+}
+
+type unitTestResult struct {
+	errs []ValidationError
+	used time.Time
+}
+
+func newUnitTestRunner() *unitTestRunner {
+	return &unitTestRunner{
+		results: make(map[string]unitTestResult),
+		waiting: make(map[string][]func()),
+		slots:   make(chan struct{}, unitTestWorkers),
+	}
+}
+
+// result returns the result of the tests with the given hash and true. Tests
+// without a result yet are started with run unless they already are, false
+// is returned and done is called once the result is in.
+func (r *unitTestRunner) result(hash string, run func() []ValidationError, done func()) ([]ValidationError, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if result, ok := r.results[hash]; ok {
+		result.used = time.Now()
+		r.results[hash] = result
+		return append([]ValidationError(nil), result.errs...), true
+	}
+	if _, ok := r.waiting[hash]; !ok {
+		go r.run(hash, run)
+	}
+	r.waiting[hash] = append(r.waiting[hash], done)
+	return nil, false
+}
+
+func (r *unitTestRunner) run(hash string, run func() []ValidationError) {
+	r.slots <- struct{}{}
+	errs := run()
+	<-r.slots
+
+	r.lock.Lock()
+	now := time.Now()
+	for key, result := range r.results {
+		if now.Sub(result.used) > unitTestResultTTL {
+			delete(r.results, key)
+		}
+	}
+	r.results[hash] = unitTestResult{errs: errs, used: now}
+	waiting := r.waiting[hash]
+	delete(r.waiting, hash)
+	r.lock.Unlock()
+
+	for _, done := range waiting {
+		if done != nil {
+			done()
+		}
+	}
+}
+
+// runUnitTestFile parses a unit test key and runs its tests, it returns the
+// failed assertions.
+func runUnitTestFile(value string, mrg *MultiRuleGroups) []ValidationError {
+	testFile := unitTestFile{}
+	if err := yaml.UnmarshalStrict([]byte(value), &testFile); err != nil {
+		return []ValidationError{{Err: fmt.Errorf("unable to parse unit tests: %s", err)}}
+	}
+	if len(testFile.Tests) == 0 {
+		return []ValidationError{{Err: fmt.Errorf("no tests")}}
+	}
+
+	evalInterval := time.Duration(testFile.EvaluationInterval)
+	if evalInterval == 0 {
+		evalInterval = time.Minute
+	}
+
+	// the rules under test, a compressed key can be named without its
+	// compression suffix
+	ruleKeys := make(map[string]struct{})
+	for _, key := range testFile.RuleFiles {
+		ruleKeys[uncompressedKey(key)] = struct{}{}
+	}
+	groups := make([]RuleGroup, 0)
+	for i, rgs := range mrg.Values {
+		if _, ok := ruleKeys[uncompressedKey(mrg.Keys[i])]; ok || len(ruleKeys) == 0 {
+			groups = append(groups, rgs.Groups...)
+		}
+	}
+	for _, key := range testFile.RuleFiles {
+		found := false
+		for _, loaded := range mrg.Keys {
+			found = found || uncompressedKey(loaded) == uncompressedKey(key)
+		}
+		if !found {
+			return []ValidationError{{Field: "rule_files", Err: fmt.Errorf("key %s has no valid rules", key)}}
+		}
+	}
+
+	groupOrder := make(map[string]int)
+	for i, name := range testFile.GroupEvalOrder {
+		if _, ok := groupOrder[name]; ok {
+			return []ValidationError{{Field: "group_eval_order", Err: fmt.Errorf("group %s is listed more than once", name)}}
+		}
+		groupOrder[name] = i
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groupOrder[groups[i].Name] < groupOrder[groups[j].Name]
+	})
+
+	errs := make([]ValidationError, 0)
+	for i := range testFile.Tests {
+		errs = append(errs, testFile.Tests[i].run(evalInterval, groups)...)
+	}
+	return errs
+}
+
+// unitTestStorage is handed to the promql test storage, which only calls it
+// when it fails. The panic is recovered by unitTestGroup.run like any other.
+type unitTestStorage struct{}
+
+type unitTestStorageError string
+
+func (unitTestStorage) Fatal(args ...interface{}) {
+	panic(unitTestStorageError(fmt.Sprint(args...)))
+}
+
+func (unitTestStorage) Fatalf(format string, args ...interface{}) {
+	panic(unitTestStorageError(fmt.Sprintf(format, args...)))
+}
+
+// run evaluates groups against the input series of tg every evalInterval,
+// checking the alerts at their eval_time as it goes, then runs the
+// expression tests against the recorded series.
+func (tg *unitTestGroup) run(evalInterval time.Duration, groups []RuleGroup) (errs []ValidationError) {
+	defer func() {
+		// a test must never take the controller down, whatever the
+		// rules or the promql engine do
+		if r := recover(); r != nil {
+			errs = append(errs, ValidationError{Err: fmt.Errorf("unable to run the tests: %v", r)})
+		}
+	}()
+
+	if samples := tg.countSamples(); samples > unitTestMaxSamples {
+		return []ValidationError{{Field: "input_series", Err: fmt.Errorf("the input series expand to more than %d samples", unitTestMaxSamples)}}
+	}
+
+	interval := time.Duration(tg.Interval)
+	if interval == 0 {
+		interval = time.Minute
+	}
+	input := "load " + model.Duration(interval).String() + "\n"
+	for _, series := range tg.InputSeries {
+		input += "  " + series.Series + " " + series.Values + "\n"
+	}
+	suite, err := promql.NewLazyLoader(unitTestStorage{}, input)
+	if err != nil {
+		return []ValidationError{{Field: "input_series", Err: err}}
+	}
+	defer suite.Close()
+
+	ruleGroups, err := tg.ruleGroups(suite, interval, groups)
+	if err != nil {
+		return []ValidationError{{Err: err}}
+	}
+
+	alertTests := make(map[time.Duration][]alertTestCase)
+	alertTimes := make([]time.Duration, 0)
+	maxEval := time.Duration(0)
+	for _, test := range tg.AlertRuleTests {
+		evalTime := time.Duration(test.EvalTime)
+		if _, ok := alertTests[evalTime]; !ok {
+			alertTimes = append(alertTimes, evalTime)
+		}
+		alertTests[evalTime] = append(alertTests[evalTime], test)
+		if evalTime > maxEval {
+			maxEval = evalTime
+		}
+	}
+	for _, test := range tg.PromqlExprTests {
+		if time.Duration(test.EvalTime) > maxEval {
+			maxEval = time.Duration(test.EvalTime)
+		}
+	}
+	sort.Slice(alertTimes, func(i, j int) bool { return alertTimes[i] < alertTimes[j] })
+
+	mint := time.Unix(0, 0).UTC()
+	maxt := mint.Add(maxEval).Add(evalInterval / 2).Round(evalInterval)
+	if int64(maxt.Sub(mint)/evalInterval) > unitTestMaxEvaluations {
+		return []ValidationError{{Err: fmt.Errorf("the tests need more than %d evaluations, use a longer evaluation_interval", unitTestMaxEvaluations)}}
+	}
+
+	next := 0
+	for ts := mint; ts.Before(maxt); ts = ts.Add(evalInterval) {
+		suite.WithSamplesTill(ts, func(err error) {
+			if err != nil {
+				errs = append(errs, ValidationError{Field: "input_series", Err: err})
+				return
+			}
+			for _, group := range ruleGroups {
+				group.Eval(suite.Context(), ts)
+				for _, rule := range group.Rules() {
+					if rule.LastError() != nil {
+						errs = append(errs, ValidationError{Group: group.Name(), Rule: rule.Name(), Err: fmt.Errorf("evaluation at %s failed: %s", model.Duration(ts.Sub(mint)), rule.LastError())})
+					}
+				}
+			}
+		})
+		if len(errs) > 0 {
+			return errs
+		}
+
+		// the alerts whose eval_time falls into this evaluation
+		for ; next < len(alertTimes) && alertTimes[next] < ts.Add(evalInterval).Sub(mint); next++ {
+			for _, test := range alertTests[alertTimes[next]] {
+				if err := test.check(ruleGroups); err != nil {
+					errs = append(errs, ValidationError{Rule: test.Alertname, Field: "alert_rule_test", Err: err})
+				}
+			}
+		}
+	}
+
+	for _, test := range tg.PromqlExprTests {
+		if err := test.check(suite, mint); err != nil {
+			errs = append(errs, ValidationError{Field: "promql_expr_test", Err: err})
+		}
+	}
+	return errs
+}
+
+// countSamples returns how many samples the input series of tg expand to, the
+// test storage expands them all up front.
+func (tg *unitTestGroup) countSamples() int {
+	samples := 0
+	for _, series := range tg.InputSeries {
+		for _, value := range strings.Fields(series.Values) {
+			match := seriesExpansion.FindStringSubmatch(value)
+			if match == nil {
+				samples++
+				continue
+			}
+			n, err := strconv.Atoi(match[1])
+			if err != nil || n >= unitTestMaxSamples {
+				// too big to count, sure to be too many
+				return unitTestMaxSamples + 1
+			}
+			samples += n + 1
+		}
+		if samples > unitTestMaxSamples {
+			break
+		}
+	}
+	return samples
+}
+
+// ruleGroups builds the groups the prometheus rule manager would from the
+// extracted groups, evaluated against suite.
+func (tg *unitTestGroup) ruleGroups(suite *promql.LazyLoader, interval time.Duration, groups []RuleGroup) ([]*rules.Group, error) {
+	opts := &rules.ManagerOptions{
+		QueryFunc:  rules.EngineQueryFunc(suite.QueryEngine(), suite.Storage()),
+		Appendable: suite.Storage(),
+		Context:    context.Background(),
+		NotifyFunc: func(ctx context.Context, expr string, alerts ...*rules.Alert) {},
+		Logger:     log.NewNopLogger(),
+		Metrics:    rules.NewGroupMetrics(nil),
+	}
+	externalLabels := labels.FromMap(tg.ExternalLabels)
+
+	ruleGroups := make([]*rules.Group, 0, len(groups))
+	for _, group := range groups {
+		groupRules := make([]rules.Rule, 0, len(group.Rules))
+		for _, rule := range group.Rules {
+			expr, err := promql.ParseExpr(rule.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %s", group.Name, err)
+			}
+			ruleLabels := make(map[string]string)
+			for name, value := range group.Labels {
+				ruleLabels[name] = value
+			}
+			for name, value := range rule.Labels {
+				ruleLabels[name] = value
+			}
+
+			if rule.Record != "" {
+				groupRules = append(groupRules, rules.NewRecordingRule(rule.Record, expr, labels.FromMap(ruleLabels)))
+				continue
+			}
+			groupRules = append(groupRules, rules.NewAlertingRule(rule.Alert, expr, time.Duration(rule.For),
+				labels.FromMap(ruleLabels), labels.FromMap(rule.Annotations), externalLabels, false, opts.Logger))
+		}
+
+		groupInterval := interval
+		if group.Interval != 0 {
+			groupInterval = time.Duration(group.Interval)
+		}
+		ruleGroups = append(ruleGroups, rules.NewGroup(group.Name, "", groupInterval, groupRules, false, opts))
+	}
+	return ruleGroups, nil
+}
+
+// check compares the firing alerts of test.Alertname with the expected ones.
+func (test *alertTestCase) check(groups []*rules.Group) error {
+	got := make([]string, 0)
+	for _, group := range groups {
+		for _, rule := range group.Rules() {
+			alerting, ok := rule.(*rules.AlertingRule)
+			if !ok || alerting.Name() != test.Alertname {
+				continue
+			}
+			for _, alert := range alerting.ActiveAlerts() {
+				if alert.State == rules.StateFiring {
+					got = append(got, alertString(alert.Labels, alert.Annotations))
+				}
+			}
+		}
+	}
+
+	expected := make([]string, 0, len(test.ExpAlerts))
+	for _, alert := range test.ExpAlerts {
+		// the alertname label is added by prometheus
+		expLabels := map[string]string{labels.AlertName: test.Alertname}
+		for name, value := range alert.ExpLabels {
+			expLabels[name] = value
+		}
+		expected = append(expected, alertString(labels.FromMap(expLabels), labels.FromMap(alert.ExpAnnotations)))
+	}
+
+	sort.Strings(got)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		return fmt.Errorf("at %s expected alerts [%s], got [%s]", test.EvalTime, strings.Join(expected, ", "), strings.Join(got, ", "))
+	}
+	return nil
+}
+
+func alertString(alertLabels, annotations labels.Labels) string {
+	return "Labels:" + alertLabels.String() + " Annotations:" + annotations.String()
+}
+
+// check runs test.Expr at its eval_time and compares the result with the
+// expected samples.
+func (test *promqlTestCase) check(suite *promql.LazyLoader, mint time.Time) error {
+	query, err := suite.QueryEngine().NewInstantQuery(suite.Queryable(), test.Expr, mint.Add(time.Duration(test.EvalTime)))
+	if err != nil {
+		return fmt.Errorf("expr %q: %s", test.Expr, err)
+	}
+	defer query.Close()
+	result := query.Exec(suite.Context())
+	if result.Err != nil {
+		return fmt.Errorf("expr %q at %s: %s", test.Expr, test.EvalTime, result.Err)
+	}
+
+	got := make([]string, 0)
+	switch value := result.Value.(type) {
+	case promql.Vector:
+		for _, sample := range value {
+			got = append(got, sampleString(sample.Metric, sample.V))
+		}
+	case promql.Scalar:
+		got = append(got, sampleString(labels.Labels{}, value.V))
+	default:
+		return fmt.Errorf("expr %q: result is not a vector or scalar", test.Expr)
+	}
+
+	expected := make([]string, 0, len(test.ExpSamples))
+	for _, sample := range test.ExpSamples {
+		metric, err := promql.ParseMetric(sample.Labels)
+		if err != nil {
+			return fmt.Errorf("expr %q: labels %q: %s", test.Expr, sample.Labels, err)
+		}
+		expected = append(expected, sampleString(metric, sample.Value))
+	}
+
+	sort.Strings(got)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		return fmt.Errorf("expr %q at %s expected [%s], got [%s]", test.Expr, test.EvalTime, strings.Join(expected, ", "), strings.Join(got, ", "))
+	}
+	return nil
+}
+
+func sampleString(metric labels.Labels, value float64) string {
+	return metric.String() + " " + strconv.FormatFloat(value, 'E', -1, 64)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	unitTestRules = `
+groups:
+- name: http
+  rules:
+  - record: job:http_errors:rate5m
+    expr: sum by (job) (rate(http_errors_total[5m]))
+  - alert: HighErrorRate
+    expr: job:http_errors:rate5m > 0.1
+    for: 5m
+    labels:
+      severity: page
+    annotations:
+      summary: '{{ $labels.job }} fails'
+`
+	passingUnitTests = `
+rule_files: [rules]
+evaluation_interval: 1m
+tests:
+- interval: 1m
+  input_series:
+  - series: 'http_errors_total{job="api",instance="a"}'
+    values: '0+60x20'
+  alert_rule_test:
+  - eval_time: 2m
+    alertname: HighErrorRate
+    exp_alerts: []
+  - eval_time: 15m
+    alertname: HighErrorRate
+    exp_alerts:
+    - exp_labels:
+        severity: page
+        job: api
+      exp_annotations:
+        summary: api fails
+  promql_expr_test:
+  - expr: job:http_errors:rate5m
+    eval_time: 10m
+    exp_samples:
+    - labels: 'job:http_errors:rate5m{job="api"}'
+      value: 1
+`
+	failingUnitTests = `
+tests:
+- input_series:
+  - series: 'http_errors_total{job="api"}'
+    values: '0+60x20'
+  alert_rule_test:
+  - eval_time: 15m
+    alertname: HighErrorRate
+    exp_alerts:
+    - exp_labels:
+        severity: ticket
+        job: api
+`
+)
+
+func unitTestConfigMap(tests string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "tested",
+			Namespace:   "team-a",
+			Annotations: map[string]string{myAnno: "true"},
+		},
+		Data: map[string]string{"rules": unitTestRules, "rules.test.yaml": tests},
+	}
+}
+
+func TestUnitTests(t *testing.T) {
+	Convey("Passing unit tests should load the rules", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, unitTestConfigMap(passingUnitTests))
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(len(mrg.Reports), ShouldEqual, 2)
+		So(mrg.Reports[1].Key, ShouldEqual, "rules.test.yaml")
+		So(mrg.Reports[1].Accepted, ShouldBeTrue)
+		So(events.CountWarnings(), ShouldEqual, 0)
+	})
+
+	Convey("Failing unit tests should reject all rules of the configmap", t, func() {
+		events.Clear()
+		mrg := c.extractValues(pipeline, unitTestConfigMap(failingUnitTests))
+		So(mrg.Values, ShouldBeEmpty)
+		So(mrg.Reports[0].Accepted, ShouldBeFalse)
+		So(mrg.Reports[0].Errors[0].Error(), ShouldContainSubstring, "the unit tests in rules.test.yaml failed")
+		So(len(mrg.Reports[1].Errors), ShouldEqual, 1)
+		So(mrg.Reports[1].Errors[0].Error(), ShouldContainSubstring, `at 15m expected alerts [Labels:{alertname="HighErrorRate", job="api", severity="ticket"} Annotations:{}], got [Labels:{alertname="HighErrorRate", job="api", severity="page"} Annotations:{summary="api fails"}]`)
+		So(events.CountWarnings(), ShouldEqual, 2)
+	})
+
+	Convey("Broken unit test keys should fail", t, func() {
+		broken := []string{
+			`tests: []`,
+			strings.Replace(passingUnitTests, "rule_files: [rules]", "rule_files: [other]", 1),
+			"tests:\n- input_series:\n  - series: 'up'\n    values: 'one two'\n",
+			"tests:\n- expected: nothing\n",
+			"evaluation_interval: 1s\ntests:\n- promql_expr_test:\n  - expr: up\n    eval_time: 1d\n",
+			"tests:\n- input_series:\n  - series: 'up'\n    values: '0+1x100000000'\n",
+		}
+		for _, tests := range broken {
+			mrg := c.extractValues(pipeline, unitTestConfigMap(tests))
+			So(mrg.Values, ShouldBeEmpty)
+			So(mrg.Reports[1].Errors, ShouldNotBeEmpty)
+		}
+	})
+
+	Convey("Compressed unit test keys should be run against compressed rules", t, func() {
+		events.Clear()
+		cm := unitTestConfigMap("")
+		cm.Data = nil
+		cm.BinaryData = map[string][]byte{
+			"rules.gz":           gzipValue(unitTestRules),
+			"rules.test.yaml.gz": gzipValue(passingUnitTests),
+		}
+		So(isUnitTestKey("rules.test.yaml.gz"), ShouldBeTrue)
+		So(isUnitTestKey("rules.gz"), ShouldBeFalse)
+
+		mrg := c.extractValues(pipeline, cm)
+		So(len(mrg.Values), ShouldEqual, 1)
+		So(len(mrg.Reports), ShouldEqual, 2)
+		So(mrg.Reports[1].Key, ShouldEqual, "rules.test.yaml.gz")
+		So(mrg.Reports[1].Accepted, ShouldBeTrue)
+		So(events.CountWarnings(), ShouldEqual, 0)
+	})
+
+	Convey("A test that panics should fail instead of crashing", t, func() {
+		var tg *unitTestGroup
+		errs := tg.run(time.Minute, nil)
+		So(len(errs), ShouldEqual, 1)
+		So(errs[0].Error(), ShouldContainSubstring, "unable to run the tests")
+	})
+
+	Convey("Unit tests should run in the background once per content", t, func() {
+		events.Clear()
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		up, err := NewPipeline(PipelineConfig{Name: "tested", Annotation: myAnno})
+		So(err, ShouldBeNil)
+		defer up.workqueue.ShutDown()
+		uc := &Controller{
+			configmapsLister:           corev1listers.NewConfigMapLister(indexer),
+			configmapEventRecorderFunc: events.Add,
+			unitTests:                  newUnitTestRunner(),
+		}
+
+		mrg := uc.extractValues(up, unitTestConfigMap(failingUnitTests))
+		So(mrg.Pending, ShouldBeTrue)
+		So(mrg.Reports[1].Warnings[0].Error(), ShouldContainSubstring, "still running")
+
+		// the configmap is requeued once the result is in
+		key, shutdown := up.workqueue.Get()
+		So(shutdown, ShouldBeFalse)
+		So(key, ShouldEqual, "team-a/tested")
+		up.workqueue.Done(key)
+
+		mrg = uc.extractValues(up, unitTestConfigMap(failingUnitTests))
+		So(mrg.Pending, ShouldBeFalse)
+		So(mrg.Values, ShouldBeEmpty)
+		So(mrg.Reports[1].Errors, ShouldNotBeEmpty)
+		So(len(uc.unitTests.results), ShouldEqual, 1)
+
+		// other rules are other tests
+		mrg = uc.extractValues(up, unitTestConfigMap(passingUnitTests))
+		So(mrg.Pending, ShouldBeTrue)
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
+)
+
+// ValidationError is a single problem found in a configmap key. Group, Rule
+// and Field are filled in as far as they are known, a key that can't be
+// parsed at all only carries Err.
+type ValidationError struct {
+	Group  string
+	Rule   string
+	Field  string
+	Policy string
+	// Document is which document of a key holding several the problem is
+	// in, counting from 1, 0 if the key holds a single one
+	Document int
+	// Line and Column are where in the value of the key the problem is, 0
+	// if unknown
+	Line   int
+	Column int
+	Err    error
+}
+
+func (v ValidationError) Error() string {
+	parts := make([]string, 0, 8)
+	if v.Group != "" {
+		parts = append(parts, fmt.Sprintf("GroupName: %s", v.Group))
+	}
+	if v.Rule != "" {
+		parts = append(parts, fmt.Sprintf("Rule Name/Record: %s", v.Rule))
+	}
+	if v.Document > 0 {
+		parts = append(parts, fmt.Sprintf("Document: %d", v.Document))
+	}
+	if v.Line > 0 {
+		parts = append(parts, fmt.Sprintf("Line: %d", v.Line))
+	}
+	if v.Column > 0 {
+		parts = append(parts, fmt.Sprintf("Column: %d", v.Column))
+	}
+	if v.Field != "" {
+		parts = append(parts, fmt.Sprintf("Field: %s", v.Field))
+	}
+	if v.Policy != "" {
+		parts = append(parts, fmt.Sprintf("Policy: %s", v.Policy))
+	}
+	parts = append(parts, fmt.Sprintf("Error: %s", v.Err))
+	return strings.Join(parts, ", ")
+}
+
+func (v ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Group    string `json:"group,omitempty"`
+		Rule     string `json:"rule,omitempty"`
+		Field    string `json:"field,omitempty"`
+		Policy   string `json:"policy,omitempty"`
+		Document int    `json:"document,omitempty"`
+		Line     int    `json:"line,omitempty"`
+		Column   int    `json:"column,omitempty"`
+		Error    string `json:"error"`
+	}{v.Group, v.Rule, v.Field, v.Policy, v.Document, v.Line, v.Column, v.Err.Error()})
+}
+
+// ValidationReport is the outcome of loading a single key of a rule configmap.
+type ValidationReport struct {
+	ConfigMap string            `json:"-"`
+	Key       string            `json:"key"`
+	Accepted  bool              `json:"accepted"`
+	Groups    int               `json:"groups"`
+	Rules     int               `json:"rules"`
+	Errors    []ValidationError `json:"errors,omitempty"`
+	// Warnings are problems that did not stop a rule from being loaded.
+	Warnings []ValidationError `json:"warnings,omitempty"`
+}
+
+// validateRule runs the same checks as rulefmt.Rule.Validate but keeps track
+// of the field that each error belongs to. Expressions are checked in the
+// query language of the pipeline.
+func (c *Controller) validateRule(language string, group string, r rulefmt.Rule) []ValidationError {
+	name := r.Alert
+	// recording rules have no names so therefore we'll use the value of "Record" in the error
+	if name == "" {
+		name = r.Record
+	}
+
+	errs := make([]ValidationError, 0)
+	add := func(field string, err error) {
+		errs = append(errs, ValidationError{Group: group, Rule: name, Field: field, Err: err})
+	}
+
+	if r.Record != "" && r.Alert != "" {
+		add("record", fmt.Errorf("only one of 'record' and 'alert' must be set"))
+	}
+	if r.Record == "" && r.Alert == "" {
+		add("record", fmt.Errorf("one of 'record' or 'alert' must be set"))
+	}
+
+	if r.Expr == "" {
+		add("expr", fmt.Errorf("field 'expr' must be set in rule"))
+	} else if err := validateExpr(language, r.Expr); err != nil {
+		add("expr", err)
+	}
+
+	if r.Record != "" {
+		if len(r.Annotations) > 0 {
+			add("annotations", fmt.Errorf("invalid field 'annotations' in recording rule"))
+		}
+		if r.For != 0 {
+			add("for", fmt.Errorf("invalid field 'for' in recording rule"))
+		}
+		if !model.IsValidMetricName(model.LabelValue(r.Record)) {
+			add("record", fmt.Errorf("invalid recording rule name: %s", r.Record))
+		}
+	}
+
+	// maps are walked in sorted order, the status annotation must not change
+	// between rebuilds of the same rules
+	for _, k := range sortedKeys(r.Labels) {
+		v := r.Labels[k]
+		if !model.LabelName(k).IsValid() {
+			add("labels."+k, fmt.Errorf("invalid label name: %s", k))
+		}
+		if !model.LabelValue(v).IsValid() {
+			add("labels."+k, fmt.Errorf("invalid label value: %s", v))
+		}
+	}
+
+	for _, k := range sortedKeys(r.Annotations) {
+		if !model.LabelName(k).IsValid() {
+			add("annotations."+k, fmt.Errorf("invalid annotation name: %s", k))
+		}
+	}
+
+	// only alerting rules are templated
+	if r.Alert != "" {
+		for _, k := range sortedKeys(r.Labels) {
+			if err := c.parseAlertTemplate(r.Alert, r.Labels[k]); err != nil {
+				add("labels."+k, err)
+			}
+		}
+		for _, k := range sortedKeys(r.Annotations) {
+			if err := c.parseAlertTemplate(r.Alert, r.Annotations[k]); err != nil {
+				add("annotations."+k, err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func validateExpr(language, expr string) error {
+	if language == LanguageLogQL {
+		if err := validateLogQL(expr); err != nil {
+			return fmt.Errorf("could not parse LogQL expression: %s", err)
+		}
+		return nil
+	}
+	if _, err := promql.ParseExpr(expr); err != nil {
+		return fmt.Errorf("could not parse expression: %s", err)
+	}
+	return nil
+}
+
+// validateRuleGroup runs the group level checks of RuleGroups.Validate
+// on a single group. seen carries the group names already used in the same
+// key, a repeated name is an error for every group after the first. The same
+// goes for the names of the rules within the group.
+func (c *Controller) validateRuleGroup(group RuleGroup, seen map[string]struct{}) []ValidationError {
+	errs := make([]ValidationError, 0)
+
+	if group.Name == "" {
+		errs = append(errs, ValidationError{Field: "name", Err: fmt.Errorf("Groupname should not be empty")})
+	} else {
+		if _, ok := seen[group.Name]; ok {
+			errs = append(errs, ValidationError{Group: group.Name, Field: "name", Err: fmt.Errorf("groupname: \"%s\" is repeated in the same key", group.Name)})
+		}
+		seen[group.Name] = struct{}{}
+	}
+
+	if group.Interval < 0 {
+		errs = append(errs, ValidationError{Group: group.Name, Field: "interval", Err: fmt.Errorf("interval must not be negative")})
+	}
+	if group.QueryOffset < 0 {
+		errs = append(errs, ValidationError{Group: group.Name, Field: "query_offset", Err: fmt.Errorf("query_offset must not be negative")})
+	}
+	if group.Limit < 0 {
+		errs = append(errs, ValidationError{Group: group.Name, Field: "limit", Err: fmt.Errorf("limit must not be negative")})
+	}
+	for _, name := range sortedKeys(group.Labels) {
+		if !model.LabelName(name).IsValid() {
+			errs = append(errs, ValidationError{Group: group.Name, Field: "labels", Err: fmt.Errorf("invalid label name: %s", name)})
+		}
+	}
+
+	rules := make(map[string]struct{})
+	for _, r := range group.Rules {
+		name := r.Alert
+		if name == "" {
+			name = r.Record
+		}
+		if name == "" {
+			// reported by validateRule
+			continue
+		}
+		if _, ok := rules[name]; ok {
+			errs = append(errs, ValidationError{Group: group.Name, Rule: name, Field: "rules", Err: fmt.Errorf("rule %q is repeated in the group", name)})
+		}
+		rules[name] = struct{}{}
+	}
+
+	return errs
+}
+
+// parseAlertTemplate is lifted from rulefmt's testTemplateParsing.
+func (c *Controller) parseAlertTemplate(alert string, text string) error {
+	tmplData := template.AlertTemplateData(map[string]string{}, map[string]string{}, 0)
+	defs := []string{
+		"{{$labels := .Labels}}",
+		"{{$externalLabels := .ExternalLabels}}",
+		"{{$value := .Value}}",
+	}
+	tmpl := template.NewTemplateExpander(
+		context.TODO(),
+		strings.Join(append(defs, text), ""),
+		"__alert_"+alert,
+		tmplData,
+		model.Time(timestamp.FromTime(time.Now())),
+		nil,
+		nil,
+	)
+	return tmpl.ParseTest()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	WebhookModeDeny = "deny"
+	WebhookModeWarn = "warn"
+
+	webhookPath = "/validate"
+	// maxAdmissionReviewBytes is well above the api server's limit for a configmap
+	maxAdmissionReviewBytes = 3 * 1024 * 1024
+)
+
+// admissionResponse is the v1beta1 AdmissionResponse plus the warnings field
+// api servers from 1.19 on show to the client, older ones ignore it.
+type admissionResponse struct {
+	*admissionv1beta1.AdmissionResponse `json:",inline"`
+	Warnings                            []string `json:"warnings,omitempty"`
+}
+
+type admissionReviewResponse struct {
+	metav1.TypeMeta `json:",inline"`
+	Response        *admissionResponse `json:"response"`
+}
+
+// admissionWebhook validates rule configmaps when they are created or
+// updated, the same way the controller loads them. In WebhookModeDeny a
+// configmap with a key that doesn't load or a rule that fails validation is
+// denied, in WebhookModeWarn it is let through with admission warnings.
+type admissionWebhook struct {
+	controller *Controller
+	mode       string
+}
+
+func (w *admissionWebhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxAdmissionReviewBytes))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Unable to read request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	review := admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(rw, "request is not an AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	out, err := json.Marshal(admissionReviewResponse{
+		TypeMeta: review.TypeMeta,
+		Response: w.review(review.Request),
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(out)
+}
+
+// review decides on a single admission request. Anything that isn't the
+// creation or update of a configmap some pipeline loads is allowed.
+func (w *admissionWebhook) review(request *admissionv1beta1.AdmissionRequest) *admissionResponse {
+	response := &admissionResponse{AdmissionResponse: &admissionv1beta1.AdmissionResponse{UID: request.UID, Allowed: true}}
+	if request.Kind.Kind != "ConfigMap" || (request.Operation != admissionv1beta1.Create && request.Operation != admissionv1beta1.Update) {
+		return response
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := json.Unmarshal(request.Object.Raw, cm); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusBadRequest, Reason: metav1.StatusReasonBadRequest, Message: fmt.Sprintf("Unable to decode configmap: %s", err)}
+		return response
+	}
+	// the name and namespace are missing from the object when they are generated
+	if cm.Namespace == "" {
+		cm.Namespace = request.Namespace
+	}
+	if cm.Name == "" {
+		cm.Name = request.Name
+	}
+
+	problems, warnings := w.validate(cm)
+	response.Warnings = warnings
+	if len(problems) == 0 {
+		return response
+	}
+
+	klog.Infof("Admission review of configmap %s/%s found %d problems.", cm.Namespace, cm.Name, len(problems))
+	if w.mode == WebhookModeWarn {
+		response.Warnings = make([]string, 0, len(problems)+len(warnings))
+		response.Warnings = append(response.Warnings, problems...)
+		response.Warnings = append(response.Warnings, warnings...)
+		return response
+	}
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusUnprocessableEntity,
+		Reason:  metav1.StatusReasonInvalid,
+		Message: fmt.Sprintf("rules of configmap %s/%s failed validation: %s", cm.Namespace, cm.Name, strings.Join(problems, "; ")),
+	}
+	return response
+}
+
+// validate loads cm for every pipeline that selects it and returns what kept
+// rules from loading and the warnings, each message only once. No events
+// are recorded, the configmap doesn't exist in this form yet.
+func (w *admissionWebhook) validate(cm *corev1.ConfigMap) ([]string, []string) {
+	w.controller.settingsLock.RLock()
+	defer w.controller.settingsLock.RUnlock()
+
+	checker := &Controller{
+		configmapEventRecorderFunc: func(cm *corev1.ConfigMap, eventtype, reason, msg string) {},
+		listConfigMaps:             w.controller.listConfigMaps,
+		// tests that didn't run yet don't hold up the review, the rebuild
+		// rejects the rules when they fail
+		unitTests: w.controller.unitTests,
+	}
+
+	problems := make([]string, 0)
+	warnings := make([]string, 0)
+	seen := make(map[string]struct{})
+	add := func(list *[]string, message string) {
+		if _, ok := seen[message]; ok {
+			return
+		}
+		seen[message] = struct{}{}
+		*list = append(*list, message)
+	}
+
+	for _, p := range w.controller.pipelines {
+		if !w.controller.isRuleConfigMap(p, cm) {
+			continue
+		}
+		if ok, _ := w.controller.isNamespaceAllowed(cm); !ok {
+			continue
+		}
+
+		mrg := checker.extractValues(p, cm)
+		for _, report := range mrg.Reports {
+			for _, verr := range report.Errors {
+				add(&problems, fmt.Sprintf("key %s: %s", report.Key, verr.Error()))
+			}
+			if !report.Accepted && len(report.Errors) == 0 {
+				add(&problems, fmt.Sprintf("key %s: no valid rules", report.Key))
+			}
+			for _, verr := range report.Warnings {
+				add(&warnings, fmt.Sprintf("key %s: %s", report.Key, verr.Error()))
+			}
+		}
+	}
+
+	return problems, warnings
+}
+
+// serveWebhook serves the admission webhook with TLS, the api server only
+// calls webhooks over https.
+func serveWebhook(address, certFile, keyFile string, webhook *admissionWebhook) {
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, webhook)
+
+	klog.Infof("Serving the admission webhook on %s%s", address, webhookPath)
+	if err := http.ListenAndServeTLS(address, certFile, keyFile, mux); err != nil {
+		klog.Fatalf("Error serving the admission webhook: %s", err.Error())
+	}
+}
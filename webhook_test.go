@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// admissionReviewFixture is the review the api server sends for operation on cm.
+func admissionReviewFixture(operation admissionv1beta1.Operation, cm *corev1.ConfigMap) []byte {
+	object, _ := json.Marshal(cm)
+	review := admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       "705ab4f5-6393-11e8-b7cc-42010a800002",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+			Name:      cm.Name,
+			Namespace: cm.Namespace,
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: object},
+		},
+	}
+	out, _ := json.Marshal(review)
+	return out
+}
+
+// postReview sends body to the webhook and decodes the response including
+// the warnings.
+func postReview(url string, body []byte) (int, map[string]interface{}) {
+	resp, err := http.Post(url+webhookPath, "application/json", bytes.NewReader(body))
+	So(err, ShouldBeNil)
+	defer resp.Body.Close()
+
+	out, _ := ioutil.ReadAll(resp.Body)
+	review := make(map[string]interface{})
+	json.Unmarshal(out, &review)
+	response, _ := review["response"].(map[string]interface{})
+	return resp.StatusCode, response
+}
+
+func brokenRulesConfigMap() *corev1.ConfigMap {
+	cm := configmapDataBlockRules.DeepCopy()
+	cm.Data = map[string]string{
+		"rules": strings.Replace(configmapDataBlockRules.Data["rules"], "expr: ", "expr: sum(( ", 1),
+		"junk":  "just: [some, yaml",
+	}
+	return cm
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	mux := http.NewServeMux()
+	deny := &admissionWebhook{controller: c, mode: WebhookModeDeny}
+	mux.Handle(webhookPath, deny)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	Convey("Valid rule configmaps should be allowed", t, func() {
+		status, response := postReview(server.URL, admissionReviewFixture(admissionv1beta1.Create, &configmapDataBlockRules))
+		So(status, ShouldEqual, http.StatusOK)
+		So(response["uid"], ShouldEqual, "705ab4f5-6393-11e8-b7cc-42010a800002")
+		So(response["allowed"], ShouldEqual, true)
+		So(response["warnings"], ShouldBeNil)
+	})
+
+	Convey("Rule configmaps that fail validation should be denied with the reasons", t, func() {
+		events.Clear()
+		status, response := postReview(server.URL, admissionReviewFixture(admissionv1beta1.Update, brokenRulesConfigMap()))
+		So(status, ShouldEqual, http.StatusOK)
+		So(response["allowed"], ShouldEqual, false)
+
+		result := response["status"].(map[string]interface{})
+		So(result["code"], ShouldEqual, http.StatusUnprocessableEntity)
+		So(result["message"], ShouldContainSubstring, "key junk: Line: 1, Error: invalid YAML: did not find expected ',' or ']'")
+		So(result["message"], ShouldContainSubstring, "key rules: ")
+		So(result["message"], ShouldContainSubstring, "Field: expr")
+		// nothing is recorded on a configmap under review
+		So(events.Events, ShouldBeEmpty)
+	})
+
+	Convey("Configmaps no pipeline loads and deletes should always be allowed", t, func() {
+		_, response := postReview(server.URL, admissionReviewFixture(admissionv1beta1.Create, &configmapNoAnnotation))
+		So(response["allowed"], ShouldEqual, true)
+
+		_, response = postReview(server.URL, admissionReviewFixture(admissionv1beta1.Delete, brokenRulesConfigMap()))
+		So(response["allowed"], ShouldEqual, true)
+	})
+
+	Convey("In warn mode failing configmaps should be allowed with warnings", t, func() {
+		warn := httptest.NewServer(&admissionWebhook{controller: c, mode: WebhookModeWarn})
+		defer warn.Close()
+
+		_, response := postReview(warn.URL, admissionReviewFixture(admissionv1beta1.Create, brokenRulesConfigMap()))
+		So(response["allowed"], ShouldEqual, true)
+		So(response["status"], ShouldBeNil)
+		warnings := response["warnings"].([]interface{})
+		So(len(warnings), ShouldBeGreaterThanOrEqualTo, 2)
+	})
+
+	Convey("Requests that aren't admission reviews should be rejected", t, func() {
+		resp, err := http.Post(server.URL+webhookPath, "application/json", strings.NewReader(`{"kind": "Pod"}`))
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+		resp, err = http.Get(server.URL + webhookPath)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}